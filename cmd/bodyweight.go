@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var bodyweightCmd = &cobra.Command{
+	Use:   "bodyweight",
+	Short: "Record and list weigh-ins",
+	Long: `Record the bodyweight of --user. Bodyweight sets such as "pullup bw+20 x5"
+count the weigh-in on or before their day towards volume, e1RM and PRs.`,
+}
+
+var bodyweightLogCmd = &cobra.Command{
+	Use:   "log <weight>",
+	Short: "Record a weigh-in",
+	Long: `Record a weigh-in such as 82.5, 82.5kg or 180lb, replacing any other
+weigh-in that day. A weight without a unit is in --unit, or the user's unit.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		date, _ := flags.GetString("date")
+		unit, _ := flags.GetString("unit")
+
+		num := strings.TrimRightFunc(args[0], func(r rune) bool {
+			return r < '0' || r > '9'
+		})
+		weight, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			exit(err, "strconv.ParseFloat")
+		}
+		if suffix := strings.TrimSpace(args[0][len(num):]); suffix != "" {
+			unit = suffix
+		}
+
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		units, err := server.UnitsFor(user(), unit)
+		if err != nil {
+			exit(err, "server.UnitsFor")
+		}
+
+		weighin, err := server.LogWeighin(user(), cliSession, server.Weighin{
+			Date:   date,
+			Weight: weight,
+			Unit:   unit,
+		}, loc)
+		if err != nil {
+			exit(err, "server.LogWeighin")
+		}
+
+		printWeighins([]server.Weighin{*weighin}, units)
+	},
+}
+
+var bodyweightListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List weigh-ins",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		from, _ := flags.GetString("from")
+		to, _ := flags.GetString("to")
+		unit, _ := flags.GetString("unit")
+
+		now := time.Now().In(loc)
+		if to == "" {
+			to = now.Format("2006-01-02")
+		}
+		if from == "" {
+			from = now.AddDate(-1, 0, 0).Format("2006-01-02")
+		}
+
+		units, err := server.UnitsFor(user(), unit)
+		if err != nil {
+			exit(err, "server.UnitsFor")
+		}
+
+		weighins, err := server.Weighins(user(), from, to)
+		if err != nil {
+			exit(err, "server.Weighins")
+		}
+
+		printWeighins(weighins, units)
+	},
+}
+
+func printWeighins(weighins []server.Weighin, units server.Units) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tWEIGHT")
+	for _, w := range units.Weighins(weighins) {
+		fmt.Fprintf(tw, "%s\t%s%s\n", w.Date, strconv.FormatFloat(w.Weight, 'f', -1, 64), w.Unit)
+	}
+	tw.Flush()
+}
+
+func init() {
+	RootCmd.AddCommand(bodyweightCmd)
+	bodyweightCmd.AddCommand(bodyweightLogCmd, bodyweightListCmd)
+
+	bodyweightLogCmd.Flags().String("date", "", "day of the weigh-in as YYYY-MM-DD (default today)")
+	bodyweightLogCmd.Flags().String("unit", "", "unit of a weight without one (default the user's unit)")
+
+	bodyweightListCmd.Flags().String("from", "", "first day as YYYY-MM-DD (default a year ago)")
+	bodyweightListCmd.Flags().String("to", "", "last day as YYYY-MM-DD (default today)")
+	bodyweightListCmd.Flags().String("unit", "", "unit to show weights in (default the user's unit)")
+}
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write day documents as JSON lines",
+	Long: `Write every day document between --from and --to as one JSON document per
+line, to stdout or the file given by --output, with every weight in the unit
+it was logged in. The output can be read back with import.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		from, _ := flags.GetString("from")
+		to, _ := flags.GetString("to")
+		output, _ := flags.GetString("output")
+
+		now := time.Now().In(loc)
+		if to == "" {
+			to = now.Format("2006-01-02")
+		}
+		if from == "" {
+			from = now.AddDate(-1, 0, 0).Format("2006-01-02")
+		}
+
+		docs, err := userStore(store).Range(from, to)
+		if err != nil {
+			exit(err, "store.Range")
+		}
+
+		var out io.Writer = os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			if err != nil {
+				exit(err, "os.Create")
+			}
+			defer f.Close()
+			out = f
+		}
+
+		enc := json.NewEncoder(out)
+		for _, doc := range docs {
+			if err := enc.Encode(server.AsLogged(doc)); err != nil {
+				exit(err, "enc.Encode")
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().String("from", "", "first day to export as YYYY-MM-DD (default a year ago)")
+	exportCmd.Flags().String("to", "", "last day to export as YYYY-MM-DD (default today)")
+	exportCmd.Flags().StringP("output", "o", "", "file to write to (default stdout)")
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import [file]",
+	Short: "Read day documents written by export",
+	Long: `Read day documents, one JSON document per line, from the file or stdin.
+Each day replaces the stored one unless --merge is given.
+
+"import gpx" and "import tcx" read activities recorded by a GPS watch instead.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		merge, _ := cmd.Flags().GetBool("merge")
+
+		var in io.Reader = os.Stdin
+		if len(args) == 1 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				exit(err, "os.Open")
+			}
+			defer f.Close()
+			in = f
+		}
+
+		var docs []*server.Document
+		dec := json.NewDecoder(in)
+		for {
+			doc := &server.Document{}
+			if err := dec.Decode(doc); err == io.EOF {
+				break
+			} else if err != nil {
+				exit(err, "dec.Decode")
+			}
+			docs = append(docs, doc)
+		}
+
+		if err := server.Import(user(), cliSession, docs, merge); err != nil {
+			exit(err, "server.Import")
+		}
+
+		fmt.Printf("Imported %d days\n", len(docs))
+	},
+}
+
+// trackImportCmd returns the command importing GPS files of format.
+func trackImportCmd(format string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   format + " <file>...",
+		Short: "Log the activities recorded in " + strings.ToUpper(format) + " files",
+		Long: `Log the activity recorded in each file on the day it started, with its
+distance, moving time, elevation gain and kilometre splits worked out from the
+track. A file that was already imported is skipped.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			store, loc := openStore(loadConfig())
+			defer store.Close()
+
+			typ, _ := cmd.Flags().GetString("type")
+
+			for _, path := range args {
+				data, err := ioutil.ReadFile(path)
+				if err != nil {
+					exit(err, "ioutil.ReadFile")
+				}
+
+				resp, err := server.ImportTrack(user(), cliSession, format, data, typ, loc)
+				if err != nil {
+					exit(err, "server.ImportTrack")
+				}
+
+				if resp.DuplicateActivities > 0 {
+					fmt.Printf("%s: already imported on %s\n", path, resp.Date)
+					continue
+				}
+
+				fmt.Printf("%s:\n", path)
+				printActivities(os.Stdout, &server.Document{
+					Date:       resp.Date,
+					Activities: resp.Activities[len(resp.Activities)-1:],
+				})
+			}
+		},
+	}
+
+	cmd.Flags().String("type", "", "activity type to log instead of the one the file gives")
+
+	return cmd
+}
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+	importCmd.AddCommand(trackImportCmd(server.FormatGPX), trackImportCmd(server.FormatTCX))
+
+	importCmd.Flags().Bool("merge", false, "add the imported sets to the stored days instead of replacing them")
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage API keys",
+	Long: `Create, list and revoke the API keys of the account given by --user.
+Requests send a key as "Authorization: Bearer <key>" or "X-API-Key: <key>".`,
+}
+
+var keysCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create an API key and print it",
+	Long: `Create an API key for --user and print it. Only a hash of the key is
+stored, so it cannot be shown again.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if user() == "" {
+			exit(errors.New("--user is required"), "keys create")
+		}
+
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		name, _ := flags.GetString("name")
+		scopes, _ := flags.GetStringSlice("scope")
+
+		key, raw, err := server.CreateAPIKey(user(), name, scopes)
+		if err != nil {
+			exit(err, "server.CreateAPIKey")
+		}
+
+		fmt.Printf("Created key %s with scopes %s:\n%s\n", key.ID, strings.Join(key.Scopes, ","), raw)
+	},
+}
+
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the API keys of a user",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if user() == "" {
+			exit(errors.New("--user is required"), "keys list")
+		}
+
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		keys, err := server.ListAPIKeys(user())
+		if err != nil {
+			exit(err, "server.ListAPIKeys")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED")
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), key.Created.Format("2006-01-02 15:04"))
+		}
+		w.Flush()
+	},
+}
+
+var keysRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revoke an API key",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		if err := server.RevokeAPIKey(args[0]); err != nil {
+			exit(err, "server.RevokeAPIKey")
+		}
+
+		fmt.Printf("Revoked key %s\n", args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysCreateCmd, keysListCmd, keysRevokeCmd)
+
+	keysCreateCmd.Flags().String("name", "", "what the key is for")
+	keysCreateCmd.Flags().StringSlice("scope", []string{"read", "write"}, "scopes of the key: read, write or admin")
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var logCmd = &cobra.Command{
+	Use:   "log <exercise> <sets>...",
+	Short: "Record sets of an exercise",
+	Long: `Record sets written in gym shorthand, for example:
+
+  workout_server log squat 100x5 110x3 120x1@9
+  workout_server log bench 135x5x3, 155x3
+  workout_server log "squat 3x5@225; pullup bw+25 x8; row 60kg 4x10 @8"
+
+Groups are weight x reps, weight x reps x sets, or sets x reps after a
+weight written on its own or followed by @weight. A trailing @ of 10 or less
+is an RPE. A weight of bw is bodyweight, bw+20 adds weight to it and bw-20
+is assistance. Semicolons separate exercises.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		date, _ := flags.GetString("date")
+		unit, _ := flags.GetString("unit")
+		notes, _ := flags.GetString("notes")
+		dryRun, _ := flags.GetBool("dry-run")
+
+		exercises, err := server.ParseShorthand(strings.Join(args, " "))
+		if err != nil {
+			exit(err, "server.ParseShorthand")
+		}
+
+		for _, sets := range exercises {
+			for i := range sets {
+				if sets[i].Unit == "" {
+					sets[i].Unit = unit
+				}
+				sets[i].Notes = notes
+			}
+		}
+
+		doc := &server.Document{
+			Date:      date,
+			Exercises: exercises,
+		}
+
+		if dryRun {
+			printDocuments(os.Stdout, doc)
+			return
+		}
+
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		units, err := server.UnitsFor(user(), unit)
+		if err != nil {
+			exit(err, "server.UnitsFor")
+		}
+
+		resp, err := server.Log(user(), cliSession, doc, loc)
+		if err != nil {
+			exit(err, "server.Log")
+		}
+		resp = units.Response(resp)
+
+		printDocuments(os.Stdout, resp.Document)
+		for _, pr := range resp.PRs {
+			if !pr.First {
+				fmt.Printf("PR: %s %s %v (was %v)\n", pr.Exercise, pr.Type, pr.Value, pr.Previous)
+			}
+		}
+		for _, u := range resp.UnknownExercises {
+			fmt.Printf("Not in the catalog: %s", u.Name)
+			if len(u.Suggestions) > 0 {
+				fmt.Printf(" (did you mean %s?)", strings.Join(u.Suggestions, " or "))
+			}
+			fmt.Println()
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(logCmd)
+
+	logCmd.Flags().String("date", "", "day to log the sets on as YYYY-MM-DD (default today)")
+	logCmd.Flags().String("unit", "", "unit of the weights that do not name one, and to show them in, kg or lb (default the user's unit)")
+	logCmd.Flags().String("notes", "", "notes attached to every set")
+	logCmd.Flags().Bool("dry-run", false, "print the parsed sets without storing them")
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var mailCmd = &cobra.Command{
+	Use:   "mail",
+	Short: "Log workouts sent by email",
+	Long: `Give accounts addresses to mail workouts to, link the addresses replies
+are sent to and ingest workout emails. Each line of a message body is read as
+shorthand, the same as the log command, and the sets are logged for the account
+whose workout address the message was sent to.
+
+"serve" also receives mail on its own when mail.listen or mail.maildir is set
+in the config.`,
+}
+
+var mailIngestCmd = &cobra.Command{
+	Use:   "ingest [file]",
+	Short: "Log the workout in an email message",
+	Long: `Log the workout in an RFC 822 message read from the file or stdin, or with
+--maildir every new message of a maildir, and print what was logged. Replies
+are only sent with --reply.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		maildir, _ := flags.GetString("maildir")
+		reply, _ := flags.GetBool("reply")
+
+		if maildir != "" {
+			logged, err := server.ScanMaildir(maildir)
+			if err != nil {
+				exit(err, "server.ScanMaildir")
+			}
+			fmt.Printf("Logged %d messages\n", logged)
+			return
+		}
+
+		var in io.Reader = os.Stdin
+		if len(args) == 1 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				exit(err, "os.Open")
+			}
+			defer f.Close()
+			in = f
+		}
+
+		result, err := server.Ingest(in, nil)
+		if err != nil {
+			exit(err, "server.Ingest")
+		}
+
+		fmt.Printf("From %s (%s)\n\n%s", result.From, result.User, server.Summary(result))
+
+		if reply {
+			if err := server.Reply(result); err != nil {
+				exit(err, "server.Reply")
+			}
+		}
+	},
+}
+
+var mailAddressCmd = &cobra.Command{
+	Use:   "address",
+	Short: "Print the address a user mails workouts to",
+	Long: `Print the secret address --user mails workouts to, giving them one the
+first time. --rotate replaces it, and mail to the old address is refused.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if user() == "" {
+			exit(errors.New("--user is required"), "mail address")
+		}
+
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		rotate, _ := cmd.Flags().GetBool("rotate")
+
+		address, err := server.MailAddress(user(), rotate)
+		if err != nil {
+			exit(err, "server.MailAddress")
+		}
+
+		fmt.Println(address)
+	},
+}
+
+var mailLinkCmd = &cobra.Command{
+	Use:   "link <address>",
+	Short: "Send a user's workout summaries to an address",
+	Long: `Mail the address a code to confirm it with "mail verify". Once confirmed,
+messages from it are answered with a summary of what was logged.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if user() == "" {
+			exit(errors.New("--user is required"), "mail link")
+		}
+
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		if err := server.LinkEmail(user(), args[0]); err != nil {
+			exit(err, "server.LinkEmail")
+		}
+
+		fmt.Printf("Sent a code to %s; confirm it with \"mail verify %s <code>\"\n", args[0], args[0])
+	},
+}
+
+var mailVerifyCmd = &cobra.Command{
+	Use:   "verify <address> <code>",
+	Short: "Confirm an address with the code it was sent",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if user() == "" {
+			exit(errors.New("--user is required"), "mail verify")
+		}
+
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		if err := server.VerifyEmail(user(), args[0], args[1]); err != nil {
+			exit(err, "server.VerifyEmail")
+		}
+
+		fmt.Printf("Linked %s to %s\n", args[0], user())
+	},
+}
+
+var mailUnlinkCmd = &cobra.Command{
+	Use:   "unlink <address>",
+	Short: "Stop sending workout summaries to an address",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, _ := openStore(loadConfig())
+		defer store.Close()
+
+		if err := server.UnlinkEmail(args[0]); err != nil {
+			exit(err, "server.UnlinkEmail")
+		}
+
+		fmt.Printf("Unlinked %s\n", args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mailCmd)
+	mailCmd.AddCommand(mailIngestCmd, mailAddressCmd, mailLinkCmd, mailVerifyCmd, mailUnlinkCmd)
+
+	mailIngestCmd.Flags().String("maildir", "", "ingest every new message of this maildir instead")
+	mailIngestCmd.Flags().Bool("reply", false, "send the sender the summary as configured under mail")
+	mailAddressCmd.Flags().Bool("rotate", false, "replace the address with a new one")
+}
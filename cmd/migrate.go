@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move workouts logged before accounts into an account",
+	Long: `Move the day documents logged before accounts existed into the account
+given by --user. Days the account already has are merged with the moved ones.
+The account must have been registered through POST /v1/users.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if user() == "" {
+			exit(errors.New("--user is required"), "migrate")
+		}
+
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		from, _ := flags.GetString("from")
+		to, _ := flags.GetString("to")
+
+		now := time.Now().In(loc)
+		if to == "" {
+			to = now.Format("2006-01-02")
+		}
+		if from == "" {
+			from = now.AddDate(-5, 0, 0).Format("2006-01-02")
+		}
+
+		moved, err := server.MigrateLegacy(user(), from, to)
+		if err != nil {
+			exit(err, "server.MigrateLegacy")
+		}
+
+		fmt.Printf("Moved %d days to %s\n", moved, user())
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().String("from", "", "first day to move as YYYY-MM-DD (default five years ago)")
+	migrateCmd.Flags().String("to", "", "last day to move as YYYY-MM-DD (default today)")
+}
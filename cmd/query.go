@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var queryCmd = &cobra.Command{
+	Use:   "query [date]",
+	Short: "Print a day or a range of days as a table",
+	Long: `Print a day, or the range given by --from and --to, as a table.
+With no arguments today is printed. Weights are shown in --unit, or the
+user's preferred unit.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		from, _ := flags.GetString("from")
+		to, _ := flags.GetString("to")
+		unit, _ := flags.GetString("unit")
+
+		units, err := server.UnitsFor(user(), unit)
+		if err != nil {
+			exit(err, "server.UnitsFor")
+		}
+
+		if len(args) == 1 {
+			from, to = args[0], args[0]
+		}
+
+		today := time.Now().In(loc).Format("2006-01-02")
+		if to == "" {
+			to = today
+		}
+		if from == "" {
+			from = to
+		}
+
+		docs, err := userStore(store).Range(from, to)
+		if err != nil {
+			exit(err, "store.Range")
+		}
+
+		if len(docs) == 0 {
+			fmt.Println("No workouts found")
+			return
+		}
+
+		for i, doc := range docs {
+			docs[i] = units.Document(doc)
+		}
+		printDocuments(os.Stdout, docs...)
+	},
+}
+
+// printDocuments writes the sets of the documents as a table.
+func printDocuments(out io.Writer, docs ...*server.Document) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATE\tEXERCISE\tSET\tWEIGHT\tREPS\tRPE\tNOTES")
+
+	for _, doc := range docs {
+		names := make([]string, 0, len(doc.Exercises))
+		for exName := range doc.Exercises {
+			names = append(names, exName)
+		}
+		sort.Strings(names)
+
+		for _, exName := range names {
+			for i, set := range doc.Exercises[exName] {
+				rpe := ""
+				if set.RPE > 0 {
+					rpe = strconv.FormatFloat(set.RPE, 'f', -1, 64)
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n",
+					doc.Date,
+					exName,
+					i+1,
+					set.Load(),
+					set.Reps,
+					rpe,
+					set.Notes,
+				)
+			}
+		}
+	}
+
+	w.Flush()
+
+	printActivities(out, docs...)
+}
+
+// printActivities writes the activities of docs as a table, or nothing when
+// there are none.
+func printActivities(out io.Writer, docs ...*server.Document) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	header := false
+
+	for _, doc := range docs {
+		for _, a := range doc.Activities {
+			if !header {
+				fmt.Fprintln(w, "\nDATE\tACTIVITY\tTIME\tDISTANCE\tPACE\tHR\tNOTES")
+				header = true
+			}
+
+			distance, pace, hr := "", "", ""
+			if a.Distance > 0 {
+				distance = strconv.FormatFloat(a.Distance/1000, 'f', 2, 64) + "km"
+			}
+			if a.Pace > 0 {
+				pace = formatSeconds(a.Pace) + "/km"
+			}
+			if a.AvgHeartRate > 0 {
+				hr = strconv.Itoa(a.AvgHeartRate)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				doc.Date,
+				a.Type,
+				formatSeconds(a.Duration),
+				distance,
+				pace,
+				hr,
+				a.Notes,
+			)
+		}
+	}
+
+	w.Flush()
+}
+
+// formatSeconds writes a duration in seconds as h:mm:ss or m:ss.
+func formatSeconds(seconds float64) string {
+	if seconds <= 0 {
+		return ""
+	}
+
+	s := int(seconds + 0.5)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+func init() {
+	RootCmd.AddCommand(queryCmd)
+
+	queryCmd.Flags().String("from", "", "first day of the range as YYYY-MM-DD")
+	queryCmd.Flags().String("to", "", "last day of the range as YYYY-MM-DD (default today)")
+	queryCmd.Flags().String("unit", "", "unit to show weights in, kg or lb")
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var rebuildCmd = &cobra.Command{
+	Use:   "rebuild",
+	Short: "Rebuild day documents from their write history",
+	Long: `Replace each day document of --user between --from and --to with the
+result of replaying the writes recorded for it, then recompute PRs. Days
+written before the history was kept are left as they are, as are days holding
+sets, activities or weigh-ins missing from their history, which are listed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		from, _ := flags.GetString("from")
+		to, _ := flags.GetString("to")
+
+		now := time.Now().In(loc)
+		if to == "" {
+			to = now.AddDate(0, 0, 1).Format("2006-01-02")
+		}
+		if from == "" {
+			from = now.AddDate(-5, 0, 0).Format("2006-01-02")
+		}
+
+		rebuilt, kept, err := server.Rebuild(user(), from, to)
+		if err != nil {
+			exit(err, "server.Rebuild")
+		}
+
+		fmt.Printf("Rebuilt %d days\n", rebuilt)
+		if len(kept) > 0 {
+			fmt.Printf("Kept %d days holding writes missing from their history: %s\n", len(kept), strings.Join(kept, ", "))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rebuildCmd)
+
+	rebuildCmd.Flags().String("from", "", "first day to rebuild as YYYY-MM-DD (default five years ago)")
+	rebuildCmd.Flags().String("to", "", "last day to rebuild as YYYY-MM-DD (default tomorrow)")
+}
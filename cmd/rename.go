@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+)
+
+var renameCmd = &cobra.Command{
+	Use:   "rename-exercises",
+	Short: "Store exercises logged before the catalog under their catalog IDs",
+	Long: `Rename the exercises of each day of --user between --from and --to to
+their catalog IDs, as writes have done since the catalog was added, so that
+e1RMs, PRs and comparisons include those days. The history and undo records of
+the days are renamed too, and the PRs of the renamed exercises are recomputed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		store, loc := openStore(loadConfig())
+		defer store.Close()
+
+		flags := cmd.Flags()
+		from, _ := flags.GetString("from")
+		to, _ := flags.GetString("to")
+
+		now := time.Now().In(loc)
+		if to == "" {
+			to = now.AddDate(0, 0, 1).Format("2006-01-02")
+		}
+		if from == "" {
+			from = now.AddDate(-5, 0, 0).Format("2006-01-02")
+		}
+
+		renamed, err := server.RenameExercises(user(), from, to)
+		if err != nil {
+			exit(err, "server.RenameExercises")
+		}
+
+		fmt.Printf("Renamed the exercises of %d days\n", renamed)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(renameCmd)
+
+	renameCmd.Flags().String("from", "", "first day to rename as YYYY-MM-DD (default five years ago)")
+	renameCmd.Flags().String("to", "", "last day to rename as YYYY-MM-DD (default tomorrow)")
+}
@@ -17,6 +17,8 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
@@ -26,6 +28,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// cliSession is the session writes from the command line are logged under.
+const cliSession = "cli"
+
 var (
 	cfgFile string
 	logger  *zap.Logger
@@ -34,24 +39,11 @@ var (
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "workout_server",
-	Short: "A brief description of your application",
-	Long: `A longer description that spans multiple lines and likely contains
-examples and usage of using your application. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	// Uncomment the following line if your bare application
-	// has an action associated with it:
-	//	Run: func(cmd *cobra.Command, args []string) { },
-
-	Run: func(cmd *cobra.Command, args []string) {
-		// Start the server and display any errors.
-		if err := server.Start(); err != nil {
-			logger.Error(errors.Wrap(err, "server.Start").Error())
-			os.Exit(200)
-		}
-	},
+	Short: "Log and review workouts",
+	Long: `workout_server records workouts as day documents of exercises and sets.
+
+Run "workout_server serve" to start the HTTP API, or use the log, query,
+export and import commands to work with the same store from the terminal.`,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -64,6 +56,13 @@ func Execute() {
 }
 
 func init() {
+	var err error
+	logger, err = zap.NewDevelopment()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	cobra.OnInitialize(initConfig)
 
 	// Here you will define your flags and configuration settings.
@@ -71,9 +70,109 @@ func init() {
 	// will be global for your application.
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.workout_server.yaml)")
 
-	// Cobra also supports local flags, which will only run
-	// when this action is called directly.
-	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	defaults := server.DefaultConfig()
+	viper.SetDefault("addr", defaults.Addr)
+	viper.SetDefault("read_timeout", defaults.ReadTimeout)
+	viper.SetDefault("write_timeout", defaults.WriteTimeout)
+	viper.SetDefault("idle_timeout", defaults.IdleTimeout)
+	viper.SetDefault("shutdown_timeout", defaults.ShutdownTimeout)
+	viper.SetDefault("timezone", defaults.Timezone)
+	viper.SetDefault("store", defaults.Store)
+	viper.SetDefault("data_dir", defaults.DataDir)
+	viper.SetDefault("couchbase.connection_string", defaults.Couchbase.ConnectionString)
+	viper.SetDefault("couchbase.bucket", defaults.Couchbase.Bucket)
+	viper.SetDefault("couchbase.username", defaults.Couchbase.Username)
+	viper.SetDefault("couchbase.password", defaults.Couchbase.Password)
+	viper.SetDefault("couchbase.connect_timeout", defaults.Couchbase.ConnectTimeout)
+	viper.SetDefault("couchbase.operation_timeout", defaults.Couchbase.OperationTimeout)
+	viper.SetDefault("mail.listen", defaults.Mail.Listen)
+	viper.SetDefault("mail.maildir", defaults.Mail.Maildir)
+	viper.SetDefault("mail.poll_interval", defaults.Mail.PollInterval)
+	viper.SetDefault("mail.from", defaults.Mail.From)
+	viper.SetDefault("mail.relay", defaults.Mail.Relay)
+	viper.SetDefault("mail.outbox", defaults.Mail.Outbox)
+	viper.SetDefault("log_level", defaults.LogLevel)
+	viper.SetDefault("rate_limit", defaults.RateLimit)
+	viper.SetDefault("rate_burst", defaults.RateBurst)
+	viper.SetDefault("features", map[string]bool{})
+	viper.SetDefault("strict_exercises", defaults.StrictExercises)
+	viper.SetDefault("unit", defaults.Unit)
+	viper.SetDefault("e1rm_formula", defaults.E1RMFormula)
+	viper.SetDefault("cors_origins", []string{})
+	viper.SetDefault("token_ttl", defaults.TokenTTL)
+	viper.SetDefault("idempotency_ttl", defaults.IdempotencyTTL)
+	viper.SetDefault("token_secret", defaults.TokenSecret)
+
+	flags := RootCmd.PersistentFlags()
+	flags.String("addr", defaults.Addr, "address the HTTP API listens on")
+	flags.String("timezone", defaults.Timezone, "IANA timezone used to bucket workouts into days")
+	flags.String("store", defaults.Store, "storage backend: couchbase, memory or file")
+	flags.String("data-dir", defaults.DataDir, "directory of the file store")
+	flags.String("couchbase", defaults.Couchbase.ConnectionString, "couchbase connection string")
+	flags.String("bucket", defaults.Couchbase.Bucket, "couchbase bucket")
+	flags.String("user", "", "account whose workouts the command works with (default the shared pre-account workouts)")
+	viper.BindPFlag("addr", flags.Lookup("addr"))
+	viper.BindPFlag("timezone", flags.Lookup("timezone"))
+	viper.BindPFlag("store", flags.Lookup("store"))
+	viper.BindPFlag("data_dir", flags.Lookup("data-dir"))
+	viper.BindPFlag("couchbase.connection_string", flags.Lookup("couchbase"))
+	viper.BindPFlag("couchbase.bucket", flags.Lookup("bucket"))
+	viper.BindPFlag("user", flags.Lookup("user"))
+}
+
+// exit logs err and stops the command.
+func exit(err error, context string) {
+	logger.Error(errors.Wrap(err, context).Error())
+	os.Exit(200)
+}
+
+// loadConfig returns the validated configuration from the config file,
+// environment and flags.
+func loadConfig() server.Config {
+	cfg := server.DefaultConfig()
+	if err := viper.Unmarshal(&cfg); err != nil {
+		exit(err, "viper.Unmarshal")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		exit(err, "cfg.Validate")
+	}
+
+	return cfg
+}
+
+// user returns the account given by --user.
+func user() string {
+	return viper.GetString("user")
+}
+
+// userStore returns the --user view of the store.
+func userStore(store server.WorkoutStore) server.WorkoutStore {
+	if user() == "" {
+		return store
+	}
+
+	return store.User(user())
+}
+
+// openStore opens the configured store and makes it, along with the
+// configured timezone, the one used by the server package.
+func openStore(cfg server.Config) (server.WorkoutStore, *time.Location) {
+	loc, err := cfg.Location()
+	if err != nil {
+		exit(err, "cfg.Location")
+	}
+
+	store, err := server.OpenStore(cfg)
+	if err != nil {
+		exit(err, "server.OpenStore")
+	}
+
+	if err := server.Use(cfg, store); err != nil {
+		exit(err, "server.Use")
+	}
+
+	return store, loc
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -94,10 +193,13 @@ func initConfig() {
 		viper.SetConfigName(".workout_server")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// Read in environment variables that match, such as WORKOUT_COUCHBASE_BUCKET.
+	viper.SetEnvPrefix("workout")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
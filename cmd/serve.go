@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	"github.com/scottshotgg/workout_server/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Start the HTTP API",
+	Long: `Start the HTTP API. Changes to the config file are picked up while the
+server runs; settings that cannot change at runtime are logged and need a
+restart.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := loadConfig()
+		store, _ := openStore(cfg)
+
+		if viper.ConfigFileUsed() != "" {
+			viper.OnConfigChange(reloadConfig)
+			viper.WatchConfig()
+		}
+
+		// Start the server and display any errors once the store is closed.
+		err := server.Start(cfg, store)
+
+		if cerr := store.Close(); cerr != nil {
+			logger.Error(errors.Wrap(cerr, "store.Close").Error())
+		}
+
+		if err != nil {
+			exit(err, "server.Start")
+		}
+	},
+}
+
+// reloadConfig applies the config file after it changed. A file that does
+// not parse or validate is rejected and the running config is kept.
+func reloadConfig(e fsnotify.Event) {
+	path := viper.ConfigFileUsed()
+
+	// Editors often truncate before writing; wait for the write that follows.
+	if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+		return
+	}
+
+	// viper has already re-read the file, but it does not tell us whether
+	// that worked, so parse it again on its own.
+	check := viper.New()
+	check.SetConfigFile(path)
+	if err := check.ReadInConfig(); err != nil {
+		logger.Error("rejected config change, keeping the running config", zap.Error(errors.Wrap(err, "ReadInConfig")))
+		return
+	}
+
+	cfg := server.DefaultConfig()
+	if err := viper.Unmarshal(&cfg); err != nil {
+		logger.Error("rejected config change, keeping the running config", zap.Error(errors.Wrap(err, "viper.Unmarshal")))
+		return
+	}
+
+	if err := server.Reload(cfg); err != nil {
+		logger.Error("rejected config change, keeping the running config", zap.Error(err))
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+}
@@ -0,0 +1,489 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Activity types. An activity of another kind is logged as ActivityOther with
+// notes saying what it was.
+const (
+	ActivityRun        = "run"
+	ActivityWalk       = "walk"
+	ActivityHike       = "hike"
+	ActivityRow        = "row"
+	ActivityBike       = "bike"
+	ActivitySwim       = "swim"
+	ActivitySki        = "ski"
+	ActivityElliptical = "elliptical"
+	ActivityCarry      = "carry"
+	ActivityOther      = "other"
+)
+
+var activityTypes = map[string]bool{
+	ActivityRun:        true,
+	ActivityWalk:       true,
+	ActivityHike:       true,
+	ActivityRow:        true,
+	ActivityBike:       true,
+	ActivitySwim:       true,
+	ActivitySki:        true,
+	ActivityElliptical: true,
+	ActivityCarry:      true,
+	ActivityOther:      true,
+}
+
+// maxHeartRate bounds heart rates well above any human's.
+const maxHeartRate = 250
+
+// Activity is a bout of cardio or conditioning work. Durations are in
+// seconds and distances and elevations in metres. Pace, in seconds per
+// kilometre, is worked out from them when the activity is stored, over the
+// moving time when there is one. Carries keep their weight as sets do.
+// Activities imported from a GPS file name it by Source.
+type Activity struct {
+	Type          string    `json:"type"`
+	Duration      float64   `json:"duration,omitempty"`
+	MovingTime    float64   `json:"moving_time,omitempty"`
+	Distance      float64   `json:"distance,omitempty"`
+	ElevationGain float64   `json:"elevation_gain,omitempty"`
+	Pace          float64   `json:"pace,omitempty"`
+	AvgHeartRate  int       `json:"avg_heart_rate,omitempty"`
+	MaxHeartRate  int       `json:"max_heart_rate,omitempty"`
+	Calories      int       `json:"calories,omitempty"`
+	Weight        float64   `json:"weight,omitempty"`
+	Unit          string    `json:"unit,omitempty"`
+	Splits        []Split   `json:"splits,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+	Notes         string    `json:"notes,omitempty"`
+	LoggedWeight  float64   `json:"logged_weight,omitempty"`
+	LoggedUnit    string    `json:"logged_unit,omitempty"`
+	Source        string    `json:"source,omitempty"`
+}
+
+// Split is one lap or interval of an activity, followed by Rest seconds of
+// rest.
+type Split struct {
+	Duration     float64 `json:"duration"`
+	Distance     float64 `json:"distance,omitempty"`
+	Pace         float64 `json:"pace,omitempty"`
+	AvgHeartRate int     `json:"avg_heart_rate,omitempty"`
+	Rest         float64 `json:"rest,omitempty"`
+}
+
+// pace returns seconds per kilometre, or 0 without both a duration and a
+// distance.
+func pace(duration, distance float64) float64 {
+	if duration <= 0 || distance <= 0 {
+		return 0
+	}
+
+	return round(duration/(distance/1000), 1)
+}
+
+// canonicalActivity returns a as it is stored: its weight in kilograms as for
+// canonicalSet and its paces worked out.
+func canonicalActivity(a Activity, unit string) Activity {
+	a.LoggedWeight, a.LoggedUnit = 0, ""
+	if a.Weight > 0 {
+		set := canonicalSet(Set{
+			Weight: a.Weight,
+			Unit:   a.Unit,
+		}, unit)
+		a.Weight, a.Unit = set.Weight, set.Unit
+		a.LoggedWeight, a.LoggedUnit = set.LoggedWeight, set.LoggedUnit
+	}
+
+	a.Pace = pace(a.Duration, a.Distance)
+	if a.MovingTime > 0 {
+		a.Pace = pace(a.MovingTime, a.Distance)
+	}
+	if a.Splits != nil {
+		splits := make([]Split, len(a.Splits))
+		for i, split := range a.Splits {
+			split.Pace = pace(split.Duration, split.Distance)
+			splits[i] = split
+		}
+		a.Splits = splits
+	}
+
+	return a
+}
+
+// validate reports every field of the activity that cannot be stored, under
+// field.
+func (a Activity) validate(field string) []FieldError {
+	var fields []FieldError
+	add := func(name, msg string) {
+		fields = append(fields, FieldError{
+			Field:   field + name,
+			Message: msg,
+		})
+	}
+
+	if !activityTypes[a.Type] {
+		add(".type", "type must be one of "+strings.Join(sortedActivityTypes(), ", "))
+	}
+	if a.Duration < 0 {
+		add(".duration", "duration must not be negative")
+	}
+	if a.MovingTime < 0 || (a.Duration > 0 && a.MovingTime > a.Duration) {
+		add(".moving_time", "moving time must be between 0 and the duration")
+	}
+	if a.Distance < 0 {
+		add(".distance", "distance must not be negative")
+	}
+	if a.ElevationGain < 0 {
+		add(".elevation_gain", "elevation gain must not be negative")
+	}
+	if a.Duration == 0 && a.Distance == 0 {
+		add(".duration", "an activity needs a duration or a distance")
+	}
+	if a.AvgHeartRate < 0 || a.AvgHeartRate > maxHeartRate {
+		add(".avg_heart_rate", "heart rate must be between 0 and "+strconv.Itoa(maxHeartRate))
+	}
+	if a.MaxHeartRate < 0 || a.MaxHeartRate > maxHeartRate {
+		add(".max_heart_rate", "heart rate must be between 0 and "+strconv.Itoa(maxHeartRate))
+	}
+	if a.MaxHeartRate > 0 && a.MaxHeartRate < a.AvgHeartRate {
+		add(".max_heart_rate", "max heart rate must not be below the average")
+	}
+	if a.Calories < 0 {
+		add(".calories", "calories must not be negative")
+	}
+	if a.Weight < 0 {
+		add(".weight", "weight must not be negative")
+	}
+	if _, ok := parseUnit(a.Unit); a.Unit != "" && !ok {
+		add(".unit", "unit must be kg or lb")
+	}
+
+	for i, split := range a.Splits {
+		name := fmt.Sprintf(".splits[%d]", i)
+		if split.Duration <= 0 {
+			add(name+".duration", "duration must be positive")
+		}
+		if split.Distance < 0 {
+			add(name+".distance", "distance must not be negative")
+		}
+		if split.Rest < 0 {
+			add(name+".rest", "rest must not be negative")
+		}
+		if split.AvgHeartRate < 0 || split.AvgHeartRate > maxHeartRate {
+			add(name+".avg_heart_rate", "heart rate must be between 0 and "+strconv.Itoa(maxHeartRate))
+		}
+	}
+
+	return fields
+}
+
+func sortedActivityTypes() []string {
+	types := make([]string, 0, len(activityTypes))
+	for t := range activityTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// DatedActivity is an activity and the day it was logged on.
+type DatedActivity struct {
+	Date string `json:"date"`
+	Activity
+}
+
+// ActivityTotal sums the activities of one type in the week starting on the
+// Monday Week. Pace is over the activities with a distance.
+type ActivityTotal struct {
+	Week          string  `json:"week"`
+	Type          string  `json:"type"`
+	Count         int     `json:"count"`
+	Duration      float64 `json:"duration"`
+	Distance      float64 `json:"distance"`
+	ElevationGain float64 `json:"elevation_gain"`
+	Pace          float64 `json:"pace,omitempty"`
+	Calories      int     `json:"calories"`
+}
+
+// sourcesKey is the meta record mapping the Source of each imported activity
+// to the day it was logged on, so a file is known again whichever day it
+// resolves to, as when it is imported again from another timezone.
+const sourcesKey = "activity-sources"
+
+// unimported drops the activities of doc imported from a file that is already
+// logged, on before, the day as the write found it, or on the day the user's
+// source index has for the file. It returns a day holding the duplicates and
+// how many there were. The user's lock must be held.
+func unimported(s WorkoutStore, doc, before *Document) (*Document, int, error) {
+	sources := map[string]string{}
+	if err := s.GetMeta(sourcesKey, &sources); err != nil && err != ErrNotFound {
+		return nil, 0, err
+	}
+
+	var held *Document
+	kept := doc.Activities[:0:0]
+	for _, a := range doc.Activities {
+		day, err := holding(s, a.Source, before, sources)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if day == nil {
+			kept = append(kept, a)
+		} else {
+			held = day
+		}
+	}
+
+	duplicates := len(doc.Activities) - len(kept)
+	doc.Activities = kept
+
+	return held, duplicates, nil
+}
+
+// holding returns the day holding an activity imported from source, looking
+// at before and at the day sources has for it, or nil when neither does. An
+// index entry whose day no longer holds the activity is ignored.
+func holding(s WorkoutStore, source string, before *Document, sources map[string]string) (*Document, error) {
+	if source == "" {
+		return nil, nil
+	}
+
+	days := []*Document{before}
+	if date := sources[source]; date != "" && (before == nil || date != before.Date) {
+		day, err := s.Get(date)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+
+	for _, day := range days {
+		if day == nil {
+			continue
+		}
+		for _, a := range day.Activities {
+			if a.Source == source {
+				return day, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// indexSources records date as the day of every activity imported from a
+// file. The user's lock must be held.
+func indexSources(s WorkoutStore, date string, activities []Activity) error {
+	imported := false
+	for _, a := range activities {
+		imported = imported || a.Source != ""
+	}
+	if !imported {
+		return nil
+	}
+
+	var sources map[string]string
+	return s.UpdateMeta(sourcesKey, &sources, func() error {
+		if sources == nil {
+			sources = map[string]string{}
+		}
+		for _, a := range activities {
+			if a.Source != "" {
+				sources[a.Source] = date
+			}
+		}
+		return nil
+	})
+}
+
+// Activities returns the user's activities between from and to inclusive in
+// the order they were done, only those of typ when it is not empty.
+func Activities(user, from, to, typ string) ([]DatedActivity, error) {
+	docs, err := storeFor(user).Range(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	activities := []DatedActivity{}
+	for _, doc := range docs {
+		for _, a := range doc.Activities {
+			if typ == "" || a.Type == typ {
+				activities = append(activities, DatedActivity{
+					Date:     doc.Date,
+					Activity: a,
+				})
+			}
+		}
+	}
+
+	return activities, nil
+}
+
+// WeeklyTotals sums activities by week and type, oldest week first.
+func WeeklyTotals(activities []DatedActivity) []ActivityTotal {
+	type key struct{ week, typ string }
+
+	totals := map[key]*ActivityTotal{}
+	paced := map[key]float64{}
+	var keys []key
+
+	for _, a := range activities {
+		k := key{weekOf(a.Date), a.Type}
+		t, ok := totals[k]
+		if !ok {
+			t = &ActivityTotal{
+				Week: k.week,
+				Type: k.typ,
+			}
+			totals[k] = t
+			keys = append(keys, k)
+		}
+
+		t.Count++
+		t.Duration += a.Duration
+		t.Distance += a.Distance
+		t.ElevationGain += a.ElevationGain
+		t.Calories += a.Calories
+		if a.Distance > 0 && a.MovingTime > 0 {
+			paced[k] += a.MovingTime
+		} else if a.Distance > 0 {
+			paced[k] += a.Duration
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].week != keys[j].week {
+			return keys[i].week < keys[j].week
+		}
+		return keys[i].typ < keys[j].typ
+	})
+
+	result := make([]ActivityTotal, len(keys))
+	for i, k := range keys {
+		t := totals[k]
+		t.Pace = pace(paced[k], t.Distance)
+		result[i] = *t
+	}
+
+	return result
+}
+
+// weekOf returns the Monday of the week of date.
+func weekOf(date string) string {
+	day, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return date
+	}
+
+	offset := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -offset).Format(dateLayout)
+}
+
+// activities serves /v1/activities and the totals and import under it:
+//
+//	GET  /v1/activities?from=&to=&type=
+//	GET  /v1/activities/totals?from=&to=&type=
+//	POST /v1/activities/import?format=&type=
+//
+// The range defaults to the 30 days up to today for the list and to the 12
+// weeks up to today for the totals. Carried weights are in the unit query
+// parameter's unit.
+func activities(w http.ResponseWriter, r *http.Request) {
+	totals := false
+	switch r.URL.Path {
+	case "/v1/activities":
+	case "/v1/activities/totals":
+		totals = true
+	case "/v1/activities/import":
+		importTrack(w, r)
+		return
+	default:
+		writeError(w, r, http.StatusNotFound, "not_found", "no such endpoint")
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+
+	to, err := queryDate(query.Get("to"), time.Now().In(loc).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "to",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	def := to.AddDate(0, 0, -30)
+	if totals {
+		week, _ := time.Parse(dateLayout, weekOf(to.Format(dateLayout)))
+		def = week.AddDate(0, 0, -7*11)
+	}
+
+	from, err := queryDate(query.Get("from"), def.Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "from",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if from.After(to) {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "from must not be after to")
+		return
+	}
+
+	if to.Sub(from) >= maxRangeDays*24*time.Hour {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "range must not exceed "+strconv.Itoa(maxRangeDays)+" days")
+		return
+	}
+
+	typ := query.Get("type")
+	if typ != "" && !activityTypes[typ] {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", fmt.Sprintf("unknown activity type %q", typ), FieldError{
+			Field:   "type",
+			Message: "must be one of " + strings.Join(sortedActivityTypes(), ", "),
+		})
+		return
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	list, err := Activities(requestUser(r), from.Format(dateLayout), to.Format(dateLayout), typ)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if totals {
+		writeJSON(w, http.StatusOK, WeeklyTotals(list))
+		return
+	}
+
+	for i := range list {
+		list[i].Activity = units.activity(list[i].Activity)
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Scopes limit what a credential may do. Reads need read, anything that
+// changes data needs write, and admin grants every scope.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+const (
+	// apiKeyPrefix starts every API key so it can be told apart from a
+	// bearer token.
+	apiKeyPrefix = "wsk_"
+	// apiKeyRecord keys API key records in the root store; apiKeyIndex is
+	// the list of a user's key IDs in their view of it.
+	apiKeyRecord = "apikey:"
+	apiKeyIndex  = "apikeys"
+	// tokenKeyRecord holds the generated token signing key when the config
+	// does not set one.
+	tokenKeyRecord = "token_key"
+
+	apiKeyHeader = "X-API-Key"
+)
+
+var (
+	knownScopes   = map[string]bool{ScopeRead: true, ScopeWrite: true, ScopeAdmin: true}
+	defaultScopes = []string{ScopeRead, ScopeWrite}
+
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+
+	// keysMu keeps the API key records and each user's index in step.
+	keysMu sync.Mutex
+
+	// tokenKey signs bearer tokens. It is set by Start.
+	tokenKey []byte
+)
+
+// principal is who a request is made as and what it may do. Session names
+// the credential used, so writes can be undone per login or per key.
+type principal struct {
+	User    string
+	Scopes  []string
+	Session string
+}
+
+// allows reports whether the principal holds the scope.
+func (p *principal) allows(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// APIKey is a long-lived credential of a user. Only a hash of the key is
+// stored; the key itself is shown once, when it is created.
+type APIKey struct {
+	ID      string    `json:"id"`
+	User    string    `json:"user"`
+	Name    string    `json:"name,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// Token is a signed, short-lived bearer token issued by /v1/login.
+type Token struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Scopes    []string  `json:"scopes"`
+}
+
+// tokenClaims are the signed contents of a bearer token.
+type tokenClaims struct {
+	ID      string   `json:"jti"`
+	User    string   `json:"sub"`
+	Scopes  []string `json:"scopes"`
+	Issued  int64    `json:"iat"`
+	Expires int64    `json:"exp"`
+}
+
+// checkScopes reports unknown scopes as an *InputError.
+func checkScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !knownScopes[scope] {
+			return &InputError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    "invalid_scope",
+				Message: fmt.Sprintf("unknown scope %q", scope),
+				Fields: []FieldError{{
+					Field:   "scopes",
+					Message: "must be read, write or admin",
+				}},
+			}
+		}
+	}
+
+	return nil
+}
+
+// CreateAPIKey issues the user a key with the scopes. The returned string is
+// the key itself, which cannot be recovered later.
+func CreateAPIKey(user, name string, scopes []string) (*APIKey, string, error) {
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+	if err := checkScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	if _, err := GetUser(user); err != nil {
+		if err == ErrNotFound {
+			return nil, "", fmt.Errorf("user %s does not exist", user)
+		}
+		return nil, "", err
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return nil, "", err
+	}
+
+	raw := apiKeyPrefix + id + "_" + secret
+	key := &APIKey{
+		ID:      id,
+		User:    user,
+		Name:    name,
+		Scopes:  scopes,
+		Hash:    hashAPIKey(raw),
+		Created: time.Now().UTC(),
+	}
+
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	ids, err := apiKeyIDs(user)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := store.PutMeta(apiKeyRecord+id, key); err != nil {
+		return nil, "", err
+	}
+
+	if err := storeFor(user).PutMeta(apiKeyIndex, append(ids, id)); err != nil {
+		return nil, "", err
+	}
+
+	return key, raw, nil
+}
+
+// ListAPIKeys returns the user's keys, oldest first.
+func ListAPIKeys(user string) ([]*APIKey, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	ids, err := apiKeyIDs(user)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*APIKey, 0, len(ids))
+	for _, id := range ids {
+		key := &APIKey{}
+		if err := store.GetMeta(apiKeyRecord+id, key); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the key with the ID. Requests using it are refused
+// from then on.
+func RevokeAPIKey(id string) error {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	key := &APIKey{}
+	if err := store.GetMeta(apiKeyRecord+id, key); err != nil {
+		return err
+	}
+
+	if err := store.DeleteMeta(apiKeyRecord + id); err != nil {
+		return err
+	}
+
+	ids, err := apiKeyIDs(key.User)
+	if err != nil {
+		return err
+	}
+
+	kept := ids[:0]
+	for _, other := range ids {
+		if other != id {
+			kept = append(kept, other)
+		}
+	}
+
+	return storeFor(key.User).PutMeta(apiKeyIndex, kept)
+}
+
+// apiKeyIDs returns the IDs in the user's key index. keysMu must be held.
+func apiKeyIDs(user string) ([]string, error) {
+	var ids []string
+	if err := storeFor(user).GetMeta(apiKeyIndex, &ids); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// lookupAPIKey returns the principal of a raw API key.
+func lookupAPIKey(raw string) (*principal, error) {
+	parts := strings.SplitN(strings.TrimPrefix(raw, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+
+	key := &APIKey{}
+	if err := store.GetMeta(apiKeyRecord+parts[0], key); err == ErrNotFound {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(raw)), []byte(key.Hash)) != 1 {
+		return nil, errInvalidToken
+	}
+
+	return &principal{
+		User:    key.User,
+		Scopes:  key.Scopes,
+		Session: "key:" + key.ID,
+	}, nil
+}
+
+// hashAPIKey hashes a key for storage. Keys are random enough that a fast
+// hash is sufficient.
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// loadTokenKey sets the key bearer tokens are signed with: the configured
+// secret or, without one, a key generated once and kept in the store so
+// tokens survive restarts.
+func loadTokenKey(cfg Config) error {
+	if cfg.TokenSecret != "" {
+		tokenKey = []byte(cfg.TokenSecret)
+		return nil
+	}
+
+	var key []byte
+	err := store.GetMeta(tokenKeyRecord, &key)
+	if err == nil {
+		tokenKey = key
+		return nil
+	}
+	if err != ErrNotFound {
+		return err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	if err := store.PutMeta(tokenKeyRecord, key); err != nil {
+		return err
+	}
+
+	tokenKey = key
+	return nil
+}
+
+// issueToken signs a token for the user with the scopes, valid for the
+// configured token TTL.
+func issueToken(user string, scopes []string, now time.Time) (*Token, error) {
+	expires := now.Add(loadSettings().cfg.TokenTTL)
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(tokenClaims{
+		ID:      id,
+		User:    user,
+		Scopes:  scopes,
+		Issued:  now.Unix(),
+		Expires: expires.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return &Token{
+		Token:     encoded + "." + signToken(encoded),
+		ExpiresAt: time.Unix(expires.Unix(), 0).UTC(),
+		Scopes:    scopes,
+	}, nil
+}
+
+// parseToken verifies a token from issueToken and returns its principal.
+func parseToken(token string, now time.Time) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+
+	if !hmac.Equal([]byte(signToken(parts[0])), []byte(parts[1])) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	claims := tokenClaims{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+
+	if now.Unix() >= claims.Expires {
+		return nil, errExpiredToken
+	}
+
+	return &principal{
+		User:    claims.User,
+		Scopes:  claims.Scopes,
+		Session: "token:" + claims.ID,
+	}, nil
+}
+
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// login serves /v1/login: POST exchanges a user's password for a bearer
+// token. The token gets the requested scopes, or all of the user's.
+func login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
+	}
+
+	req := struct {
+		ID       string   `json:"id"`
+		Password string   `json:"password"`
+		Scopes   []string `json:"scopes"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	user, ok := authenticate(req.ID, req.Password)
+	if !ok {
+		writeUnauthorized(w, r, "invalid_credentials", "unknown user or wrong password")
+		return
+	}
+
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = user.Scopes
+	}
+	if err := checkScopes(scopes); err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	held := &principal{User: user.ID, Scopes: user.Scopes}
+	for _, scope := range scopes {
+		if !held.allows(scope) {
+			writeError(w, r, http.StatusForbidden, "insufficient_scope", "user "+user.ID+" does not hold the "+scope+" scope")
+			return
+		}
+	}
+
+	token, err := issueToken(user.ID, scopes, time.Now())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	// The token must not outlive this response in a cache or the
+	// idempotency store.
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, token)
+}
+
+// requiredScope is the scope a request needs: read to look, write to change.
+func requiredScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return ScopeRead
+	default:
+		return ScopeWrite
+	}
+}
+
+// withAuth identifies the caller of every request but registration and
+// login, by API key, bearer token or password, and refuses requests the
+// caller's scopes do not cover.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && (r.URL.Path == "/v1/users" || r.URL.Path == "/v1/login") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := authenticateRequest(r)
+		switch {
+		case err == errInvalidToken:
+			writeUnauthorized(w, r, "invalid_token", "the credentials are invalid or revoked")
+			return
+
+		case err == errExpiredToken:
+			writeUnauthorized(w, r, "invalid_token", "the token has expired")
+			return
+
+		case err != nil:
+			writeStoreError(w, r, err)
+			return
+
+		case p == nil:
+			writeUnauthorized(w, r, "unauthorized", "an API key, bearer token or password is required")
+			return
+		}
+
+		if scope := requiredScope(r); !p.allows(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="workout_server", error="insufficient_scope", scope="`+scope+`"`)
+			writeError(w, r, http.StatusForbidden, "insufficient_scope", "the "+scope+" scope is required")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, p)))
+	})
+}
+
+// authenticateRequest returns the principal of the request's credentials,
+// or nil when it has none.
+func authenticateRequest(r *http.Request) (*principal, error) {
+	if raw := r.Header.Get(apiKeyHeader); raw != "" {
+		return lookupAPIKey(raw)
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		raw := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		if strings.HasPrefix(raw, apiKeyPrefix) {
+			return lookupAPIKey(raw)
+		}
+		return parseToken(raw, time.Now())
+	}
+
+	if id, password, ok := r.BasicAuth(); ok {
+		user, ok := authenticate(id, password)
+		if !ok {
+			return nil, errInvalidToken
+		}
+		return &principal{User: user.ID, Scopes: user.Scopes, Session: "password"}, nil
+	}
+
+	return nil, nil
+}
+
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, code, message string) {
+	h := w.Header()
+	h.Add("WWW-Authenticate", `Bearer realm="workout_server"`)
+	h.Add("WWW-Authenticate", `Basic realm="workout_server"`)
+	writeError(w, r, http.StatusUnauthorized, code, message)
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// bodyweightKey is the meta record indexing a user's weigh-ins, next to the
+// day documents that hold them, so the bodyweight on any day is found without
+// reading every day before it. Writes that change a day's weigh-in update it
+// with syncBodyweight.
+const bodyweightKey = "bodyweight"
+
+// Weighin is the lifter's bodyweight on a day. Like sets, weigh-ins are
+// stored in kilograms and keep the weight as it was logged.
+type Weighin struct {
+	Date         string    `json:"date"`
+	Weight       float64   `json:"weight"`
+	Unit         string    `json:"unit,omitempty"`
+	LoggedWeight float64   `json:"logged_weight,omitempty"`
+	LoggedUnit   string    `json:"logged_unit,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// validate reports the fields of the weigh-in that cannot be stored, named
+// under field.
+func (w Weighin) validate(field string) []FieldError {
+	if field != "" {
+		field += "."
+	}
+
+	var fields []FieldError
+	if w.Weight <= 0 {
+		fields = append(fields, FieldError{
+			Field:   field + "weight",
+			Message: "weight must be positive",
+		})
+	}
+	if _, ok := parseUnit(w.Unit); w.Unit != "" && !ok {
+		fields = append(fields, FieldError{
+			Field:   field + "unit",
+			Message: "unit must be kg or lb",
+		})
+	}
+
+	return fields
+}
+
+// canonicalWeighin returns w as it is stored, reading a weight without a unit
+// as unit.
+func canonicalWeighin(w Weighin, unit string) Weighin {
+	set := canonicalSet(Set{
+		Weight: w.Weight,
+		Unit:   w.Unit,
+	}, unit)
+
+	w.Weight, w.Unit = set.Weight, set.Unit
+	w.LoggedWeight, w.LoggedUnit = set.LoggedWeight, set.LoggedUnit
+
+	return w
+}
+
+// sameWeighin reports whether a and b are the same weigh-in.
+func sameWeighin(a, b *Weighin) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	x, y := *a, *b
+	if !x.Time.Equal(y.Time) {
+		return false
+	}
+	x.Time, y.Time = time.Time{}, time.Time{}
+
+	return x == y
+}
+
+// bodyweights are a user's weigh-ins ordered by date, at most one a day.
+type bodyweights []Weighin
+
+// loadBodyweights returns the weigh-ins stored in s.
+func loadBodyweights(s WorkoutStore) (bodyweights, error) {
+	var bws bodyweights
+	if err := s.GetMeta(bodyweightKey, &bws); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	return bws, nil
+}
+
+// asOf returns the bodyweight in kilograms on date: the last weigh-in on or
+// before it, or the first one when the date is before every weigh-in. It is
+// 0 without weigh-ins.
+func (bws bodyweights) asOf(date string) float64 {
+	i := sort.Search(len(bws), func(i int) bool {
+		return bws[i].Date > date
+	})
+
+	switch {
+	case i > 0:
+		return bws[i-1].Weight
+	case len(bws) > 0:
+		return bws[0].Weight
+	}
+
+	return 0
+}
+
+// Weighins returns the user's weigh-ins between from and to inclusive.
+func Weighins(user, from, to string) ([]Weighin, error) {
+	bws, err := loadBodyweights(storeFor(user))
+	if err != nil {
+		return nil, err
+	}
+
+	weighins := []Weighin{}
+	for _, w := range bws {
+		if w.Date >= from && w.Date <= to {
+			weighins = append(weighins, w)
+		}
+	}
+
+	return weighins, nil
+}
+
+// LogWeighin records the user's bodyweight on w.Date, a day resolved in loc
+// as for Log, replacing any weigh-in that day. The weigh-in is kept in the
+// day's document and logged under session like any other write. A weight
+// without a unit is in the user's unit. Volume, e1RMs and PRs of bodyweight
+// sets from the day on are recomputed.
+func LogWeighin(user, session string, w Weighin, loc *time.Location) (*Weighin, error) {
+	if fields := w.validate(""); len(fields) > 0 {
+		return nil, &InputError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_weighin",
+			Message: "the weigh-in has invalid fields",
+			Fields:  fields,
+		}
+	}
+
+	resp, err := Log(user, session, &Document{
+		Date:      w.Date,
+		Exercises: map[string][]Set{},
+		Bodyweight: &Weighin{
+			Weight: w.Weight,
+			Unit:   w.Unit,
+		},
+	}, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Bodyweight, nil
+}
+
+// DeleteWeighin removes the user's weigh-in on date, logging the write under
+// session.
+func DeleteWeighin(user, session, date string) error {
+	defer lockUser(user)()
+
+	s := storeFor(user)
+
+	var before Snapshot
+	doc, err := s.Update(date, func(doc *Document) (*Document, error) {
+		if doc == nil || doc.Bodyweight == nil {
+			return nil, ErrNotFound
+		}
+		before = Snapshot{Date: date, Doc: copyDocument(doc)}
+
+		doc.Bodyweight = nil
+		doc.Version = SchemaVersion
+		if doc.empty() {
+			return nil, nil
+		}
+		return doc, nil
+	})
+	if err != nil {
+		return err
+	}
+	e1rms.invalidate(user, date)
+
+	err = recordWrite(user, before.Doc, doc, Event{
+		Source: session,
+		Action: "delete_bodyweight",
+		Type:   EventReplace,
+		Date:   date,
+		Doc:    doc,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := syncBodyweight(user, date, doc); err != nil {
+		logger.Error("could not update bodyweight", zap.String("user", user), zap.String("date", date), zap.Error(err))
+	}
+
+	if err := recordOp(user, session, "delete_bodyweight", []Snapshot{before}); err != nil {
+		logger.Error("could not record operation", zap.String("user", user), zap.String("date", date), zap.Error(err))
+	}
+
+	return nil
+}
+
+// syncBodyweight brings the user's weigh-in index in line with doc, the day
+// as a write left it, and when the write changed the day's weigh-in brings
+// everything computed from bodyweight up to date. The user's lock must be
+// held.
+func syncBodyweight(user, date string, doc *Document) error {
+	var span weighedSpan
+	if err := indexWeighin(user, date, doc, &span); err != nil {
+		return err
+	}
+
+	return span.refresh(user)
+}
+
+// weighedSpan gathers the days whose bodyweight a batch of writes moved, so
+// what was computed from them is brought up to date once.
+type weighedSpan struct {
+	changed bool
+	// from is the first day moved, or empty from the start. through is the
+	// last, or empty to the end.
+	from, through string
+}
+
+func (sp *weighedSpan) add(from, through string) {
+	if !sp.changed || from < sp.from {
+		sp.from = from
+	}
+	if !sp.changed || sp.through != "" && (through == "" || through > sp.through) {
+		sp.through = through
+	}
+	sp.changed = true
+}
+
+// refresh brings everything computed from bodyweight up to date over the
+// span.
+func (sp *weighedSpan) refresh(user string) error {
+	if !sp.changed {
+		return nil
+	}
+
+	return refreshBodyweight(user, sp.from, sp.through)
+}
+
+// indexWeighin brings the user's weigh-in index in line with doc, the day as
+// a write left it, adding the days whose bodyweight moved to span. The user's
+// lock must be held.
+func indexWeighin(user, date string, doc *Document, span *weighedSpan) error {
+	var w *Weighin
+	if doc != nil {
+		w = doc.Bodyweight
+	}
+
+	var bws bodyweights
+	var from string
+	err := storeFor(user).UpdateMeta(bodyweightKey, &bws, func() error {
+		i := sort.Search(len(bws), func(i int) bool {
+			return bws[i].Date >= date
+		})
+		found := i < len(bws) && bws[i].Date == date
+
+		if !found && w == nil || found && sameWeighin(&bws[i], w) {
+			return errUnchanged
+		}
+
+		// The first weigh-in also stands in for the days before it.
+		from = date
+		if len(bws) == 0 || date <= bws[0].Date {
+			from = ""
+		}
+
+		switch {
+		case w == nil:
+			bws = append(bws[:i], bws[i+1:]...)
+		case found:
+			bws[i] = *w
+		default:
+			bws = append(bws, Weighin{})
+			copy(bws[i+1:], bws[i:])
+			bws[i] = *w
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Days from the next weigh-in on are weighed by it, so the change ends
+	// there.
+	through := ""
+	for _, next := range bws {
+		if next.Date > date {
+			through = next.Date
+			break
+		}
+	}
+
+	span.add(from, through)
+	return nil
+}
+
+// refreshBodyweight forgets the user's cached e1RMs and recomputes the PRs of
+// the exercises done with bodyweight sets between date, or the start when it
+// is empty, and through, or the end when it is empty.
+func refreshBodyweight(user, date, through string) error {
+	e1rms.invalidateSpan(user, date, through)
+
+	all, err := loadPRs(storeFor(user))
+	if err != nil {
+		return err
+	}
+
+	// Nothing was logged before the first PR, so there is no need to read
+	// further back than it.
+	first := ""
+	for _, events := range all {
+		for _, pr := range events {
+			if first == "" || pr.Date < first {
+				first = pr.Date
+			}
+		}
+	}
+	if first == "" {
+		return nil
+	}
+	if date > first {
+		first = date
+	}
+
+	to := time.Now().In(defaultLocation()).AddDate(0, 0, maxFutureDays).Format(dateLayout)
+	if through != "" && through < to {
+		to = through
+	}
+	if first > to {
+		return nil
+	}
+
+	docs, err := storeFor(user).Range(first, to)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	var exercises []string
+	for _, doc := range docs {
+		for exName, sets := range doc.Exercises {
+			for _, set := range sets {
+				if set.Type != "" && !seen[exName] {
+					seen[exName] = true
+					exercises = append(exercises, exName)
+				}
+			}
+		}
+	}
+	if len(exercises) == 0 {
+		return nil
+	}
+	sort.Strings(exercises)
+
+	_, err = updatePRs(user, first, to, exercises)
+	return err
+}
+
+// bodyweight serves /v1/bodyweight and /v1/bodyweight/{date}:
+//
+//	GET    /v1/bodyweight?from=&to=
+//	POST   /v1/bodyweight
+//	GET    /v1/bodyweight/{date}
+//	DELETE /v1/bodyweight/{date}
+//
+// Weights are in the unit query parameter's unit.
+func bodyweight(w http.ResponseWriter, r *http.Request) {
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	date := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/bodyweight"), "/")
+	if date != "" {
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_date", "date must be YYYY-MM-DD")
+			return
+		}
+	}
+
+	switch {
+	case date == "" && r.Method == http.MethodGet:
+		listWeighins(w, r, units)
+
+	case date == "" && r.Method == http.MethodPost:
+		postWeighin(w, r, units)
+
+	case date != "" && r.Method == http.MethodGet:
+		weighins, err := Weighins(requestUser(r), date, date)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		if len(weighins) == 0 {
+			writeError(w, r, http.StatusNotFound, "not_found", "no weigh-in on "+date)
+			return
+		}
+		writeJSON(w, http.StatusOK, units.weighin(weighins[0]))
+
+	case date != "" && r.Method == http.MethodDelete:
+		err := DeleteWeighin(requestUser(r), requestSession(r), date)
+		if err == ErrNotFound {
+			writeError(w, r, http.StatusNotFound, "not_found", "no weigh-in on "+date)
+			return
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// listWeighins returns the weigh-ins between the from and to query
+// parameters inclusive, defaulting to the last 90 days.
+func listWeighins(w http.ResponseWriter, r *http.Request, units Units) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+
+	to, err := queryDate(query.Get("to"), time.Now().In(loc).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "to",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	from, err := queryDate(query.Get("from"), to.AddDate(0, 0, -defaultLookbackDays).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "from",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if from.After(to) {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "from must not be after to")
+		return
+	}
+
+	weighins, err := Weighins(requestUser(r), from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.Weighins(weighins))
+}
+
+// postWeighin records the weigh-in in the request body.
+func postWeighin(w http.ResponseWriter, r *http.Request, units Units) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
+	}
+
+	req := Weighin{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	weighin, err := LogWeighin(requestUser(r), requestSession(r), req, loc)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.weighin(*weighin))
+}
@@ -0,0 +1,67 @@
+package server
+
+// builtinExercises seed every user's catalog.
+var builtinExercises = []Exercise{
+	// Squats and lunges.
+	{ID: "back_squat", Name: "Back Squat", Aliases: []string{"squat", "squats", "bs"}, Equipment: "barbell", PrimaryMuscles: []string{"quads", "glutes"}, SecondaryMuscles: []string{"adductors", "lower_back"}, MovementPattern: "squat"},
+	{ID: "front_squat", Name: "Front Squat", Aliases: []string{"fs"}, Equipment: "barbell", PrimaryMuscles: []string{"quads"}, SecondaryMuscles: []string{"glutes", "upper_back"}, MovementPattern: "squat"},
+	{ID: "goblet_squat", Name: "Goblet Squat", Equipment: "dumbbell", PrimaryMuscles: []string{"quads", "glutes"}, SecondaryMuscles: []string{"abs"}, MovementPattern: "squat"},
+	{ID: "hack_squat", Name: "Hack Squat", Equipment: "machine", PrimaryMuscles: []string{"quads"}, SecondaryMuscles: []string{"glutes"}, MovementPattern: "squat"},
+	{ID: "leg_press", Name: "Leg Press", Equipment: "machine", PrimaryMuscles: []string{"quads", "glutes"}, SecondaryMuscles: []string{"hamstrings"}, MovementPattern: "squat"},
+	{ID: "bulgarian_split_squat", Name: "Bulgarian Split Squat", Aliases: []string{"bss", "split_squat"}, Equipment: "dumbbell", PrimaryMuscles: []string{"quads", "glutes"}, SecondaryMuscles: []string{"adductors"}, MovementPattern: "lunge"},
+	{ID: "walking_lunge", Name: "Walking Lunge", Aliases: []string{"lunge", "lunges"}, Equipment: "dumbbell", PrimaryMuscles: []string{"quads", "glutes"}, SecondaryMuscles: []string{"adductors"}, MovementPattern: "lunge"},
+	{ID: "step_up", Name: "Step Up", Aliases: []string{"step_ups"}, Equipment: "dumbbell", PrimaryMuscles: []string{"quads", "glutes"}, MovementPattern: "lunge"},
+
+	// Hinges.
+	{ID: "deadlift", Name: "Deadlift", Aliases: []string{"dl", "conventional_deadlift"}, Equipment: "barbell", PrimaryMuscles: []string{"glutes", "hamstrings", "lower_back"}, SecondaryMuscles: []string{"traps", "forearms", "quads"}, MovementPattern: "hinge"},
+	{ID: "sumo_deadlift", Name: "Sumo Deadlift", Aliases: []string{"sumo"}, Equipment: "barbell", PrimaryMuscles: []string{"glutes", "adductors"}, SecondaryMuscles: []string{"hamstrings", "quads", "lower_back"}, MovementPattern: "hinge"},
+	{ID: "romanian_deadlift", Name: "Romanian Deadlift", Aliases: []string{"rdl"}, Equipment: "barbell", PrimaryMuscles: []string{"hamstrings", "glutes"}, SecondaryMuscles: []string{"lower_back"}, MovementPattern: "hinge"},
+	{ID: "trap_bar_deadlift", Name: "Trap Bar Deadlift", Aliases: []string{"hex_bar_deadlift", "tbdl"}, Equipment: "trap_bar", PrimaryMuscles: []string{"quads", "glutes"}, SecondaryMuscles: []string{"hamstrings", "traps"}, MovementPattern: "hinge"},
+	{ID: "hip_thrust", Name: "Hip Thrust", Aliases: []string{"barbell_hip_thrust"}, Equipment: "barbell", PrimaryMuscles: []string{"glutes"}, SecondaryMuscles: []string{"hamstrings"}, MovementPattern: "hinge"},
+	{ID: "good_morning", Name: "Good Morning", Equipment: "barbell", PrimaryMuscles: []string{"hamstrings", "lower_back"}, SecondaryMuscles: []string{"glutes"}, MovementPattern: "hinge"},
+	{ID: "kettlebell_swing", Name: "Kettlebell Swing", Aliases: []string{"kb_swing", "swing"}, Equipment: "kettlebell", PrimaryMuscles: []string{"glutes", "hamstrings"}, SecondaryMuscles: []string{"lower_back", "abs"}, MovementPattern: "hinge"},
+	{ID: "back_extension", Name: "Back Extension", Aliases: []string{"hyperextension"}, Equipment: "bodyweight", PrimaryMuscles: []string{"lower_back"}, SecondaryMuscles: []string{"glutes", "hamstrings"}, MovementPattern: "hinge"},
+
+	// Pushes.
+	{ID: "bench_press", Name: "Bench Press", Aliases: []string{"bench", "bp", "flat_bench"}, Equipment: "barbell", PrimaryMuscles: []string{"chest"}, SecondaryMuscles: []string{"triceps", "front_delts"}, MovementPattern: "horizontal_push"},
+	{ID: "incline_bench_press", Name: "Incline Bench Press", Aliases: []string{"incline_bench", "incline"}, Equipment: "barbell", PrimaryMuscles: []string{"chest", "front_delts"}, SecondaryMuscles: []string{"triceps"}, MovementPattern: "horizontal_push"},
+	{ID: "close_grip_bench_press", Name: "Close Grip Bench Press", Aliases: []string{"cgbp", "close_grip_bench"}, Equipment: "barbell", PrimaryMuscles: []string{"triceps", "chest"}, SecondaryMuscles: []string{"front_delts"}, MovementPattern: "horizontal_push"},
+	{ID: "dumbbell_bench_press", Name: "Dumbbell Bench Press", Aliases: []string{"db_bench", "db_bench_press"}, Equipment: "dumbbell", PrimaryMuscles: []string{"chest"}, SecondaryMuscles: []string{"triceps", "front_delts"}, MovementPattern: "horizontal_push"},
+	{ID: "push_up", Name: "Push Up", Aliases: []string{"pushup", "pushups", "press_up"}, Equipment: "bodyweight", PrimaryMuscles: []string{"chest"}, SecondaryMuscles: []string{"triceps", "front_delts", "abs"}, MovementPattern: "horizontal_push"},
+	{ID: "dip", Name: "Dip", Aliases: []string{"dips"}, Equipment: "bodyweight", PrimaryMuscles: []string{"chest", "triceps"}, SecondaryMuscles: []string{"front_delts"}, MovementPattern: "vertical_push"},
+	{ID: "overhead_press", Name: "Overhead Press", Aliases: []string{"ohp", "press", "military_press", "strict_press"}, Equipment: "barbell", PrimaryMuscles: []string{"front_delts"}, SecondaryMuscles: []string{"triceps", "side_delts", "upper_back"}, MovementPattern: "vertical_push"},
+	{ID: "push_press", Name: "Push Press", Equipment: "barbell", PrimaryMuscles: []string{"front_delts"}, SecondaryMuscles: []string{"triceps", "quads"}, MovementPattern: "vertical_push"},
+	{ID: "dumbbell_shoulder_press", Name: "Dumbbell Shoulder Press", Aliases: []string{"db_press", "db_shoulder_press"}, Equipment: "dumbbell", PrimaryMuscles: []string{"front_delts"}, SecondaryMuscles: []string{"triceps", "side_delts"}, MovementPattern: "vertical_push"},
+	{ID: "chest_fly", Name: "Chest Fly", Aliases: []string{"fly", "flyes", "pec_deck"}, Equipment: "machine", PrimaryMuscles: []string{"chest"}, MovementPattern: "isolation"},
+
+	// Pulls.
+	{ID: "pull_up", Name: "Pull Up", Aliases: []string{"pullup", "pullups"}, Equipment: "bodyweight", PrimaryMuscles: []string{"lats"}, SecondaryMuscles: []string{"biceps", "upper_back"}, MovementPattern: "vertical_pull"},
+	{ID: "chin_up", Name: "Chin Up", Aliases: []string{"chinup", "chinups"}, Equipment: "bodyweight", PrimaryMuscles: []string{"lats", "biceps"}, SecondaryMuscles: []string{"upper_back"}, MovementPattern: "vertical_pull"},
+	{ID: "lat_pulldown", Name: "Lat Pulldown", Aliases: []string{"pulldown", "lat_pull"}, Equipment: "cable", PrimaryMuscles: []string{"lats"}, SecondaryMuscles: []string{"biceps"}, MovementPattern: "vertical_pull"},
+	{ID: "barbell_row", Name: "Barbell Row", Aliases: []string{"row", "bent_over_row", "bb_row"}, Equipment: "barbell", PrimaryMuscles: []string{"upper_back", "lats"}, SecondaryMuscles: []string{"biceps", "lower_back", "rear_delts"}, MovementPattern: "horizontal_pull"},
+	{ID: "pendlay_row", Name: "Pendlay Row", Equipment: "barbell", PrimaryMuscles: []string{"upper_back", "lats"}, SecondaryMuscles: []string{"biceps", "lower_back"}, MovementPattern: "horizontal_pull"},
+	{ID: "dumbbell_row", Name: "Dumbbell Row", Aliases: []string{"db_row", "one_arm_row"}, Equipment: "dumbbell", PrimaryMuscles: []string{"lats", "upper_back"}, SecondaryMuscles: []string{"biceps", "rear_delts"}, MovementPattern: "horizontal_pull"},
+	{ID: "seated_cable_row", Name: "Seated Cable Row", Aliases: []string{"cable_row"}, Equipment: "cable", PrimaryMuscles: []string{"upper_back", "lats"}, SecondaryMuscles: []string{"biceps"}, MovementPattern: "horizontal_pull"},
+	{ID: "inverted_row", Name: "Inverted Row", Aliases: []string{"body_row"}, Equipment: "bodyweight", PrimaryMuscles: []string{"upper_back"}, SecondaryMuscles: []string{"biceps", "rear_delts"}, MovementPattern: "horizontal_pull"},
+	{ID: "face_pull", Name: "Face Pull", Aliases: []string{"face_pulls"}, Equipment: "cable", PrimaryMuscles: []string{"rear_delts"}, SecondaryMuscles: []string{"upper_back", "traps"}, MovementPattern: "horizontal_pull"},
+	{ID: "shrug", Name: "Shrug", Aliases: []string{"shrugs"}, Equipment: "barbell", PrimaryMuscles: []string{"traps"}, SecondaryMuscles: []string{"forearms"}, MovementPattern: "isolation"},
+
+	// Arms, shoulders and legs in isolation.
+	{ID: "barbell_curl", Name: "Barbell Curl", Aliases: []string{"curl", "curls", "bb_curl"}, Equipment: "barbell", PrimaryMuscles: []string{"biceps"}, SecondaryMuscles: []string{"forearms"}, MovementPattern: "isolation"},
+	{ID: "dumbbell_curl", Name: "Dumbbell Curl", Aliases: []string{"db_curl"}, Equipment: "dumbbell", PrimaryMuscles: []string{"biceps"}, SecondaryMuscles: []string{"forearms"}, MovementPattern: "isolation"},
+	{ID: "hammer_curl", Name: "Hammer Curl", Aliases: []string{"hammer_curls"}, Equipment: "dumbbell", PrimaryMuscles: []string{"biceps", "forearms"}, MovementPattern: "isolation"},
+	{ID: "triceps_pushdown", Name: "Triceps Pushdown", Aliases: []string{"pushdown", "tricep_pushdown"}, Equipment: "cable", PrimaryMuscles: []string{"triceps"}, MovementPattern: "isolation"},
+	{ID: "skull_crusher", Name: "Skull Crusher", Aliases: []string{"skullcrusher", "lying_triceps_extension"}, Equipment: "ez_bar", PrimaryMuscles: []string{"triceps"}, MovementPattern: "isolation"},
+	{ID: "lateral_raise", Name: "Lateral Raise", Aliases: []string{"lat_raise", "side_raise"}, Equipment: "dumbbell", PrimaryMuscles: []string{"side_delts"}, MovementPattern: "isolation"},
+	{ID: "rear_delt_fly", Name: "Rear Delt Fly", Aliases: []string{"reverse_fly"}, Equipment: "dumbbell", PrimaryMuscles: []string{"rear_delts"}, SecondaryMuscles: []string{"upper_back"}, MovementPattern: "isolation"},
+	{ID: "leg_extension", Name: "Leg Extension", Aliases: []string{"leg_ext"}, Equipment: "machine", PrimaryMuscles: []string{"quads"}, MovementPattern: "isolation"},
+	{ID: "leg_curl", Name: "Leg Curl", Aliases: []string{"hamstring_curl"}, Equipment: "machine", PrimaryMuscles: []string{"hamstrings"}, MovementPattern: "isolation"},
+	{ID: "calf_raise", Name: "Calf Raise", Aliases: []string{"calf_raises", "calves"}, Equipment: "machine", PrimaryMuscles: []string{"calves"}, MovementPattern: "isolation"},
+
+	// Core and carries.
+	{ID: "plank", Name: "Plank", Equipment: "bodyweight", PrimaryMuscles: []string{"abs"}, SecondaryMuscles: []string{"obliques"}, MovementPattern: "core"},
+	{ID: "hanging_leg_raise", Name: "Hanging Leg Raise", Aliases: []string{"leg_raise", "hlr"}, Equipment: "bodyweight", PrimaryMuscles: []string{"abs", "hip_flexors"}, MovementPattern: "core"},
+	{ID: "cable_crunch", Name: "Cable Crunch", Aliases: []string{"crunch"}, Equipment: "cable", PrimaryMuscles: []string{"abs"}, MovementPattern: "core"},
+	{ID: "ab_wheel_rollout", Name: "Ab Wheel Rollout", Aliases: []string{"ab_wheel", "rollout"}, Equipment: "other", PrimaryMuscles: []string{"abs"}, SecondaryMuscles: []string{"lats"}, MovementPattern: "core"},
+	{ID: "farmers_carry", Name: "Farmer's Carry", Aliases: []string{"farmers_walk", "farmer_carry"}, Equipment: "dumbbell", PrimaryMuscles: []string{"forearms", "traps"}, SecondaryMuscles: []string{"abs"}, MovementPattern: "carry"},
+}
@@ -0,0 +1,788 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// catalogKey is the meta record of a user's own exercises.
+const catalogKey = "exercises"
+
+// maxSuggestions is how many close matches are offered for an unknown name.
+const maxSuggestions = 3
+
+var exerciseIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{0,63}$`)
+
+var (
+	knownEquipment = map[string]bool{
+		"barbell": true, "dumbbell": true, "kettlebell": true, "machine": true,
+		"cable": true, "bodyweight": true, "band": true, "smith_machine": true,
+		"ez_bar": true, "trap_bar": true, "other": true,
+	}
+	knownMuscles = map[string]bool{
+		"chest": true, "front_delts": true, "side_delts": true, "rear_delts": true,
+		"triceps": true, "biceps": true, "forearms": true, "lats": true,
+		"upper_back": true, "traps": true, "lower_back": true, "abs": true,
+		"obliques": true, "glutes": true, "quads": true, "hamstrings": true,
+		"adductors": true, "abductors": true, "calves": true, "hip_flexors": true,
+		"neck": true,
+	}
+	knownPatterns = map[string]bool{
+		"squat": true, "hinge": true, "lunge": true, "horizontal_push": true,
+		"vertical_push": true, "horizontal_pull": true, "vertical_pull": true,
+		"carry": true, "isolation": true, "core": true,
+	}
+)
+
+// catalogMu serializes changes to users' own exercises.
+var catalogMu sync.Mutex
+
+// Exercise is an entry of the exercise catalog. ID is the name sets are
+// stored under; the name and aliases resolve to it.
+type Exercise struct {
+	ID               string   `json:"id"`
+	Name             string   `json:"name"`
+	Aliases          []string `json:"aliases,omitempty"`
+	Equipment        string   `json:"equipment"`
+	PrimaryMuscles   []string `json:"primary_muscles"`
+	SecondaryMuscles []string `json:"secondary_muscles,omitempty"`
+	MovementPattern  string   `json:"movement_pattern"`
+	// Custom marks an exercise a user added to their own catalog.
+	Custom bool `json:"custom,omitempty"`
+}
+
+// UnknownExercise is a name that is not in the catalog, with the closest
+// names that are.
+type UnknownExercise struct {
+	Name        string   `json:"name"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// catalog is the built-in exercises along with a user's own.
+type catalog struct {
+	entries []Exercise
+	// byKey maps the folded ID, name and aliases of each entry to its index.
+	byKey map[string]int
+}
+
+// builtinCatalog indexes builtinExercises once.
+var builtinCatalog = newCatalog(nil)
+
+// newCatalog indexes the built-in exercises and custom on top of them.
+func newCatalog(custom []Exercise) *catalog {
+	c := &catalog{
+		byKey: map[string]int{},
+	}
+
+	for _, entries := range [][]Exercise{builtinExercises, custom} {
+		for _, ex := range entries {
+			c.entries = append(c.entries, ex)
+			i := len(c.entries) - 1
+			for _, name := range append([]string{ex.ID, ex.Name}, ex.Aliases...) {
+				if _, taken := c.byKey[foldName(name)]; !taken {
+					c.byKey[foldName(name)] = i
+				}
+			}
+		}
+	}
+
+	return c
+}
+
+// loadCatalog returns the catalog as the user sees it.
+func loadCatalog(user string) (*catalog, error) {
+	var custom []Exercise
+	if err := storeFor(user).GetMeta(catalogKey, &custom); err != nil {
+		if err == ErrNotFound {
+			return builtinCatalog, nil
+		}
+		return nil, err
+	}
+
+	return newCatalog(custom), nil
+}
+
+// foldName reduces a name to lowercase letters and digits, so leg_press,
+// legpress and "Leg Press" are the same name.
+func foldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// slugName turns a free-form name into the lowercase, underscore separated
+// form exercises are stored under.
+func slugName(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	return strings.Join(words, "_")
+}
+
+// lookup returns the entry the name resolves to.
+func (c *catalog) lookup(name string) (*Exercise, bool) {
+	i, ok := c.byKey[foldName(name)]
+	if !ok {
+		return nil, false
+	}
+
+	return &c.entries[i], true
+}
+
+// resolve returns the ID the name is stored under: its catalog ID when it
+// has one and its slug otherwise.
+func (c *catalog) resolve(name string) (string, bool) {
+	if ex, ok := c.lookup(name); ok {
+		return ex.ID, true
+	}
+
+	return slugName(name), false
+}
+
+// suggest returns the IDs of the entries whose names are closest to name,
+// best first.
+func (c *catalog) suggest(name string) []string {
+	folded := foldName(name)
+	if folded == "" {
+		return []string{}
+	}
+
+	// Allow roughly one typo per four characters.
+	limit := len(folded)/4 + 1
+
+	best := map[string]int{}
+	for key, i := range c.byKey {
+		d := editDistance(folded, key)
+		if d > limit && len(folded) >= 3 && len(key) >= 3 && (strings.Contains(key, folded) || strings.Contains(folded, key)) {
+			// Partial names are close however long the rest of the name
+			// is, but rank behind typos.
+			d = limit
+		}
+		if d > limit {
+			continue
+		}
+
+		id := c.entries[i].ID
+		if prev, ok := best[id]; !ok || d < prev {
+			best[id] = d
+		}
+	}
+
+	ids := make([]string, 0, len(best))
+	for id := range best {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if best[ids[i]] != best[ids[j]] {
+			return best[ids[i]] < best[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+
+	if len(ids) > maxSuggestions {
+		ids = ids[:maxSuggestions]
+	}
+
+	return ids
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	for _, v := range rest {
+		if v < first {
+			first = v
+		}
+	}
+
+	return first
+}
+
+// canonicalize renames the exercises of doc to their catalog IDs, merging
+// the sets of names that resolve to the same exercise in name order. It
+// returns the names that are not in the catalog, which are kept as slugs.
+func (c *catalog) canonicalize(doc *Document) []UnknownExercise {
+	names := make([]string, 0, len(doc.Exercises))
+	for exName := range doc.Exercises {
+		names = append(names, exName)
+	}
+	sort.Strings(names)
+
+	var unknown []UnknownExercise
+	exercises := make(map[string][]Set, len(doc.Exercises))
+	for _, exName := range names {
+		id, known := c.resolve(exName)
+		if !known {
+			unknown = append(unknown, UnknownExercise{
+				Name:        exName,
+				Suggestions: c.suggest(exName),
+			})
+		}
+		if id == "" {
+			// Leave names with nothing to slug for validate to report.
+			id = exName
+		}
+		exercises[id] = append(exercises[id], doc.Exercises[exName]...)
+	}
+	doc.Exercises = exercises
+
+	return unknown
+}
+
+// normalizeExercises renames the exercises of doc to the user's catalog IDs.
+// With strict_exercises set, unknown names are refused as an *InputError;
+// otherwise they are returned so the caller can pass the suggestions on.
+func normalizeExercises(user string, doc *Document) ([]UnknownExercise, error) {
+	c, err := loadCatalog(user)
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := c.canonicalize(doc)
+	if len(unknown) == 0 || !loadSettings().cfg.StrictExercises {
+		return unknown, nil
+	}
+
+	fields := make([]FieldError, 0, len(unknown))
+	for _, u := range unknown {
+		message := "unknown exercise"
+		if len(u.Suggestions) > 0 {
+			message += ", did you mean " + strings.Join(u.Suggestions, " or ") + "?"
+		}
+		fields = append(fields, FieldError{
+			Field:   "exercises." + u.Name,
+			Message: message,
+		})
+	}
+
+	return nil, &InputError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    "unknown_exercise",
+		Message: "the workout names exercises that are not in the catalog",
+		Fields:  fields,
+	}
+}
+
+// renamed reports whether canonicalize would rename any exercise of doc.
+func (c *catalog) renamed(doc *Document) bool {
+	for exName := range doc.Exercises {
+		if id, _ := c.resolve(exName); id != "" && id != exName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RenameExercises rewrites the user's days between from and to under the
+// catalog IDs of their exercises, as writes have stored them since the
+// catalog existed, so days logged before it show up in e1RMs, PRs and
+// comparisons. The events and undo snapshots of the days are rewritten with
+// them, and the PRs of the renamed exercises are recomputed under their new
+// names. It returns the number of days that changed.
+func RenameExercises(user, from, to string) (int, error) {
+	c, err := loadCatalog(user)
+	if err != nil {
+		return 0, err
+	}
+
+	defer lockUser(user)()
+
+	s := storeFor(user)
+
+	first, last := "", ""
+	renamed := 0
+	oldNames := map[string]bool{}
+	seen := map[string]bool{}
+	var ids []string
+
+	err = dateRange(from, to, func(date string) error {
+		var events []Event
+		err := s.UpdateMeta(eventsPrefix+date, &events, func() error {
+			changed := false
+			for i := range events {
+				ev := &events[i]
+				if ev.Doc != nil && c.renamed(ev.Doc) {
+					c.canonicalize(ev.Doc)
+					changed = true
+				}
+				if ev.Exercise != "" {
+					if id, _ := c.resolve(ev.Exercise); id != "" && id != ev.Exercise {
+						ev.Exercise = id
+						changed = true
+					}
+				}
+			}
+			if !changed {
+				return errUnchanged
+			}
+			return nil
+		})
+		if err != nil && err != errUnchanged {
+			return err
+		}
+
+		doc, err := s.Get(date)
+		if err == ErrNotFound || (err == nil && !c.renamed(doc)) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		doc, err = s.Update(date, func(doc *Document) (*Document, error) {
+			names = nil
+			if doc == nil {
+				return nil, nil
+			}
+			names = exerciseNames(doc)
+			c.canonicalize(doc)
+			return doc, nil
+		})
+		if err != nil || doc == nil {
+			return err
+		}
+
+		for _, exName := range names {
+			oldNames[exName] = true
+		}
+		for _, id := range exerciseNames(doc) {
+			delete(oldNames, id)
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		e1rms.invalidate(user, date)
+		renamed++
+
+		if first == "" {
+			first = date
+		}
+		last = date
+
+		return nil
+	})
+	if err != nil {
+		return renamed, err
+	}
+
+	if renamed == 0 {
+		return 0, nil
+	}
+
+	if err := renameSnapshots(s, c); err != nil {
+		return renamed, err
+	}
+
+	// The old names keep only the PRs of days outside the range, which still
+	// hold them.
+	var all map[string][]PR
+	err = s.UpdateMeta(prsKey, &all, func() error {
+		for exName := range oldNames {
+			var kept []PR
+			for _, pr := range all[exName] {
+				if pr.Date < first || pr.Date > to {
+					kept = append(kept, pr)
+				}
+			}
+			if len(kept) == 0 {
+				delete(all, exName)
+			} else {
+				all[exName] = kept
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return renamed, err
+	}
+
+	sort.Strings(ids)
+	_, err = updatePRs(user, first, last, ids)
+	return renamed, err
+}
+
+// renameSnapshots renames the exercises of the days kept in the user's op
+// log, so undoing a write does not bring the old names back. The user's lock
+// must be held.
+func renameSnapshots(s WorkoutStore, c *catalog) error {
+	var ops []Operation
+	err := s.UpdateMeta(opLogKey, &ops, func() error {
+		changed := false
+		for _, op := range ops {
+			for _, snap := range op.Before {
+				if snap.Doc != nil && c.renamed(snap.Doc) {
+					c.canonicalize(snap.Doc)
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return nil
+	}
+
+	return err
+}
+
+// ListExercises returns the user's catalog, built-in and own exercises, by ID.
+func ListExercises(user string) ([]Exercise, error) {
+	c, err := loadCatalog(user)
+	if err != nil {
+		return nil, err
+	}
+
+	list := append([]Exercise(nil), c.entries...)
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list, nil
+}
+
+// AddExercise adds an exercise to the user's own catalog. Its ID, name and
+// aliases must not resolve to an exercise that already exists.
+func AddExercise(user string, ex Exercise) (*Exercise, error) {
+	if ex.ID == "" {
+		ex.ID = slugName(ex.Name)
+	}
+	ex.Custom = true
+
+	if fields := ex.validate(); len(fields) > 0 {
+		return nil, &InputError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_exercise",
+			Message: "the exercise has invalid fields",
+			Fields:  fields,
+		}
+	}
+
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	s := storeFor(user)
+
+	var custom []Exercise
+	if err := s.GetMeta(catalogKey, &custom); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	c := newCatalog(custom)
+	for _, name := range append([]string{ex.ID, ex.Name}, ex.Aliases...) {
+		if other, ok := c.lookup(name); ok {
+			return nil, &InputError{
+				Status:  http.StatusConflict,
+				Code:    "exercise_exists",
+				Message: fmt.Sprintf("%q already names the exercise %s", name, other.ID),
+			}
+		}
+	}
+
+	if err := s.PutMeta(catalogKey, append(custom, ex)); err != nil {
+		return nil, err
+	}
+
+	return &ex, nil
+}
+
+// DeleteExercise removes an exercise from the user's own catalog. Built-in
+// exercises cannot be removed. Sets already logged under it are kept.
+func DeleteExercise(user, id string) error {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	s := storeFor(user)
+
+	var custom []Exercise
+	if err := s.GetMeta(catalogKey, &custom); err != nil {
+		return err
+	}
+
+	kept := custom[:0]
+	for _, ex := range custom {
+		if ex.ID != id {
+			kept = append(kept, ex)
+		}
+	}
+	if len(kept) == len(custom) {
+		return ErrNotFound
+	}
+
+	return s.PutMeta(catalogKey, kept)
+}
+
+// validate reports every field of a new exercise that cannot be stored.
+func (ex *Exercise) validate() []FieldError {
+	var fields []FieldError
+
+	if !exerciseIDPattern.MatchString(ex.ID) {
+		fields = append(fields, FieldError{
+			Field:   "id",
+			Message: "must be 1 to 64 lowercase letters, digits or underscores",
+		})
+	}
+	if strings.TrimSpace(ex.Name) == "" {
+		fields = append(fields, FieldError{
+			Field:   "name",
+			Message: "must not be empty",
+		})
+	}
+	for i, alias := range ex.Aliases {
+		if foldName(alias) == "" {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("aliases[%d]", i),
+				Message: "must contain a letter or digit",
+			})
+		}
+	}
+	if !knownEquipment[ex.Equipment] {
+		fields = append(fields, FieldError{
+			Field:   "equipment",
+			Message: "must be one of " + knownList(knownEquipment),
+		})
+	}
+	if len(ex.PrimaryMuscles) == 0 {
+		fields = append(fields, FieldError{
+			Field:   "primary_muscles",
+			Message: "must name at least one muscle group",
+		})
+	}
+	for field, muscles := range map[string][]string{
+		"primary_muscles":   ex.PrimaryMuscles,
+		"secondary_muscles": ex.SecondaryMuscles,
+	} {
+		for i, muscle := range muscles {
+			if !knownMuscles[muscle] {
+				fields = append(fields, FieldError{
+					Field:   fmt.Sprintf("%s[%d]", field, i),
+					Message: "must be one of " + knownList(knownMuscles),
+				})
+			}
+		}
+	}
+	if !knownPatterns[ex.MovementPattern] {
+		fields = append(fields, FieldError{
+			Field:   "movement_pattern",
+			Message: "must be one of " + knownList(knownPatterns),
+		})
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Field < fields[j].Field
+	})
+
+	return fields
+}
+
+// knownList renders the names of a set of known values in order.
+func knownList(known map[string]bool) string {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// listExercises serves GET /v1/exercises. The q query parameter searches
+// names, and equipment, muscle and pattern filter the entries.
+func listExercises(w http.ResponseWriter, r *http.Request) {
+	user := requestUser(r)
+	query := r.URL.Query()
+
+	list, err := ListExercises(user)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if q := query.Get("q"); q != "" {
+		c, err := loadCatalog(user)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+
+		ids := c.suggest(q)
+		if ex, ok := c.lookup(q); ok {
+			ids = append([]string{ex.ID}, ids...)
+		}
+
+		byID := map[string]Exercise{}
+		for _, ex := range list {
+			byID[ex.ID] = ex
+		}
+
+		list = nil
+		for _, id := range ids {
+			if ex, ok := byID[id]; ok {
+				list = append(list, ex)
+				delete(byID, id)
+			}
+		}
+	}
+
+	equipment, muscle, pattern := query.Get("equipment"), query.Get("muscle"), query.Get("pattern")
+
+	filtered := []Exercise{}
+	for _, ex := range list {
+		if equipment != "" && ex.Equipment != equipment {
+			continue
+		}
+		if pattern != "" && ex.MovementPattern != pattern {
+			continue
+		}
+		if muscle != "" && !containsString(ex.PrimaryMuscles, muscle) && !containsString(ex.SecondaryMuscles, muscle) {
+			continue
+		}
+		filtered = append(filtered, ex)
+	}
+
+	writeJSON(w, http.StatusOK, filtered)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addExercise serves POST /v1/exercises.
+func addExercise(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
+	}
+
+	ex := Exercise{}
+	if err := json.Unmarshal(body, &ex); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	added, err := AddExercise(requestUser(r), ex)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, added)
+}
+
+// catalogExercises serves /v1/exercises: GET lists the catalog, POST adds an
+// exercise of the user's own.
+func catalogExercises(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listExercises(w, r)
+
+	case http.MethodPost:
+		addExercise(w, r)
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// catalogExercise serves GET and DELETE /v1/exercises/{name}. Any name or
+// alias finds the exercise.
+func catalogExercise(w http.ResponseWriter, r *http.Request, name string) {
+	c, err := loadCatalog(requestUser(r))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	ex, ok := c.lookup(name)
+
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			var fields []FieldError
+			if suggestions := c.suggest(name); len(suggestions) > 0 {
+				fields = append(fields, FieldError{
+					Field:   "name",
+					Message: "did you mean " + strings.Join(suggestions, " or ") + "?",
+				})
+			}
+			writeError(w, r, http.StatusNotFound, "unknown_exercise", "no exercise is named "+name, fields...)
+			return
+		}
+		writeJSON(w, http.StatusOK, ex)
+
+	case http.MethodDelete:
+		if !ok || !ex.Custom {
+			writeError(w, r, http.StatusNotFound, "not_found", "no exercise of your own is named "+name)
+			return
+		}
+		if err := DeleteExercise(requestUser(r), ex.ID); err == ErrNotFound {
+			writeError(w, r, http.StatusNotFound, "not_found", "no exercise of your own is named "+name)
+			return
+		} else if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// resolveExercise returns the name the user's sets of the exercise are
+// stored under.
+func resolveExercise(user, name string) (string, error) {
+	c, err := loadCatalog(user)
+	if err != nil {
+		return "", err
+	}
+
+	id, _ := c.resolve(name)
+	return id, nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultLookbackDays = 90
+	maxLookbackDays     = 365
+)
+
+// Comparison compares each exercise of a day with the last session that
+// included it.
+type Comparison struct {
+	Date      string               `json:"date"`
+	Unit      string               `json:"unit"`
+	Exercises []ExerciseComparison `json:"exercises"`
+}
+
+// ExerciseComparison is the difference between an exercise today and the
+// last time it was performed. Previous fields are empty when no prior session
+// was found within the lookback window.
+type ExerciseComparison struct {
+	Exercise       string        `json:"exercise"`
+	PreviousDate   string        `json:"previous_date,omitempty"`
+	Volume         float64       `json:"volume"`
+	PreviousVolume float64       `json:"previous_volume"`
+	VolumeDelta    float64       `json:"volume_delta"`
+	TopSet         *Set          `json:"top_set,omitempty"`
+	PreviousTopSet *Set          `json:"previous_top_set,omitempty"`
+	TopSetDelta    float64       `json:"top_set_delta"`
+	Reps           []WeightDelta `json:"reps"`
+}
+
+// WeightDelta is the change in total reps performed at one weight. Type is
+// the set type of bodyweight sets, whose weight is added or assisted.
+type WeightDelta struct {
+	Weight       float64 `json:"weight"`
+	Type         string  `json:"type,omitempty"`
+	Reps         int     `json:"reps"`
+	PreviousReps int     `json:"previous_reps"`
+	Delta        int     `json:"delta"`
+}
+
+// compareWorkouts serves /v1/compare. The date query parameter defaults to
+// today. With match=weekday (the default) only earlier sessions on the same
+// weekday are considered; match=any considers every earlier day. Weights are
+// in the unit query parameter's unit.
+func compareWorkouts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+
+	date, err := queryDate(query.Get("date"), time.Now().In(loc).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "date",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	sameWeekday := true
+	switch query.Get("match") {
+	case "", "weekday":
+	case "any":
+		sameWeekday = false
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "match must be weekday or any", FieldError{
+			Field:   "match",
+			Message: "must be weekday or any",
+		})
+		return
+	}
+
+	lookback := defaultLookbackDays
+	if raw := query.Get("lookback"); raw != "" {
+		lookback, err = strconv.Atoi(raw)
+		if err != nil || lookback < 1 || lookback > maxLookbackDays {
+			writeError(w, r, http.StatusBadRequest, "invalid_query", "lookback must be between 1 and "+strconv.Itoa(maxLookbackDays), FieldError{
+				Field:   "lookback",
+				Message: "must be between 1 and " + strconv.Itoa(maxLookbackDays),
+			})
+			return
+		}
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	s := storeFor(requestUser(r))
+
+	current, err := s.Get(date.Format(dateLayout))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	history, err := s.Range(date.AddDate(0, 0, -lookback).Format(dateLayout), date.AddDate(0, 0, -1).Format(dateLayout))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	if sameWeekday {
+		var filtered []*Document
+		for _, doc := range history {
+			day, err := time.Parse(dateLayout, doc.Date)
+			if err == nil && day.Weekday() == date.Weekday() {
+				filtered = append(filtered, doc)
+			}
+		}
+		history = filtered
+	}
+
+	bws, err := loadBodyweights(s)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.comparison(compare(current, history, bws)))
+}
+
+// compare builds the comparison of current against history, which must be
+// sorted by date. Weights are in kilograms, and bodyweight sets count the
+// bodyweight of their own day.
+func compare(current *Document, history []*Document, bws bodyweights) Comparison {
+	comparison := Comparison{
+		Date:      current.Date,
+		Unit:      UnitKg,
+		Exercises: []ExerciseComparison{},
+	}
+
+	bw := bws.asOf(current.Date)
+
+	for exName, sets := range current.Exercises {
+		ec := ExerciseComparison{
+			Exercise: exName,
+			Volume:   volume(sets, bw),
+		}
+
+		var (
+			previous []Set
+			prevBW   float64
+		)
+		for i := len(history) - 1; i >= 0; i-- {
+			if prev := history[i].Exercises[exName]; len(prev) > 0 {
+				ec.PreviousDate = history[i].Date
+				previous = prev
+				prevBW = bws.asOf(history[i].Date)
+				break
+			}
+		}
+
+		ec.PreviousVolume = volume(previous, prevBW)
+		ec.VolumeDelta = ec.Volume - ec.PreviousVolume
+
+		if top, ok := topSet(sets, bw); ok {
+			ec.TopSet = &top
+		}
+		if top, ok := topSet(previous, prevBW); ok {
+			ec.PreviousTopSet = &top
+		}
+		if ec.TopSet != nil && ec.PreviousTopSet != nil {
+			ec.TopSetDelta = effectiveLoad(*ec.TopSet, bw) - effectiveLoad(*ec.PreviousTopSet, prevBW)
+		}
+
+		reps, prevReps := repsByWeight(sets), repsByWeight(previous)
+		for _, key := range sortedWeights(reps, prevReps) {
+			ec.Reps = append(ec.Reps, WeightDelta{
+				Weight:       key.Weight,
+				Type:         key.Type,
+				Reps:         reps[key],
+				PreviousReps: prevReps[key],
+				Delta:        reps[key] - prevReps[key],
+			})
+		}
+
+		comparison.Exercises = append(comparison.Exercises, ec)
+	}
+
+	sort.Slice(comparison.Exercises, func(i, j int) bool {
+		return comparison.Exercises[i].Exercise < comparison.Exercises[j].Exercise
+	})
+
+	return comparison
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Config is everything needed to run the server. It is usually read from
+// ~/.workout_server.yaml, WORKOUT_ environment variables and flags.
+type Config struct {
+	// Addr is the host:port the HTTP API listens on.
+	Addr string `mapstructure:"addr"`
+	// ReadTimeout, WriteTimeout and IdleTimeout bound each connection.
+	ReadTimeout  time.Duration `mapstructure:"read_timeout"`
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout  time.Duration `mapstructure:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests get to finish after
+	// SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+	// Timezone is the IANA timezone days are bucketed in when a request
+	// does not name one.
+	Timezone string `mapstructure:"timezone"`
+	// Store is the storage backend: couchbase, memory or file.
+	Store string `mapstructure:"store"`
+	// DataDir is the directory of the file store.
+	DataDir   string          `mapstructure:"data_dir"`
+	Couchbase CouchbaseConfig `mapstructure:"couchbase"`
+	Mail      MailConfig      `mapstructure:"mail"`
+
+	// The settings below, along with Timezone, are reloaded while the
+	// server runs; everything else needs a restart.
+
+	// LogLevel is the minimum level logged: debug, info, warn or error.
+	LogLevel string `mapstructure:"log_level"`
+	// RateLimit is the sustained requests per second allowed per client,
+	// with bursts of up to RateBurst. Zero disables rate limiting.
+	RateLimit float64 `mapstructure:"rate_limit"`
+	RateBurst int     `mapstructure:"rate_burst"`
+	// Features turns optional endpoints off by name. Features that are not
+	// listed are on.
+	Features map[string]bool `mapstructure:"features"`
+	// StrictExercises refuses writes naming exercises that are not in the
+	// catalog instead of storing them under their own names.
+	StrictExercises bool `mapstructure:"strict_exercises"`
+	// Unit is the weight unit, kg or lb, for users who have not chosen one.
+	// Weights stored without one, before every set carried a unit, are read
+	// in the unit this was the first time the store was used.
+	Unit string `mapstructure:"unit"`
+	// E1RMFormula is the default formula for e1RM history and PRs.
+	E1RMFormula string `mapstructure:"e1rm_formula"`
+	// CORSOrigins are the origins browsers may call the API from. "*"
+	// allows any origin.
+	CORSOrigins []string `mapstructure:"cors_origins"`
+	// TokenTTL is how long bearer tokens from /v1/login stay valid.
+	TokenTTL time.Duration `mapstructure:"token_ttl"`
+	// IdempotencyTTL is how long the response to a write with an
+	// Idempotency-Key is replayed to retries.
+	IdempotencyTTL time.Duration `mapstructure:"idempotency_ttl"`
+
+	// TokenSecret signs bearer tokens and needs a restart to change. When
+	// empty a key is generated and kept in the store.
+	TokenSecret string `mapstructure:"token_secret"`
+}
+
+// CouchbaseConfig configures the couchbase store.
+type CouchbaseConfig struct {
+	ConnectionString string `mapstructure:"connection_string"`
+	Bucket           string `mapstructure:"bucket"`
+	// Username and Password authenticate against the cluster. When Username
+	// is empty Password is used as the bucket password instead.
+	Username         string        `mapstructure:"username"`
+	Password         string        `mapstructure:"password"`
+	ConnectTimeout   time.Duration `mapstructure:"connect_timeout"`
+	OperationTimeout time.Duration `mapstructure:"operation_timeout"`
+}
+
+// MailConfig configures logging workouts by email. Messages are taken from
+// an SMTP listener, a maildir, or both.
+type MailConfig struct {
+	// Listen is the host:port of the SMTP listener, which must be a
+	// loopback address. Empty turns it off.
+	Listen string `mapstructure:"listen"`
+	// Maildir is a maildir whose new messages are ingested every
+	// PollInterval. Empty turns it off.
+	Maildir      string        `mapstructure:"maildir"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// From is the address replies are sent from.
+	From string `mapstructure:"from"`
+	// Relay is the host:port of the SMTP server replies are sent through.
+	// Without one replies are written to the Outbox maildir, and without
+	// either none are sent.
+	Relay  string `mapstructure:"relay"`
+	Outbox string `mapstructure:"outbox"`
+}
+
+// isLoopback reports whether host only accepts connections from this
+// machine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// DefaultConfig returns the configuration used for anything left unset.
+func DefaultConfig() Config {
+	return Config{
+		Addr:            ":3000",
+		ReadTimeout:     10 * time.Second,
+		WriteTimeout:    30 * time.Second,
+		IdleTimeout:     2 * time.Minute,
+		ShutdownTimeout: 15 * time.Second,
+		Timezone:        "Local",
+		Store:           "couchbase",
+		DataDir:         "data",
+		Couchbase: CouchbaseConfig{
+			ConnectionString: "couchbase://127.0.0.1",
+			Bucket:           "workout",
+			ConnectTimeout:   5 * time.Second,
+			OperationTimeout: 2500 * time.Millisecond,
+		},
+		Mail: MailConfig{
+			PollInterval: 30 * time.Second,
+			From:         "workout_server@localhost",
+		},
+		LogLevel:       "debug",
+		RateBurst:      20,
+		Unit:           UnitKg,
+		E1RMFormula:    "epley",
+		TokenTTL:       time.Hour,
+		IdempotencyTTL: 24 * time.Hour,
+	}
+}
+
+// Validate reports every problem with the configuration at once.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		problems = append(problems, fmt.Sprintf("addr %q must be host:port", c.Addr))
+	}
+
+	for name, timeout := range map[string]time.Duration{
+		"read_timeout":     c.ReadTimeout,
+		"write_timeout":    c.WriteTimeout,
+		"idle_timeout":     c.IdleTimeout,
+		"shutdown_timeout": c.ShutdownTimeout,
+	} {
+		if timeout <= 0 {
+			problems = append(problems, name+" must be positive")
+		}
+	}
+
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		problems = append(problems, fmt.Sprintf("timezone %q is not an IANA timezone", c.Timezone))
+	}
+
+	switch c.Store {
+	case "couchbase":
+		if c.Couchbase.ConnectionString == "" {
+			problems = append(problems, "couchbase.connection_string must be set")
+		}
+		if c.Couchbase.Bucket == "" {
+			problems = append(problems, "couchbase.bucket must be set")
+		}
+		if c.Couchbase.ConnectTimeout <= 0 {
+			problems = append(problems, "couchbase.connect_timeout must be positive")
+		}
+		if c.Couchbase.OperationTimeout <= 0 {
+			problems = append(problems, "couchbase.operation_timeout must be positive")
+		}
+
+	case "file":
+		if c.DataDir == "" {
+			problems = append(problems, "data_dir must be set for the file store")
+		}
+
+	case "memory":
+
+	default:
+		problems = append(problems, fmt.Sprintf("store %q must be couchbase, memory or file", c.Store))
+	}
+
+	if c.Mail.Listen != "" {
+		if host, _, err := net.SplitHostPort(c.Mail.Listen); err != nil {
+			problems = append(problems, fmt.Sprintf("mail.listen %q must be host:port", c.Mail.Listen))
+		} else if !isLoopback(host) {
+			problems = append(problems, fmt.Sprintf("mail.listen %q must be a loopback address; put an MTA in front to take mail from other hosts", c.Mail.Listen))
+		}
+	}
+	if c.Mail.Maildir != "" && c.Mail.PollInterval <= 0 {
+		problems = append(problems, "mail.poll_interval must be positive")
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		problems = append(problems, fmt.Sprintf("mail.from %q must be an email address", c.Mail.From))
+	}
+	if c.Mail.Relay != "" {
+		if _, _, err := net.SplitHostPort(c.Mail.Relay); err != nil {
+			problems = append(problems, fmt.Sprintf("mail.relay %q must be host:port", c.Mail.Relay))
+		}
+	}
+
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		problems = append(problems, fmt.Sprintf("log_level %q must be debug, info, warn or error", c.LogLevel))
+	}
+
+	if c.RateLimit < 0 {
+		problems = append(problems, "rate_limit must not be negative")
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		problems = append(problems, "rate_burst must be at least 1 when rate_limit is set")
+	}
+
+	for name := range c.Features {
+		if !knownFeatures[name] {
+			problems = append(problems, fmt.Sprintf("features.%s is not a feature", name))
+		}
+	}
+
+	if _, ok := parseUnit(c.Unit); !ok {
+		problems = append(problems, fmt.Sprintf("unit %q must be kg or lb", c.Unit))
+	}
+
+	if _, ok := formulas[c.E1RMFormula]; !ok {
+		problems = append(problems, fmt.Sprintf("e1rm_formula %q must be epley, brzycki, lombardi or wathan", c.E1RMFormula))
+	}
+
+	for _, origin := range c.CORSOrigins {
+		if origin == "" {
+			problems = append(problems, "cors_origins must not contain empty origins")
+		}
+	}
+
+	if c.TokenTTL <= 0 {
+		problems = append(problems, "token_ttl must be positive")
+	}
+	if c.IdempotencyTTL <= 0 {
+		problems = append(problems, "idempotency_ttl must be positive")
+	}
+	if c.TokenSecret != "" && len(c.TokenSecret) < 32 {
+		problems = append(problems, "token_secret must be at least 32 characters")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// Location returns the configured timezone.
+func (c *Config) Location() (*time.Location, error) {
+	return time.LoadLocation(c.Timezone)
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"time"
+
+	gocb "github.com/couchbase/gocb"
+	"github.com/pkg/errors"
+)
+
+const (
+	mergeRetries = 5
+	mergeBackoff = 10 * time.Millisecond
+)
+
+// CouchbaseStore keeps day documents in a Couchbase bucket.
+type CouchbaseStore struct {
+	cluster *gocb.Cluster
+	bucket  *gocb.Bucket
+	// prefix scopes the keys of a user's view of the store.
+	prefix string
+}
+
+// NewCouchbaseStore connects to the cluster and opens the bucket.
+func NewCouchbaseStore(cfg CouchbaseConfig) (*CouchbaseStore, error) {
+	cluster, err := gocb.Connect(cfg.ConnectionString)
+	if err != nil {
+		return nil, errors.Wrap(err, "gocb.Connect")
+	}
+	cluster.SetConnectTimeout(cfg.ConnectTimeout)
+
+	password := cfg.Password
+	if cfg.Username != "" {
+		err = cluster.Authenticate(gocb.PasswordAuthenticator{
+			Username: cfg.Username,
+			Password: cfg.Password,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "cluster.Authenticate")
+		}
+		password = ""
+	}
+
+	bucket, err := cluster.OpenBucket(cfg.Bucket, password)
+	if err != nil {
+		return nil, errors.Wrap(err, "cluster.OpenBucket")
+	}
+	bucket.SetOperationTimeout(cfg.OperationTimeout)
+
+	return &CouchbaseStore{
+		cluster: cluster,
+		bucket:  bucket,
+	}, nil
+}
+
+// User implements WorkoutStore.
+func (s *CouchbaseStore) User(id string) WorkoutStore {
+	return &CouchbaseStore{
+		cluster: s.cluster,
+		bucket:  s.bucket,
+		prefix:  s.prefix + "user::" + id + "::",
+	}
+}
+
+// Get implements WorkoutStore.
+func (s *CouchbaseStore) Get(date string) (*Document, error) {
+	doc := Document{}
+	_, err := s.bucket.Get(s.prefix+date, &doc)
+	if err != nil {
+		if gocb.IsKeyNotFoundError(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "bucket.Get")
+	}
+	doc.upgradeUnits()
+
+	return &doc, nil
+}
+
+// Upsert implements WorkoutStore.
+func (s *CouchbaseStore) Upsert(date string, doc *Document) error {
+	_, err := s.bucket.Upsert(s.prefix+date, doc, 0)
+	return errors.Wrap(err, "bucket.Upsert")
+}
+
+// Merge implements WorkoutStore through Update.
+func (s *CouchbaseStore) Merge(date string, doc *Document) (*Document, error) {
+	return s.Update(date, func(thing *Document) (*Document, error) {
+		if thing == nil {
+			thing = newDocument(date, doc)
+		}
+		mergeExercises(thing, doc)
+
+		return thing, nil
+	})
+}
+
+// Update implements WorkoutStore. The write is guarded by the CAS returned
+// from Get; on a CAS mismatch, or when another writer creates or removes the
+// day first, the update is retried from a fresh read with a growing backoff.
+func (s *CouchbaseStore) Update(date string, fn func(doc *Document) (*Document, error)) (*Document, error) {
+	backoff := mergeBackoff
+
+	for attempt := 0; attempt < mergeRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var current *Document
+		stored := Document{}
+		cas, err := s.bucket.Get(s.prefix+date, &stored)
+		if err == nil {
+			stored.upgradeUnits()
+			current = &stored
+		} else if !gocb.IsKeyNotFoundError(err) {
+			return nil, errors.Wrap(err, "bucket.Get")
+		}
+
+		doc, err := fn(current)
+		if err != nil {
+			return doc, err
+		}
+
+		var op string
+		switch {
+		case current == nil && doc == nil:
+			return nil, nil
+		case current == nil:
+			// Insert fails if another writer created the day in the meantime.
+			op = "bucket.Insert"
+			_, err = s.bucket.Insert(s.prefix+date, doc, 0)
+		case doc == nil:
+			// Remove and Replace fail if the day changed since we read it.
+			op = "bucket.Remove"
+			_, err = s.bucket.Remove(s.prefix+date, cas)
+		default:
+			op = "bucket.Replace"
+			_, err = s.bucket.Replace(s.prefix+date, doc, cas, 0)
+		}
+
+		if err == nil {
+			return doc, nil
+		}
+
+		// A day removed since the read is as much a conflict as one changed.
+		if !gocb.IsKeyExistsError(err) && !gocb.IsKeyNotFoundError(err) {
+			return nil, errors.Wrap(err, op)
+		}
+	}
+
+	return nil, ErrConflict
+}
+
+// Range implements WorkoutStore. Every day in the range is fetched in a
+// single bulk operation so no N1QL index is needed.
+func (s *CouchbaseStore) Range(from, to string) ([]*Document, error) {
+	var ops []gocb.BulkOp
+
+	err := dateRange(from, to, func(date string) error {
+		ops = append(ops, &gocb.GetOp{
+			Key:   s.prefix + date,
+			Value: &Document{},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.bucket.Do(ops); err != nil {
+		return nil, errors.Wrap(err, "bucket.Do")
+	}
+
+	var docs []*Document
+	for _, op := range ops {
+		get := op.(*gocb.GetOp)
+		if get.Err != nil {
+			if gocb.IsKeyNotFoundError(get.Err) {
+				continue
+			}
+			return nil, errors.Wrap(get.Err, "bucket.Get")
+		}
+
+		doc := get.Value.(*Document)
+		doc.upgradeUnits()
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// Delete implements WorkoutStore.
+func (s *CouchbaseStore) Delete(date string) error {
+	_, err := s.bucket.Remove(s.prefix+date, 0)
+	if gocb.IsKeyNotFoundError(err) {
+		return ErrNotFound
+	}
+
+	return errors.Wrap(err, "bucket.Remove")
+}
+
+// metaPrefix keeps auxiliary records out of the date keyspace.
+const metaPrefix = "meta::"
+
+// GetMeta implements WorkoutStore.
+func (s *CouchbaseStore) GetMeta(key string, v interface{}) error {
+	_, err := s.bucket.Get(s.prefix+metaPrefix+key, v)
+	if gocb.IsKeyNotFoundError(err) {
+		return ErrNotFound
+	}
+
+	return errors.Wrap(err, "bucket.Get")
+}
+
+// PutMeta implements WorkoutStore.
+func (s *CouchbaseStore) PutMeta(key string, v interface{}) error {
+	_, err := s.bucket.Upsert(s.prefix+metaPrefix+key, v, 0)
+	return errors.Wrap(err, "bucket.Upsert")
+}
+
+// UpdateMeta implements WorkoutStore with the CAS retries of Update.
+func (s *CouchbaseStore) UpdateMeta(key string, v interface{}, fn func() error) error {
+	backoff := mergeBackoff
+
+	for attempt := 0; attempt < mergeRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		resetValue(v)
+		cas, err := s.bucket.Get(s.prefix+metaPrefix+key, v)
+		found := err == nil
+		if err != nil && !gocb.IsKeyNotFoundError(err) {
+			return errors.Wrap(err, "bucket.Get")
+		}
+		if !found {
+			resetValue(v)
+		}
+
+		if err := fn(); err != nil {
+			return err
+		}
+
+		op := "bucket.Replace"
+		if found {
+			_, err = s.bucket.Replace(s.prefix+metaPrefix+key, v, cas, 0)
+		} else {
+			op = "bucket.Insert"
+			_, err = s.bucket.Insert(s.prefix+metaPrefix+key, v, 0)
+		}
+
+		if err == nil {
+			return nil
+		}
+
+		if !gocb.IsKeyExistsError(err) && !gocb.IsKeyNotFoundError(err) {
+			return errors.Wrap(err, op)
+		}
+	}
+
+	return ErrConflict
+}
+
+// PutMetaExpiring implements WorkoutStore. Couchbase removes the record
+// itself once it expires.
+func (s *CouchbaseStore) PutMetaExpiring(key string, v interface{}, ttl time.Duration) error {
+	_, err := s.bucket.Upsert(s.prefix+metaPrefix+key, v, couchbaseExpiry(ttl, time.Now()))
+	return errors.Wrap(err, "bucket.Upsert")
+}
+
+// maxRelativeExpiry is the longest expiry Couchbase reads as seconds from
+// now; longer ones must be given as a unix time.
+const maxRelativeExpiry = 30 * 24 * time.Hour
+
+// couchbaseExpiry encodes ttl as a Couchbase document expiry.
+func couchbaseExpiry(ttl time.Duration, now time.Time) uint32 {
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	if ttl > maxRelativeExpiry {
+		return uint32(now.Add(ttl).Unix())
+	}
+	return uint32(ttl / time.Second)
+}
+
+// DeleteMeta implements WorkoutStore.
+func (s *CouchbaseStore) DeleteMeta(key string) error {
+	_, err := s.bucket.Remove(s.prefix+metaPrefix+key, 0)
+	if gocb.IsKeyNotFoundError(err) {
+		return ErrNotFound
+	}
+
+	return errors.Wrap(err, "bucket.Remove")
+}
+
+// Close implements WorkoutStore. Closing a user's view closes the bucket for
+// every view.
+func (s *CouchbaseStore) Close() error {
+	return errors.Wrap(s.bucket.Close(), "bucket.Close")
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxFutureDays is how far past today, in the request's timezone, a client
+// may log a workout. One day of slack covers clients a timezone ahead of us.
+const maxFutureDays = 1
+
+// timezoneHeader lets a client name the IANA timezone it is logging from.
+const timezoneHeader = "X-Timezone"
+
+// requestLocation returns the timezone of the request, falling back to the
+// server's configured timezone.
+func requestLocation(r *http.Request) (*time.Location, error) {
+	name := r.Header.Get(timezoneHeader)
+	if name == "" {
+		return defaultLocation(), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+
+	return loc, nil
+}
+
+// resolveDate returns the day, in YYYY-MM-DD form, that a workout belongs to.
+// raw is the client-supplied ISO-8601 date or timestamp; when it is empty the
+// current day in loc is used. Timestamps are bucketed by their own offset.
+func resolveDate(raw string, loc *time.Location, now time.Time) (string, error) {
+	today := now.In(loc).Format(dateLayout)
+	if raw == "" {
+		return today, nil
+	}
+
+	day, err := time.ParseInLocation(dateLayout, raw, loc)
+	if err != nil {
+		t, terr := time.Parse(time.RFC3339, raw)
+		if terr != nil {
+			return "", fmt.Errorf("invalid date %q: expected YYYY-MM-DD or RFC 3339", raw)
+		}
+		day, _ = time.ParseInLocation(dateLayout, t.Format(dateLayout), loc)
+	}
+
+	limit, _ := time.ParseInLocation(dateLayout, today, loc)
+	if day.After(limit.AddDate(0, 0, maxFutureDays)) {
+		return "", fmt.Errorf("date %s is too far in the future", day.Format(dateLayout))
+	}
+
+	return day.Format(dateLayout), nil
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SchemaVersion is the version of the day document layout written by this
+// server. Documents without a version are the legacy weight-to-reps maps, and
+// version 2 documents kept each weight in the unit it was logged in.
+const SchemaVersion = 3
+
+// loggedUnitVersion is the last version that kept weights in the unit they
+// were logged in.
+const loggedUnitVersion = 2
+
+// Set types say what a set lifts. A set without a type lifts Weight.
+const (
+	// SetBodyweight lifts the lifter's bodyweight alone; Weight is 0.
+	SetBodyweight = "bodyweight"
+	// SetWeighted lifts bodyweight plus Weight, as with a dip belt.
+	SetWeighted = "weighted"
+	// SetAssisted lifts bodyweight less Weight, as on an assisted machine.
+	SetAssisted = "assisted"
+)
+
+// Set is a single set of an exercise. Stored sets are in kilograms and keep
+// the weight as it was logged in LoggedWeight and LoggedUnit, which the API
+// shows but never reads; it shows sets in the unit asked for.
+type Set struct {
+	Weight       float64   `json:"weight"`
+	Unit         string    `json:"unit,omitempty"`
+	Type         string    `json:"type,omitempty"`
+	Reps         int       `json:"reps"`
+	Timestamp    time.Time `json:"timestamp"`
+	RPE          float64   `json:"rpe,omitempty"`
+	Notes        string    `json:"notes,omitempty"`
+	LoggedWeight float64   `json:"logged_weight,omitempty"`
+	LoggedUnit   string    `json:"logged_unit,omitempty"`
+}
+
+// Document is everything logged for one day. Exercises maps an exercise name
+// to its sets in the order they were performed, Activities are the cardio
+// and conditioning work of the day in the same order, and Bodyweight is the
+// day's weigh-in, if any.
+type Document struct {
+	Version       int              `json:"version"`
+	InsertionDate string           `json:"insertion_date"`
+	Date          string           `json:"date"`
+	Exercises     map[string][]Set `json:"exercises"`
+	Activities    []Activity       `json:"activities,omitempty"`
+	Bodyweight    *Weighin         `json:"bodyweight,omitempty"`
+}
+
+// UnmarshalJSON reads both current and legacy documents. Legacy exercises are
+// maps of weight to total reps; each weight becomes a single set, and the
+// document reads as version 2 since its weights are still in the unit they
+// were logged in. Weights are never converted here: Log reads request bodies
+// in the user's unit, and stores convert older documents with upgradeUnits.
+func (d *Document) UnmarshalJSON(data []byte) error {
+	raw := struct {
+		Version       int                        `json:"version"`
+		InsertionDate string                     `json:"insertion_date"`
+		Date          string                     `json:"date"`
+		Exercises     map[string]json.RawMessage `json:"exercises"`
+		Activities    []Activity                 `json:"activities"`
+		Bodyweight    *Weighin                   `json:"bodyweight"`
+	}{}
+
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	d.Version = raw.Version
+	d.InsertionDate = raw.InsertionDate
+	d.Date = raw.Date
+	if d.Date == "" {
+		// Legacy documents were keyed by the day they were inserted.
+		d.Date = raw.InsertionDate
+	}
+	d.Exercises = make(map[string][]Set, len(raw.Exercises))
+	d.Activities = raw.Activities
+	d.Bodyweight = raw.Bodyweight
+
+	for exName, exer := range raw.Exercises {
+		var sets []Set
+
+		exer = bytes.TrimSpace(exer)
+		if len(exer) > 0 && exer[0] == '{' {
+			var err error
+			sets, err = upgradeLegacySets(exer, d.Date)
+			if err != nil {
+				return fmt.Errorf("exercise %q: %v", exName, err)
+			}
+			d.Version = loggedUnitVersion
+		} else if err := json.Unmarshal(exer, &sets); err != nil {
+			return fmt.Errorf("exercise %q: %v", exName, err)
+		}
+
+		d.Exercises[exName] = sets
+	}
+
+	return nil
+}
+
+// upgradeUnits converts a stored document from before weights were kept in
+// kilograms, reading weights without a unit in legacyUnit. Current documents
+// are left as they are.
+func (d *Document) upgradeUnits() {
+	if d.Version < SchemaVersion {
+		d.canonicalize(legacyUnit())
+	}
+}
+
+// upgradeLegacySets converts a legacy weight-to-reps map into sets ordered by
+// weight. The sets are stamped with the start of the day they were logged.
+func upgradeLegacySets(data []byte, date string) ([]Set, error) {
+	legacy := map[string]int{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, err
+	}
+
+	stamp, _ := time.Parse(dateLayout, date)
+
+	sets := make([]Set, 0, len(legacy))
+	for weight, reps := range legacy {
+		w, err := strconv.ParseFloat(weight, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q", weight)
+		}
+
+		sets = append(sets, Set{
+			Weight:    w,
+			Reps:      reps,
+			Timestamp: stamp,
+		})
+	}
+
+	sort.Slice(sets, func(i, j int) bool {
+		return sets[i].Weight < sets[j].Weight
+	})
+
+	return sets, nil
+}
+
+// Load describes what the set lifts, such as 100kg, bw or bw+20kg.
+func (s Set) Load() string {
+	weight := strconv.FormatFloat(s.Weight, 'f', -1, 64) + s.Unit
+
+	switch s.Type {
+	case SetBodyweight:
+		return "bw"
+	case SetWeighted:
+		return "bw+" + weight
+	case SetAssisted:
+		return "bw-" + weight
+	}
+
+	return weight
+}
+
+// stamp sets the timestamp of every set, activity and weigh-in that does not
+// have one.
+func (d *Document) stamp(now time.Time) {
+	for exName, sets := range d.Exercises {
+		for i := range sets {
+			if sets[i].Timestamp.IsZero() {
+				d.Exercises[exName][i].Timestamp = now
+			}
+		}
+	}
+
+	for i := range d.Activities {
+		if d.Activities[i].Timestamp.IsZero() {
+			d.Activities[i].Timestamp = now
+		}
+	}
+
+	if d.Bodyweight != nil && d.Bodyweight.Time.IsZero() {
+		d.Bodyweight.Time = now.UTC()
+	}
+}
+
+// empty reports whether nothing is logged in d.
+func (d *Document) empty() bool {
+	return len(d.Exercises) == 0 && len(d.Activities) == 0 && d.Bodyweight == nil
+}
+
+// validate reports every set, activity and weigh-in that cannot be stored.
+func (d *Document) validate() []FieldError {
+	var fields []FieldError
+
+	for exName, sets := range d.Exercises {
+		if exName == "" {
+			fields = append(fields, FieldError{
+				Field:   "exercises",
+				Message: "exercise name must not be empty",
+			})
+		}
+
+		for i, set := range sets {
+			field := fmt.Sprintf("exercises.%s[%d]", exName, i)
+
+			if set.Reps <= 0 {
+				fields = append(fields, FieldError{
+					Field:   field + ".reps",
+					Message: "reps must be positive",
+				})
+			}
+			if set.Weight < 0 {
+				fields = append(fields, FieldError{
+					Field:   field + ".weight",
+					Message: "weight must not be negative",
+				})
+			}
+			switch set.Type {
+			case "", SetWeighted, SetAssisted:
+			case SetBodyweight:
+				if set.Weight != 0 {
+					fields = append(fields, FieldError{
+						Field:   field + ".weight",
+						Message: "bodyweight sets must not have a weight; use weighted or assisted",
+					})
+				}
+			default:
+				fields = append(fields, FieldError{
+					Field:   field + ".type",
+					Message: "type must be bodyweight, weighted or assisted",
+				})
+			}
+			if _, ok := parseUnit(set.Unit); set.Unit != "" && !ok {
+				fields = append(fields, FieldError{
+					Field:   field + ".unit",
+					Message: "unit must be kg or lb",
+				})
+			}
+			if set.RPE < 0 || set.RPE > 10 {
+				fields = append(fields, FieldError{
+					Field:   field + ".rpe",
+					Message: "rpe must be between 0 and 10",
+				})
+			}
+		}
+	}
+
+	for i, a := range d.Activities {
+		fields = append(fields, a.validate(fmt.Sprintf("activities[%d]", i))...)
+	}
+
+	if d.Bodyweight != nil {
+		fields = append(fields, d.Bodyweight.validate("bodyweight")...)
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Field < fields[j].Field
+	})
+
+	return fields
+}
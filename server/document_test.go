@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDocumentUnmarshalJSON(t *testing.T) {
+	day := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	stamp := time.Date(2017, 3, 4, 18, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		json string
+		want Document
+	}{
+		{
+			name: "legacy map becomes sets ordered by weight",
+			json: `{"insertion_date":"2017-03-04","exercises":{"bench":{"155":3,"135":10}}}`,
+			want: Document{
+				Version:       loggedUnitVersion,
+				InsertionDate: "2017-03-04",
+				Date:          "2017-03-04",
+				Exercises: map[string][]Set{
+					"bench": {
+						{Weight: 135, Reps: 10, Timestamp: day},
+						{Weight: 155, Reps: 3, Timestamp: day},
+					},
+				},
+			},
+		},
+		{
+			name: "legacy and current exercises together",
+			json: `{"version":1,"date":"2017-03-04","exercises":{"bench":{"100":5},"squat":[{"weight":140,"reps":5,"timestamp":"2017-03-04T18:30:00Z"}]}}`,
+			want: Document{
+				Version: loggedUnitVersion,
+				Date:    "2017-03-04",
+				Exercises: map[string][]Set{
+					"bench": {{Weight: 100, Reps: 5, Timestamp: day}},
+					"squat": {{Weight: 140, Reps: 5, Timestamp: stamp}},
+				},
+			},
+		},
+		{
+			name: "current document is read as it is",
+			json: `{"version":3,"date":"2017-03-04","exercises":{"squat":[{"weight":140,"unit":"kg","reps":5,"timestamp":"2017-03-04T18:30:00Z","logged_weight":140,"logged_unit":"kg"}]}}`,
+			want: Document{
+				Version: SchemaVersion,
+				Date:    "2017-03-04",
+				Exercises: map[string][]Set{
+					"squat": {{Weight: 140, Unit: UnitKg, Reps: 5, Timestamp: stamp, LoggedWeight: 140, LoggedUnit: UnitKg}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		var got Document
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil {
+			t.Errorf("%s: Unmarshal: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Unmarshal = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDocumentUnmarshalJSONErrors(t *testing.T) {
+	for _, data := range []string{
+		`{"date":"2017-03-04","exercises":{"bench":{"heavy":5}}}`,
+		`{"date":"2017-03-04","exercises":{"bench":{"100":"five"}}}`,
+		`{"date":"2017-03-04","exercises":{"bench":5}}`,
+	} {
+		var doc Document
+		if err := json.Unmarshal([]byte(data), &doc); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded, want an error", data)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formula estimates a one-rep max from a weight lifted for reps.
+type Formula func(weight float64, reps int) float64
+
+// formulas are the supported e1RM formulas by name.
+var formulas = map[string]Formula{
+	"epley": func(weight float64, reps int) float64 {
+		return weight * (1 + float64(reps)/30)
+	},
+	"brzycki": func(weight float64, reps int) float64 {
+		// The formula diverges as reps approach 37.
+		if reps >= 37 {
+			return 0
+		}
+		return weight * 36 / float64(37-reps)
+	},
+	"lombardi": func(weight float64, reps int) float64 {
+		return weight * math.Pow(float64(reps), 0.10)
+	},
+	"wathan": func(weight float64, reps int) float64 {
+		return 100 * weight / (48.8 + 53.8*math.Exp(-0.075*float64(reps)))
+	},
+}
+
+// E1RMPoint is the best estimated one-rep max for an exercise on one day.
+// Weight, Type and Reps are the set it was estimated from; for bodyweight
+// sets the estimate counts Bodyweight too.
+type E1RMPoint struct {
+	Date       string  `json:"date"`
+	E1RM       float64 `json:"e1rm"`
+	Weight     float64 `json:"weight"`
+	Type       string  `json:"type,omitempty"`
+	Bodyweight float64 `json:"bodyweight,omitempty"`
+	Reps       int     `json:"reps"`
+}
+
+// E1RMSeries is the e1RM history of an exercise.
+type E1RMSeries struct {
+	Exercise string      `json:"exercise"`
+	Formula  string      `json:"formula"`
+	Unit     string      `json:"unit"`
+	Points   []E1RMPoint `json:"points"`
+}
+
+// estimate returns the e1RM of a set done at bodyweight bw. A single rep is
+// its own max.
+func estimate(f Formula, set Set, bw float64) float64 {
+	if set.Reps <= 0 {
+		return 0
+	}
+
+	load := effectiveLoad(set, bw)
+	if set.Reps == 1 {
+		return load
+	}
+
+	return round(f(load, set.Reps), 2)
+}
+
+func round(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+// bestE1RM returns the point for the set with the highest e1RM, done at
+// bodyweight bw.
+func bestE1RM(f Formula, date string, sets []Set, bw float64) (E1RMPoint, bool) {
+	var (
+		best  E1RMPoint
+		found bool
+	)
+
+	for _, set := range sets {
+		if e := estimate(f, set, bw); !found || e > best.E1RM {
+			best = E1RMPoint{
+				Date:   date,
+				E1RM:   e,
+				Weight: set.Weight,
+				Type:   set.Type,
+				Reps:   set.Reps,
+			}
+			if set.Type != "" {
+				best.Bodyweight = bw
+			}
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+// e1rmCacheTTL is how long a user's cached e1RMs are used before they are
+// read again, so writes made by other processes, which cannot invalidate
+// them, show up.
+const e1rmCacheTTL = 5 * time.Minute
+
+// e1rmCache materializes the best e1RM of every exercise per day and formula
+// so a history request only reads the days it has not seen before. Writes
+// must call invalidate for the day they touched. The store is read without
+// the cache locked.
+type e1rmCache struct {
+	mu sync.Mutex
+	// days maps user and formula, then date, to each exercise's best point.
+	// A day with no document is cached as an empty map.
+	days map[string]map[string]map[string]E1RMPoint
+	// started holds when each user and formula's days began to be cached.
+	started map[string]time.Time
+	// generations counts the invalidations of each user's days, so days
+	// read while one happened are not cached.
+	generations map[string]int
+}
+
+var e1rms = newE1RMCache()
+
+func newE1RMCache() *e1rmCache {
+	return &e1rmCache{
+		days:        map[string]map[string]map[string]E1RMPoint{},
+		started:     map[string]time.Time{},
+		generations: map[string]int{},
+	}
+}
+
+// invalidate forgets everything cached for the user's day.
+func (c *e1rmCache) invalidate(user, date string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[user]++
+	for formula := range formulas {
+		delete(c.days[user+"|"+formula], date)
+	}
+}
+
+// invalidateSpan drops the user's cached days between from and to inclusive,
+// from the first cached day when from is empty and to the last when to is,
+// as when a change of bodyweight moves the estimates of the days it stands
+// for.
+func (c *e1rmCache) invalidateSpan(user, from, to string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generations[user]++
+	for formula := range formulas {
+		for date := range c.days[user+"|"+formula] {
+			if date >= from && (to == "" || date <= to) {
+				delete(c.days[user+"|"+formula], date)
+			}
+		}
+	}
+}
+
+// series returns the user's e1RM history of the exercise between from and to.
+func (c *e1rmCache) series(user, formula, exercise string, from, to time.Time) ([]E1RMPoint, error) {
+	f := formulas[formula]
+	key := user + "|" + formula
+
+	// Only the span between the first and last uncached days is read; the
+	// points of the cached days outside it are taken now.
+	missingFrom, missingTo, points, generation := c.cached(key, user, exercise, from, to)
+
+	if missingFrom != "" {
+		s := storeFor(user)
+
+		docs, err := s.Range(missingFrom, missingTo)
+		if err != nil {
+			return nil, err
+		}
+
+		bws, err := loadBodyweights(s)
+		if err != nil {
+			return nil, err
+		}
+
+		read := map[string]map[string]E1RMPoint{}
+		start, _ := time.Parse(dateLayout, missingFrom)
+		end, _ := time.Parse(dateLayout, missingTo)
+		for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+			read[day.Format(dateLayout)] = map[string]E1RMPoint{}
+		}
+
+		for _, doc := range docs {
+			for exName, sets := range doc.Exercises {
+				if best, ok := bestE1RM(f, doc.Date, sets, bws.asOf(doc.Date)); ok {
+					read[doc.Date][exName] = best
+				}
+			}
+		}
+
+		for _, bests := range read {
+			if point, ok := bests[exercise]; ok {
+				points = append(points, point)
+			}
+		}
+
+		c.mu.Lock()
+		if c.generations[user] == generation && c.days[key] != nil {
+			for date, bests := range read {
+				c.days[key][date] = bests
+			}
+		}
+		c.mu.Unlock()
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Date < points[j].Date
+	})
+
+	return points, nil
+}
+
+// cached returns the span of days between from and to that series must read,
+// the exercise's points on the cached days outside it, and the user's
+// generation as they were taken.
+func (c *e1rmCache) cached(key, user, exercise string, from, to time.Time) (missingFrom, missingTo string, points []E1RMPoint, generation int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	days := c.days[key]
+	if days == nil || time.Since(c.started[key]) > e1rmCacheTTL {
+		days = map[string]map[string]E1RMPoint{}
+		c.days[key] = days
+		c.started[key] = time.Now()
+	}
+
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		if _, ok := days[date]; !ok {
+			if missingFrom == "" {
+				missingFrom = date
+			}
+			missingTo = date
+		}
+	}
+
+	points = []E1RMPoint{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		if missingFrom != "" && date >= missingFrom && date <= missingTo {
+			continue
+		}
+		if point, ok := days[date][exercise]; ok {
+			points = append(points, point)
+		}
+	}
+
+	return missingFrom, missingTo, points, c.generations[user]
+}
+
+// exercises serves /v1/exercises/{name} and /v1/exercises/{name}/e1rm.
+func exercises(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/exercises/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		catalogExercise(w, r, parts[0])
+
+	case len(parts) == 2 && parts[0] != "" && parts[1] == "e1rm":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		requireFeature("e1rm", func(w http.ResponseWriter, r *http.Request) {
+			getE1RM(w, r, parts[0])
+		})(w, r)
+
+	default:
+		writeError(w, r, http.StatusNotFound, "not_found", "no such endpoint")
+	}
+}
+
+// getE1RM returns the e1RM history of the exercise between the from and to
+// query parameters, defaulting to the last 90 days, in the unit query
+// parameter's unit.
+func getE1RM(w http.ResponseWriter, r *http.Request, exercise string) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+
+	formula := query.Get("formula")
+	if formula == "" {
+		formula = defaultFormula()
+	}
+	if _, ok := formulas[formula]; !ok {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", fmt.Sprintf("unknown formula %q", formula), FieldError{
+			Field:   "formula",
+			Message: "must be one of epley, brzycki, lombardi or wathan",
+		})
+		return
+	}
+
+	to, err := queryDate(query.Get("to"), time.Now().In(loc).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "to",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	from, err := queryDate(query.Get("from"), to.AddDate(0, 0, -defaultLookbackDays).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "from",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if from.After(to) {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "from must not be after to")
+		return
+	}
+
+	if to.Sub(from) >= maxRangeDays*24*time.Hour {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", fmt.Sprintf("range must not exceed %d days", maxRangeDays))
+		return
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	exercise, err = resolveExercise(requestUser(r), exercise)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	points, err := e1rms.series(requestUser(r), formula, exercise, from, to)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, E1RMSeries{
+		Exercise: exercise,
+		Formula:  formula,
+		Unit:     units.Unit,
+		Points:   units.points(points),
+	})
+}
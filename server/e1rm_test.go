@@ -0,0 +1,51 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestE1RMSeries(t *testing.T) {
+	const writers = 10
+
+	useMemoryStore(t)
+
+	from, _ := time.Parse(dateLayout, "2026-01-01")
+	to, _ := time.Parse(dateLayout, "2026-01-31")
+
+	series := func() []E1RMPoint {
+		t.Helper()
+
+		points, err := e1rms.series("al", "epley", "back_squat", from, to)
+		if err != nil {
+			t.Fatalf("series: %v", err)
+		}
+		return points
+	}
+
+	logSets(t, "al", "a", "2026-01-05", "squat", Set{Weight: 100, Reps: 1})
+	if points := series(); len(points) != 1 || points[0].Date != "2026-01-05" {
+		t.Fatalf("points = %+v, want one on 2026-01-05", points)
+	}
+
+	// Reads racing writes never leave a day cached as it was before one.
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(day int) {
+			defer wg.Done()
+			date := time.Date(2026, 1, 10+day, 0, 0, 0, 0, time.UTC).Format(dateLayout)
+			logSets(t, "al", "a", date, "squat", Set{Weight: 100, Reps: 1})
+		}(i)
+		go func() {
+			defer wg.Done()
+			series()
+		}()
+	}
+	wg.Wait()
+
+	if points := series(); len(points) != writers+1 {
+		t.Errorf("%d points, want %d", len(points), writers+1)
+	}
+}
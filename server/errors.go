@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// requestIDHeader carries the request ID in both directions so clients can
+// correlate an error response with the server logs.
+const requestIDHeader = "X-Request-ID"
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// FieldError describes a problem with one field of the request body. Line
+// and Column locate the problem within a text field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+}
+
+// ErrorResponse is the body of every error returned by the API.
+type ErrorResponse struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+// withRequestID tags each request with an ID, taken from the client when it
+// sends one, and echoes it back in the response headers.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("could not write response", zap.Error(err))
+	}
+}
+
+// writeError writes an ErrorResponse with the given status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, fields ...FieldError) {
+	writeJSON(w, status, ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Fields:    fields,
+		RequestID: requestID(r),
+	})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", r.Method+" is not supported on "+r.URL.Path)
+}
+
+// writeStoreError maps an error returned by the WorkoutStore onto a response.
+// Anything other than a missing or contended document means the backend is
+// unhealthy, so it is logged and reported as unavailable.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ErrNotFound:
+		writeError(w, r, http.StatusNotFound, "not_found", "no workout found for that day")
+
+	case ErrConflict:
+		writeError(w, r, http.StatusConflict, "conflict", "the workout was modified concurrently, please retry")
+
+	default:
+		logger.Error("store failure", zap.String("request_id", requestID(r)), zap.Error(err))
+		writeError(w, r, http.StatusServiceUnavailable, "storage_unavailable", "the workout store is unavailable")
+	}
+}
@@ -0,0 +1,441 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Event types say how an event changes its day.
+const (
+	// EventMerge adds the sets of Doc to the day.
+	EventMerge = "merge"
+	// EventReplace makes Doc the whole day, or removes the day when Doc is
+	// nil.
+	EventReplace = "replace"
+	// EventSetExercise makes Sets the sets of Exercise, removing the
+	// exercise when there are none.
+	EventSetExercise = "set_exercise"
+)
+
+// eventsPrefix keys the meta record of a day's events in the user's view of
+// the store.
+const eventsPrefix = "events:"
+
+// Event is an accepted write. Events are never changed once stored; a day
+// document is the projection of its events in order and can be rebuilt from
+// them.
+type Event struct {
+	ID   string    `json:"id"`
+	User string    `json:"user,omitempty"`
+	Time time.Time `json:"time"`
+	// Source is the session or tool that made the write.
+	Source string `json:"source"`
+	// Action is what was done, such as log, import or delete_set. Type
+	// alone decides how the event is applied.
+	Action   string    `json:"action"`
+	Type     string    `json:"type"`
+	Date     string    `json:"date"`
+	Doc      *Document `json:"doc,omitempty"`
+	Exercise string    `json:"exercise,omitempty"`
+	Sets     []Set     `json:"sets,omitempty"`
+}
+
+// DayHistory is every write made to a day, oldest first.
+type DayHistory struct {
+	Date   string  `json:"date"`
+	Events []Event `json:"events"`
+}
+
+// apply returns the day after the event. doc is not modified and a nil
+// result means the day has no document.
+func (ev *Event) apply(doc *Document) *Document {
+	switch ev.Type {
+	case EventMerge:
+		if doc == nil {
+			doc = newDocument(ev.Date, ev.Doc)
+		} else {
+			doc = copyDocument(doc)
+		}
+		mergeExercises(doc, ev.Doc)
+
+	case EventReplace:
+		if ev.Doc == nil {
+			return nil
+		}
+		doc = copyDocument(ev.Doc)
+		doc.Date = ev.Date
+
+	case EventSetExercise:
+		if doc == nil {
+			doc = newDocument(ev.Date, &Document{InsertionDate: ev.Date})
+		} else {
+			doc = copyDocument(doc)
+		}
+
+		if len(ev.Sets) == 0 {
+			delete(doc.Exercises, ev.Exercise)
+		} else {
+			// Events from before sets were stored in kilograms are
+			// converted as their documents are.
+			sets := make([]Set, len(ev.Sets))
+			for i, set := range ev.Sets {
+				sets[i] = storedSet(set, legacyUnit())
+			}
+			doc.Exercises[ev.Exercise] = sets
+		}
+	}
+
+	if doc == nil || doc.empty() {
+		return nil
+	}
+	doc.Version = SchemaVersion
+
+	return doc
+}
+
+// project folds events into the day they describe.
+func project(events []Event) *Document {
+	var doc *Document
+	for i := range events {
+		doc = events[i].apply(doc)
+	}
+
+	return doc
+}
+
+// loadEvents returns the events of the day, oldest first.
+func loadEvents(s WorkoutStore, date string) ([]Event, error) {
+	var events []Event
+	if err := s.GetMeta(eventsPrefix+date, &events); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	for _, ev := range events {
+		if ev.Doc != nil {
+			ev.Doc.upgradeUnits()
+		}
+	}
+
+	return events, nil
+}
+
+// appendEvent stores ev, filling in its ID and time, once the write it records
+// has been applied to the day document, so a write that failed leaves no
+// event behind. before is the day as the write found it: a day written before
+// events existed first gets a baseline event holding it, so that rebuilding
+// the day keeps it. Events appended concurrently, from this process or
+// another, are all kept.
+func appendEvent(user string, before *Document, ev Event) error {
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+
+	ev.ID = id
+	ev.User = user
+	ev.Time = time.Now().UTC()
+
+	var events []Event
+	return storeFor(user).UpdateMeta(eventsPrefix+ev.Date, &events, func() error {
+		if len(events) == 0 && before != nil {
+			id, err := randomHex(8)
+			if err != nil {
+				return err
+			}
+
+			events = append(events, Event{
+				ID:     id,
+				User:   user,
+				Time:   ev.Time,
+				Source: "baseline",
+				Action: "baseline",
+				Type:   EventReplace,
+				Date:   ev.Date,
+				Doc:    before,
+			})
+		}
+
+		events = append(events, ev)
+		return nil
+	})
+}
+
+// errUnchanged stops an Update that has nothing to write.
+var errUnchanged = errors.New("nothing to write")
+
+// recordWrite appends ev for a write that found the day as found and left it
+// as wrote. When the event cannot be stored the write is rolled back, so the
+// day holds nothing its events do not, and the error is returned. A day
+// written again in the meantime is left to the later write, and Rebuild
+// leaves it alone until its events account for it.
+func recordWrite(user string, found, wrote *Document, ev Event) error {
+	err := appendEvent(user, found, ev)
+	if err == nil {
+		return nil
+	}
+
+	_, rerr := storeFor(user).Update(ev.Date, func(doc *Document) (*Document, error) {
+		if !sameDocument(doc, wrote) {
+			return nil, errUnchanged
+		}
+		return found, nil
+	})
+	if rerr != nil {
+		logger.Error("could not roll back write", zap.String("user", user), zap.String("date", ev.Date), zap.Error(rerr))
+	}
+	e1rms.invalidate(user, ev.Date)
+
+	return err
+}
+
+// History returns the events of the user's day.
+func History(user, date string) (*DayHistory, error) {
+	events, err := loadEvents(storeFor(user), date)
+	if err != nil {
+		return nil, err
+	}
+
+	if events == nil {
+		events = []Event{}
+	}
+
+	return &DayHistory{
+		Date:   date,
+		Events: events,
+	}, nil
+}
+
+// Rebuild replaces each of the user's day documents between from and to with
+// the projection of its events and recomputes the PRs of the exercises that
+// changed. Days without events, written before events existed, are left as
+// they are, as are days holding sets, activities or weigh-ins none of their
+// events do, whose dates are returned as kept. It returns the number of days
+// that changed, and stops with ErrConflict when other writers keep changing a
+// day it rebuilds.
+func Rebuild(user, from, to string) (rebuilt int, kept []string, err error) {
+	defer lockUser(user)()
+
+	s := storeFor(user)
+
+	first, last := "", ""
+	seen := map[string]bool{}
+	var exercises []string
+	var weighed weighedSpan
+
+	err = dateRange(from, to, func(date string) error {
+		events, err := loadEvents(s, date)
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		doc := project(events)
+
+		// Most days already match their events and need no write.
+		current, err := s.Get(date)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if sameDocument(current, doc) {
+			return nil
+		}
+
+		changed, unaccounted := false, false
+		_, err = s.Update(date, func(stored *Document) (*Document, error) {
+			current = stored
+			changed, unaccounted = false, unrecorded(stored, events)
+			if unaccounted || sameDocument(stored, doc) {
+				return nil, errUnchanged
+			}
+			changed = true
+			return doc, nil
+		})
+		if err == errUnchanged {
+			err = nil
+		}
+		if unaccounted {
+			kept = append(kept, date)
+		}
+		if err != nil || !changed {
+			return err
+		}
+		e1rms.invalidate(user, date)
+		rebuilt++
+
+		if err := indexWeighin(user, date, doc, &weighed); err != nil {
+			return err
+		}
+
+		if first == "" {
+			first = date
+		}
+		last = date
+		for _, d := range []*Document{current, doc} {
+			if d == nil {
+				continue
+			}
+			for _, exName := range exerciseNames(d) {
+				if !seen[exName] {
+					seen[exName] = true
+					exercises = append(exercises, exName)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return rebuilt, kept, err
+	}
+
+	if err := weighed.refresh(user); err != nil {
+		return rebuilt, kept, err
+	}
+
+	if rebuilt > 0 {
+		sort.Strings(exercises)
+		if _, err := updatePRs(user, first, last, exercises); err != nil {
+			return rebuilt, kept, err
+		}
+	}
+
+	return rebuilt, kept, nil
+}
+
+// unrecorded reports whether doc holds a set, activity or weigh-in that the
+// day never held as its events were applied, as when the event of a write
+// could not be stored. Rebuilding the day would lose it.
+func unrecorded(doc *Document, events []Event) bool {
+	if doc == nil {
+		return false
+	}
+
+	var states []*Document
+	var state *Document
+	for i := range events {
+		state = events[i].apply(state)
+		if state != nil {
+			states = append(states, state)
+		}
+	}
+
+	for exName, sets := range doc.Exercises {
+	next:
+		for _, set := range sets {
+			for _, state := range states {
+				for _, other := range state.Exercises[exName] {
+					if sameSet(set, other) {
+						continue next
+					}
+				}
+			}
+			return true
+		}
+	}
+
+activities:
+	for _, activity := range doc.Activities {
+		for _, state := range states {
+			for _, other := range state.Activities {
+				if sameActivity(activity, other) {
+					continue activities
+				}
+			}
+		}
+		return true
+	}
+
+	if doc.Bodyweight != nil {
+		for _, state := range states {
+			if sameWeighin(doc.Bodyweight, state.Bodyweight) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// sameDocument reports whether two days hold the same sets, activities and
+// weigh-in.
+func sameDocument(a, b *Document) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	if !sameWeighin(a.Bodyweight, b.Bodyweight) {
+		return false
+	}
+
+	if len(a.Exercises) != len(b.Exercises) || len(a.Activities) != len(b.Activities) {
+		return false
+	}
+
+	for i := range a.Activities {
+		if !sameActivity(a.Activities[i], b.Activities[i]) {
+			return false
+		}
+	}
+
+	for exName, sets := range a.Exercises {
+		other, ok := b.Exercises[exName]
+		if !ok || len(other) != len(sets) {
+			return false
+		}
+		for i := range sets {
+			if !sameSet(sets[i], other[i]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// sameSet reports whether two sets are the same, at the same instant.
+func sameSet(x, y Set) bool {
+	if !x.Timestamp.Equal(y.Timestamp) {
+		return false
+	}
+	x.Timestamp, y.Timestamp = time.Time{}, time.Time{}
+
+	return x == y
+}
+
+// sameActivity reports whether two activities are the same, at the same
+// instant.
+func sameActivity(x, y Activity) bool {
+	if !x.Timestamp.Equal(y.Timestamp) {
+		return false
+	}
+	x.Timestamp, y.Timestamp = time.Time{}, time.Time{}
+
+	return reflect.DeepEqual(x, y)
+}
+
+// getHistory serves GET /v1/workouts/{date}/history.
+func getHistory(w http.ResponseWriter, r *http.Request, date string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	history, err := History(requestUser(r), date)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.history(history))
+}
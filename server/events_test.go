@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingEvents is a store whose event records cannot be written.
+type failingEvents struct {
+	WorkoutStore
+}
+
+var errEvents = errors.New("events unavailable")
+
+func (s failingEvents) User(id string) WorkoutStore {
+	return failingEvents{s.WorkoutStore.User(id)}
+}
+
+func (s failingEvents) UpdateMeta(key string, v interface{}, fn func() error) error {
+	if strings.HasPrefix(key, eventsPrefix) {
+		return errEvents
+	}
+	return s.WorkoutStore.UpdateMeta(key, v, fn)
+}
+
+func TestLogWithoutEvent(t *testing.T) {
+	useMemoryStore(t)
+
+	logSets(t, "al", "a", "2026-01-05", "squat", Set{Weight: 100, Reps: 5})
+
+	healthy := store
+	store = failingEvents{healthy}
+	_, err := Log("al", "a", &Document{
+		Date:      "2026-01-05",
+		Exercises: map[string][]Set{"squat": {{Weight: 110, Reps: 5}}},
+	}, time.UTC)
+	store = healthy
+
+	if err != errEvents {
+		t.Fatalf("Log error = %v, want %v", err, errEvents)
+	}
+
+	// The write is rolled back, so the day still matches its events.
+	if got := setCounts(t, "al", "2026-01-05"); got["2026-01-05"] != 1 {
+		t.Errorf("sets by day = %v, want 1 on 2026-01-05", got)
+	}
+	history, err := History("al", "2026-01-05")
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(history.Events) != 1 {
+		t.Errorf("%d events, want 1", len(history.Events))
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	const (
+		mon = "2026-01-05"
+		tue = "2026-01-06"
+	)
+
+	useMemoryStore(t)
+
+	logSets(t, "al", "a", mon, "squat", Set{Weight: 100, Reps: 5})
+	logSets(t, "al", "a", tue, "squat", Set{Weight: 100, Reps: 5})
+
+	s := storeFor("al")
+
+	// Monday loses a set its events have; Tuesday gains one they do not.
+	if err := s.Delete(mon); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Merge(tue, testDay(tue, "back_squat", 3)); err != nil {
+		t.Fatalf("Merge: %v", err)
+	}
+
+	rebuilt, kept, err := Rebuild("al", mon, tue)
+	if err != nil {
+		t.Fatalf("Rebuild: %v", err)
+	}
+	if rebuilt != 1 {
+		t.Errorf("rebuilt %d days, want 1", rebuilt)
+	}
+	if len(kept) != 1 || kept[0] != tue {
+		t.Errorf("kept %v, want [%s]", kept, tue)
+	}
+
+	if got := setCounts(t, "al", mon, tue); got[mon] != 1 || got[tue] != 2 {
+		t.Errorf("sets by day = %v, want 1 on %s and 2 on %s", got, mon, tue)
+	}
+}
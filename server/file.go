@@ -0,0 +1,424 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileStore keeps each day document as a JSON file in a directory, and
+// auxiliary records in its meta subdirectory, or its expiring subdirectory
+// when they have a TTL. Each user's view of the store lives under users/<id>.
+// Updates also hold the lock file at the root of the store, so processes
+// sharing the directory do not interleave them.
+type FileStore struct {
+	mu       *sync.Mutex
+	dir      string
+	lockPath string
+	// swept holds when each view's expiring records were last swept. It is
+	// shared by every view and guarded by mu.
+	swept map[string]time.Time
+}
+
+// expiringRecord is an auxiliary record written with a TTL.
+type expiringRecord struct {
+	Expires time.Time       `json:"expires"`
+	Value   json.RawMessage `json:"value"`
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "meta"), 0755); err != nil {
+		return nil, errors.Wrap(err, "os.MkdirAll")
+	}
+
+	return &FileStore{
+		mu:       &sync.Mutex{},
+		dir:      dir,
+		lockPath: filepath.Join(dir, ".lock"),
+		swept:    map[string]time.Time{},
+	}, nil
+}
+
+// User implements WorkoutStore.
+func (s *FileStore) User(id string) WorkoutStore {
+	return &FileStore{
+		mu:       s.mu,
+		dir:      filepath.Join(s.dir, "users", id),
+		lockPath: s.lockPath,
+		swept:    s.swept,
+	}
+}
+
+func (s *FileStore) path(date string) string {
+	return filepath.Join(s.dir, date+".json")
+}
+
+func (s *FileStore) metaPath(key string) string {
+	return filepath.Join(s.dir, "meta", url.PathEscape(key)+".json")
+}
+
+func (s *FileStore) expiringPath(key string) string {
+	return filepath.Join(s.dir, "expiring", url.PathEscape(key)+".json")
+}
+
+func (s *FileStore) read(date string) (*Document, error) {
+	contents, err := ioutil.ReadFile(s.path(date))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "ioutil.ReadFile")
+	}
+
+	doc := Document{}
+	if err := json.Unmarshal(contents, &doc); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+	doc.upgradeUnits()
+
+	return &doc, nil
+}
+
+func (s *FileStore) write(date string, doc *Document) error {
+	return writeJSONFile(s.path(date), doc)
+}
+
+// writeJSONFile saves v through a temporary file so a crash never leaves a
+// half-written record behind.
+func writeJSONFile(path string, v interface{}) error {
+	contents, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "json.MarshalIndent")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "os.MkdirAll")
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, contents, 0644); err != nil {
+		return errors.Wrap(err, "ioutil.WriteFile")
+	}
+
+	return errors.Wrap(os.Rename(tmp, path), "os.Rename")
+}
+
+// Get implements WorkoutStore.
+func (s *FileStore) Get(date string) (*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read(date)
+}
+
+// Upsert implements WorkoutStore.
+func (s *FileStore) Upsert(date string, doc *Document) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.write(date, doc)
+}
+
+// Merge implements WorkoutStore.
+func (s *FileStore) Merge(date string, doc *Document) (*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.lockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	thing, err := s.read(date)
+	if err == ErrNotFound {
+		thing = newDocument(date, doc)
+	} else if err != nil {
+		return nil, err
+	}
+
+	mergeExercises(thing, doc)
+
+	return thing, s.write(date, thing)
+}
+
+// Update implements WorkoutStore. The store is locked for the whole update,
+// so fn is only called once.
+func (s *FileStore) Update(date string, fn func(doc *Document) (*Document, error)) (*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.lockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	current, err := s.read(date)
+	if err == ErrNotFound {
+		current = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	doc, err := fn(current)
+	if err != nil {
+		return doc, err
+	}
+
+	if doc == nil {
+		err = os.Remove(s.path(date))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "os.Remove")
+	}
+
+	return doc, s.write(date, doc)
+}
+
+// Range implements WorkoutStore.
+func (s *FileStore) Range(from, to string) ([]*Document, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []*Document{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "ioutil.ReadDir")
+	}
+
+	var dates []string
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		date := strings.TrimSuffix(file.Name(), ".json")
+		if date >= from && date <= to {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+
+	docs := make([]*Document, 0, len(dates))
+	for _, date := range dates {
+		doc, err := s.read(date)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+
+	return docs, nil
+}
+
+// Delete implements WorkoutStore.
+func (s *FileStore) Delete(date string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.Remove(s.path(date))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	return errors.Wrap(err, "os.Remove")
+}
+
+// GetMeta implements WorkoutStore.
+func (s *FileStore) GetMeta(key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	contents, err := s.readMeta(key)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(json.Unmarshal(contents, v), "json.Unmarshal")
+}
+
+// readMeta returns the encoded record under key, whether or not it expires.
+// The caller must hold mu.
+func (s *FileStore) readMeta(key string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(s.metaPath(key))
+	if os.IsNotExist(err) {
+		record, err := s.readExpiring(s.expiringPath(key), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return record.Value, nil
+	}
+
+	return contents, errors.Wrap(err, "ioutil.ReadFile")
+}
+
+// UpdateMeta implements WorkoutStore. The store is locked for the whole
+// update, so fn is only called once.
+func (s *FileStore) UpdateMeta(key string, v interface{}, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.lockPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	resetValue(v)
+	contents, err := s.readMeta(key)
+	if err == nil {
+		if err := json.Unmarshal(contents, v); err != nil {
+			return errors.Wrap(err, "json.Unmarshal")
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	return s.putMeta(key, v)
+}
+
+// PutMeta implements WorkoutStore.
+func (s *FileStore) PutMeta(key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.putMeta(key, v)
+}
+
+// putMeta stores v under key as a record that does not expire. The caller
+// must hold mu.
+func (s *FileStore) putMeta(key string, v interface{}) error {
+	if err := writeJSONFile(s.metaPath(key), v); err != nil {
+		return err
+	}
+
+	err := os.Remove(s.expiringPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Wrap(err, "os.Remove")
+}
+
+// PutMetaExpiring implements WorkoutStore.
+func (s *FileStore) PutMetaExpiring(key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if err := s.sweep(now); err != nil {
+		return err
+	}
+
+	if err := writeJSONFile(s.expiringPath(key), &expiringRecord{Expires: now.Add(ttl).UTC(), Value: value}); err != nil {
+		return err
+	}
+
+	err = os.Remove(s.metaPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Wrap(err, "os.Remove")
+}
+
+// DeleteMeta implements WorkoutStore.
+func (s *FileStore) DeleteMeta(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	for _, path := range []string{s.metaPath(key), s.expiringPath(key)} {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "os.Remove")
+		}
+		found = true
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// readExpiring reads the expiring record at path, removing it and returning
+// ErrNotFound once it has lapsed. The caller must hold mu.
+func (s *FileStore) readExpiring(path string, now time.Time) (*expiringRecord, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "ioutil.ReadFile")
+	}
+
+	record := &expiringRecord{}
+	if err := json.Unmarshal(contents, record); err != nil {
+		return nil, errors.Wrap(err, "json.Unmarshal")
+	}
+
+	if !now.Before(record.Expires) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "os.Remove")
+		}
+		return nil, ErrNotFound
+	}
+
+	return record, nil
+}
+
+// sweep removes the view's lapsed records, at most once per
+// expirySweepInterval. The caller must hold mu.
+func (s *FileStore) sweep(now time.Time) error {
+	if now.Sub(s.swept[s.dir]) < expirySweepInterval {
+		return nil
+	}
+	s.swept[s.dir] = now
+
+	dir := filepath.Join(s.dir, "expiring")
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "ioutil.ReadDir")
+	}
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		if _, err := s.readExpiring(filepath.Join(dir, file.Name()), now); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close implements WorkoutStore.
+func (s *FileStore) Close() error {
+	return nil
+}
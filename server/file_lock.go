@@ -0,0 +1,28 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it when
+// needed, and returns the func releasing it. Other processes taking the same
+// lock wait for it.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "os.OpenFile")
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "syscall.Flock")
+	}
+
+	// Closing the file releases the lock.
+	return func() { f.Close() }, nil
+}
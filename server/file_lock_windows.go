@@ -0,0 +1,7 @@
+package server
+
+// lockFile does nothing on Windows, where processes sharing a file store are
+// not kept from interleaving their updates.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	replayedHeader    = "Idempotent-Replayed"
+
+	// idempotencyPrefix keys stored responses in the user's view of the
+	// store.
+	idempotencyPrefix = "idempotency:"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// storedResponse is the first response to a request with an idempotency key.
+type storedResponse struct {
+	// Fingerprint identifies the request the key was first used with, so a
+	// key reused for a different request is refused instead of replayed.
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body"`
+	Created     time.Time `json:"created"`
+}
+
+// idempotencyCalls tracks the requests being handled per key so a retry
+// racing the original waits for its response instead of applying it again.
+var idempotencyCalls = struct {
+	sync.Mutex
+	inflight map[string]chan struct{}
+}{
+	inflight: map[string]chan struct{}{},
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// withIdempotency honors the Idempotency-Key header on writes: the first
+// response for a key is kept for the configured TTL and later requests with
+// the key get it again without the write being applied twice. Responses
+// marked Cache-Control: no-store, such as issued tokens, are never kept. It
+// must run after authentication since keys are scoped to the user.
+func withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		user := requestUser(r)
+		sum := sha256.Sum256([]byte(key))
+		record := idempotencyPrefix + hex.EncodeToString(sum[:])
+		callKey := user + "|" + record
+		fingerprint := requestFingerprint(r, body)
+
+		for {
+			stored, err := loadResponse(user, record)
+			if err != nil {
+				writeStoreError(w, r, err)
+				return
+			}
+
+			if stored != nil {
+				if stored.Fingerprint != fingerprint {
+					writeError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used for a different request")
+					return
+				}
+
+				replay(w, stored)
+				return
+			}
+
+			idempotencyCalls.Lock()
+			wait, busy := idempotencyCalls.inflight[callKey]
+			if !busy {
+				idempotencyCalls.inflight[callKey] = make(chan struct{})
+			}
+			idempotencyCalls.Unlock()
+
+			if !busy {
+				break
+			}
+
+			// The original is still running; its response is stored when
+			// it finishes. Should it not be kept, this request runs instead.
+			select {
+			case <-wait:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		defer func() {
+			idempotencyCalls.Lock()
+			close(idempotencyCalls.inflight[callKey])
+			delete(idempotencyCalls.inflight, callKey)
+			idempotencyCalls.Unlock()
+		}()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// Failures that a retry could get past are not kept, and neither are
+		// credentials.
+		if rec.status == 0 || rec.status >= 500 || rec.status == http.StatusConflict || noStore(rec.Header()) {
+			return
+		}
+
+		err = storeFor(user).PutMetaExpiring(record, &storedResponse{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			ContentType: rec.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+			Created:     time.Now().UTC(),
+		}, loadSettings().cfg.IdempotencyTTL)
+		if err != nil {
+			logger.Error("could not store idempotent response", zap.String("request_id", requestID(r)), zap.Error(err))
+		}
+	})
+}
+
+// loadResponse returns the user's stored response, or nil when there is none
+// or it has outlived the TTL. The store expires records on its own; the TTL
+// is checked again here in case it was shortened by a reload since.
+func loadResponse(user, record string) (*storedResponse, error) {
+	stored := &storedResponse{}
+
+	err := storeFor(user).GetMeta(record, stored)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Since(stored.Created) > loadSettings().cfg.IdempotencyTTL {
+		if err := storeFor(user).DeleteMeta(record); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	return stored, nil
+}
+
+// noStore reports whether the response must not be kept.
+func noStore(h http.Header) bool {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+			return true
+		}
+	}
+	return false
+}
+
+// requestFingerprint hashes what makes two writes the same request.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replay(w http.ResponseWriter, stored *storedResponse) {
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set(replayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
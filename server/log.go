@@ -0,0 +1,311 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// InputError is returned when a workout cannot be accepted as submitted.
+type InputError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+}
+
+func (e *InputError) Error() string {
+	return e.Message
+}
+
+// Use sets the configuration and store shared by the HTTP server and the
+// package level operations such as Log and Import, and pins the unit of
+// weights stored without one in s. cfg must be valid.
+func Use(cfg Config, s WorkoutStore) error {
+	store = s
+	e1rms = newE1RMCache()
+	apply(cfg)
+
+	return pinLegacyUnit(cfg)
+}
+
+// Log validates doc, files it under its day in loc and merges it into the
+// user's store, logging the write under session so it can be undone. Exercise
+// names are normalized against the user's catalog first, weights without a
+// unit are read in the user's unit, and activities imported from a file that
+// is already logged, on any day, are left out; when nothing is left the
+// response is the day holding them. Invalid input is reported as an
+// *InputError. The response is in kilograms, as stored.
+func Log(user, session string, doc *Document, loc *time.Location) (*WriteResponse, error) {
+	unknown, err := normalizeExercises(user, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if fields := doc.validate(); len(fields) > 0 {
+		return nil, &InputError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_workout",
+			Message: "the workout has invalid fields",
+			Fields:  fields,
+		}
+	}
+
+	unit, err := inputUnit(user)
+	if err != nil {
+		return nil, err
+	}
+	doc.canonicalize(unit)
+
+	now := time.Now()
+
+	date, err := resolveDate(doc.Date, loc, now)
+	if err != nil {
+		return nil, &InputError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_date",
+			Message: err.Error(),
+			Fields: []FieldError{{
+				Field:   "date",
+				Message: err.Error(),
+			}},
+		}
+	}
+
+	doc.Date = date
+	doc.InsertionDate = now.In(loc).Format(dateLayout)
+	doc.stamp(now)
+	if doc.Bodyweight != nil {
+		doc.Bodyweight.Date = date
+	}
+
+	defer lockUser(user)()
+
+	s := storeFor(user)
+
+	before, err := snapshot(s, doc.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	held, duplicates, err := unimported(s, doc, before.Doc)
+	if err != nil {
+		return nil, err
+	}
+	if duplicates > 0 && doc.empty() {
+		return &WriteResponse{
+			Document:            held,
+			PRs:                 []PR{},
+			DuplicateActivities: duplicates,
+		}, nil
+	}
+
+	found, thing, err := mergeDay(s, doc)
+	if err != nil {
+		return nil, err
+	}
+	e1rms.invalidate(user, doc.Date)
+	before.Doc = found
+
+	err = recordWrite(user, found, thing, Event{
+		Source: session,
+		Action: "log",
+		Type:   EventMerge,
+		Date:   doc.Date,
+		Doc:    doc,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := indexSources(s, doc.Date, doc.Activities); err != nil {
+		logger.Error("could not index activity sources", zap.String("user", user), zap.String("date", doc.Date), zap.Error(err))
+	}
+
+	if doc.Bodyweight != nil {
+		if err := syncBodyweight(user, doc.Date, thing); err != nil {
+			logger.Error("could not update bodyweight", zap.String("user", user), zap.String("date", doc.Date), zap.Error(err))
+		}
+	}
+
+	if err := recordOp(user, session, "log", []Snapshot{before}); err != nil {
+		logger.Error("could not record operation", zap.String("user", user), zap.String("date", doc.Date), zap.Error(err))
+	}
+
+	prs, err := updatePRs(user, doc.Date, doc.Date, exerciseNames(doc))
+	if err != nil {
+		// The sets are already stored; only the PR events are behind.
+		logger.Error("could not update PRs", zap.String("user", user), zap.String("date", doc.Date), zap.Error(err))
+	}
+
+	return &WriteResponse{
+		Document:            thing,
+		PRs:                 prs,
+		UnknownExercises:    unknown,
+		DuplicateActivities: duplicates,
+	}, nil
+}
+
+// Import stores whole day documents for the user, replacing the stored day or,
+// with merge, adding to it. Exercise names and weights are normalized as by
+// Log, and PRs are recomputed from the earliest imported day. The import is logged under
+// session as a single operation.
+func Import(user, session string, docs []*Document, merge bool) error {
+	if len(docs) == 0 {
+		return nil
+	}
+
+	unit, err := inputUnit(user)
+	if err != nil {
+		return err
+	}
+
+	s := storeFor(user)
+	first, last := "", ""
+	seen := map[string]bool{}
+	var exercises []string
+
+	var weighed weighedSpan
+
+	for _, doc := range docs {
+		if _, err := time.Parse(dateLayout, doc.Date); err != nil {
+			return &InputError{
+				Status:  http.StatusBadRequest,
+				Code:    "invalid_date",
+				Message: "invalid date " + doc.Date + ": expected YYYY-MM-DD",
+			}
+		}
+		if _, err := normalizeExercises(user, doc); err != nil {
+			return err
+		}
+		if fields := doc.validate(); len(fields) > 0 {
+			return &InputError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    "invalid_workout",
+				Message: "the workout for " + doc.Date + " has invalid fields",
+				Fields:  fields,
+			}
+		}
+		doc.canonicalize(unit)
+		if doc.Bodyweight != nil {
+			doc.Bodyweight.Date = doc.Date
+		}
+	}
+
+	defer lockUser(user)()
+
+	var before []Snapshot
+	for _, doc := range docs {
+		snap, err := snapshot(s, doc.Date)
+		if err != nil {
+			return err
+		}
+		before = append(before, snap)
+	}
+
+	for i, doc := range docs {
+		if doc.InsertionDate == "" {
+			doc.InsertionDate = doc.Date
+		}
+		doc.Version = SchemaVersion
+
+		names := exerciseNames(doc)
+
+		ev := Event{
+			Source: session,
+			Action: "import",
+			Type:   EventReplace,
+			Date:   doc.Date,
+			Doc:    doc,
+		}
+		if merge {
+			ev.Type = EventMerge
+		}
+
+		var found, stored *Document
+		if merge {
+			found, stored, err = mergeDay(s, doc)
+		} else {
+			stored, err = s.Update(doc.Date, func(old *Document) (*Document, error) {
+				found = old
+				return doc, nil
+			})
+
+			// Exercises dropped by the replacement need their PRs revisited too.
+			if found != nil {
+				names = append(names, exerciseNames(found)...)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		e1rms.invalidate(user, doc.Date)
+		before[i].Doc = found
+
+		if err := recordWrite(user, found, stored, ev); err != nil {
+			return err
+		}
+
+		if err := indexWeighin(user, doc.Date, stored, &weighed); err != nil {
+			return err
+		}
+		if err := indexSources(s, doc.Date, doc.Activities); err != nil {
+			return err
+		}
+
+		if first == "" || doc.Date < first {
+			first = doc.Date
+		}
+		if doc.Date > last {
+			last = doc.Date
+		}
+		for _, exName := range names {
+			if !seen[exName] {
+				seen[exName] = true
+				exercises = append(exercises, exName)
+			}
+		}
+	}
+	sort.Strings(exercises)
+
+	if err := recordOp(user, session, "import", before); err != nil {
+		logger.Error("could not record operation", zap.String("user", user), zap.Error(err))
+	}
+
+	if err := weighed.refresh(user); err != nil {
+		return err
+	}
+
+	_, err = updatePRs(user, first, last, exercises)
+	return err
+}
+
+// mergeDay merges doc into its stored day, returning the day as the merge
+// found it, nil when there was none, and as it left it.
+func mergeDay(s WorkoutStore, doc *Document) (found, merged *Document, err error) {
+	merged, err = s.Update(doc.Date, func(stored *Document) (*Document, error) {
+		found = nil
+		if stored == nil {
+			stored = newDocument(doc.Date, doc)
+		} else {
+			found = copyDocument(stored)
+		}
+		mergeExercises(stored, doc)
+
+		return stored, nil
+	})
+
+	return found, merged, err
+}
+
+// writeLogError maps an error returned by Log or Import onto a response.
+func writeLogError(w http.ResponseWriter, r *http.Request, err error) {
+	if ie, ok := err.(*InputError); ok {
+		writeError(w, r, ie.Status, ie.Code, ie.Message, ie.Fields...)
+		return
+	}
+
+	writeStoreError(w, r, err)
+}
@@ -0,0 +1,616 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// mailSession is the session writes made by email are logged under.
+	mailSession = "email"
+	// mailSeenPrefix keys the record of an ingested message in the user's
+	// view of the store, so redelivered messages are not logged twice.
+	mailSeenPrefix = "mail:"
+	// maxMailSize bounds a message read from SMTP or a maildir.
+	maxMailSize = 1 << 20
+)
+
+var (
+	htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|tr|h[1-6])>`)
+	htmlHidden = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlTags   = regexp.MustCompile(`<[^>]*>`)
+	hasDigit   = regexp.MustCompile(`[0-9]`)
+)
+
+// IngestResult is what Ingest made of a message.
+type IngestResult struct {
+	MessageID string `json:"message_id,omitempty"`
+	// From is the sender the message claims. It is only replied to when it
+	// is one of the user's linked addresses.
+	From    string `json:"from"`
+	Subject string `json:"subject,omitempty"`
+	User    string `json:"user"`
+	// Date is the day the sets were logged on. It is empty when the message
+	// held no sets.
+	Date      string           `json:"date,omitempty"`
+	Exercises map[string][]Set `json:"exercises"`
+	PRs       []PR             `json:"prs,omitempty"`
+	// UnknownExercises are the names that are not in the catalog.
+	UnknownExercises []UnknownExercise `json:"unknown_exercises,omitempty"`
+	// Skipped are the lines that looked like sets but did not parse.
+	Skipped []SkippedLine `json:"skipped,omitempty"`
+	// Duplicate marks a message that was ingested before. Nothing is
+	// stored for it again.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// SkippedLine is a line of a message body that could not be parsed.
+type SkippedLine struct {
+	Line  int    `json:"line"`
+	Text  string `json:"text"`
+	Error string `json:"error"`
+}
+
+// mailSeen is the record of an ingested message.
+type mailSeen struct {
+	Date string    `json:"date,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// Ingest reads an RFC 822 message, finds the account whose mail address it
+// was sent to and logs the set lines of its body, parsed with
+// ParseShorthand, on the day the message was sent. recipients are the
+// envelope recipients; without them the Delivered-To, X-Original-To, To and
+// Cc headers are read. The sender is not trusted to say whose workout it
+// is. The plain text part of the body is preferred over the HTML one.
+// Messages that cannot be read or are not sent to a user's address are
+// reported as an *InputError.
+func Ingest(r io.Reader, recipients []string) (*IngestResult, error) {
+	msg, err := mail.ReadMessage(io.LimitReader(r, maxMailSize))
+	if err != nil {
+		return nil, invalidMessage("could not read message: " + err.Error())
+	}
+
+	result := &IngestResult{
+		MessageID: strings.TrimSpace(msg.Header.Get("Message-Id")),
+		Subject:   decodeHeader(msg.Header.Get("Subject")),
+		Exercises: map[string][]Set{},
+	}
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		result.From = strings.ToLower(from.Address)
+	}
+
+	if len(recipients) == 0 {
+		for _, header := range []string{"Delivered-To", "X-Original-To", "To", "Cc"} {
+			for _, value := range msg.Header[header] {
+				addrs, err := mail.ParseAddressList(value)
+				if err != nil {
+					continue
+				}
+				for _, addr := range addrs {
+					recipients = append(recipients, addr.Address)
+				}
+			}
+		}
+	}
+
+	result.User, err = userByRecipient(recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	s := storeFor(result.User)
+
+	seenKey := ""
+	if result.MessageID != "" {
+		sum := sha256.Sum256([]byte(result.MessageID))
+		seenKey = mailSeenPrefix + hex.EncodeToString(sum[:])
+
+		seen := mailSeen{}
+		if err := s.GetMeta(seenKey, &seen); err == nil {
+			result.Date = seen.Date
+			result.Duplicate = true
+			return result, nil
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+	}
+
+	text, err := messageText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, invalidMessage("could not read message body: " + err.Error())
+	}
+
+	result.Exercises, result.Skipped = extractSets(text)
+
+	if len(result.Exercises) > 0 {
+		units, err := UnitsFor(result.User, "")
+		if err != nil {
+			return nil, err
+		}
+
+		loc := defaultLocation()
+
+		doc := &Document{
+			Date:      messageDate(msg.Header.Get("Date"), loc),
+			Exercises: result.Exercises,
+		}
+
+		resp, err := Log(result.User, mailSession, doc, loc)
+		if err != nil {
+			return nil, err
+		}
+
+		// Log renamed the exercises to their catalog IDs and stored the
+		// weights in kilograms; the sender sees them in their own unit.
+		result.Exercises = units.Document(doc).Exercises
+		result.Date = resp.Document.Date
+		result.PRs = units.PRs(resp.PRs)
+		result.UnknownExercises = resp.UnknownExercises
+	}
+
+	if seenKey != "" {
+		err := s.PutMeta(seenKey, mailSeen{
+			Date: result.Date,
+			Time: time.Now().UTC(),
+		})
+		if err != nil {
+			logger.Error("could not record ingested message", zap.String("user", result.User), zap.String("message_id", result.MessageID), zap.Error(err))
+		}
+	}
+
+	return result, nil
+}
+
+// userByRecipient returns the user whose mail address is one of recipients.
+// An unknown address is an *InputError.
+func userByRecipient(recipients []string) (string, error) {
+	for _, rcpt := range recipients {
+		token := recipientToken(rcpt)
+		if token == "" {
+			continue
+		}
+
+		id, err := userByMailToken(token)
+		if err == nil {
+			return id, nil
+		}
+		if err != ErrNotFound {
+			return "", err
+		}
+	}
+
+	return "", &InputError{
+		Status:  http.StatusForbidden,
+		Code:    "unknown_recipient",
+		Message: "the message is not addressed to a user's workout address",
+	}
+}
+
+// recipientToken returns the token of a workout address such as
+// workout_server+<token>@example.com, or empty for other addresses.
+func recipientToken(address string) string {
+	address = strings.Trim(strings.TrimSpace(address), "<>")
+
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return ""
+	}
+
+	local := address[:at]
+	plus := strings.LastIndexByte(local, '+')
+	if plus < 0 {
+		return ""
+	}
+
+	return strings.ToLower(local[plus+1:])
+}
+
+func invalidMessage(message string) error {
+	return &InputError{
+		Status:  http.StatusBadRequest,
+		Code:    "invalid_message",
+		Message: message,
+	}
+}
+
+// decodeHeader decodes RFC 2047 encoded words, keeping the raw value when it
+// cannot.
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+// messageDate returns the Date header as RFC 3339 for resolveDate, or empty
+// to log on the current day when there is none. Dates without a zone are
+// read in loc.
+func messageDate(raw string, loc *time.Location) string {
+	if raw == "" {
+		return ""
+	}
+
+	if t, err := mail.ParseDate(raw); err == nil {
+		return t.Format(time.RFC3339)
+	}
+
+	for _, layout := range []string{"Mon, _2 Jan 2006 15:04:05", "_2 Jan 2006 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, strings.TrimSpace(raw), loc); err == nil {
+			return t.Format(time.RFC3339)
+		}
+	}
+
+	return ""
+}
+
+// messageText returns the text of a message body: its first text/plain
+// part or, failing that, its first text/html part with the markup removed.
+func messageText(contentType, encoding string, body io.Reader) (string, error) {
+	plain, htm, err := messageParts(contentType, encoding, body)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.TrimSpace(plain) != "" {
+		return plain, nil
+	}
+
+	return htmlToText(htm), nil
+}
+
+// messageParts walks a possibly multipart body for its first plain and HTML
+// parts. Other parts, such as attachments, are ignored.
+func messageParts(contentType, encoding string, body io.Reader) (plain, htm string, err error) {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", "", err
+	}
+
+	body = decodeTransfer(encoding, body)
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return plain, htm, nil
+			}
+			if err != nil {
+				return "", "", err
+			}
+
+			// The multipart reader has already decoded quoted-printable
+			// parts and dropped their encoding header.
+			p, h, err := messageParts(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", "", err
+			}
+			if plain == "" {
+				plain = p
+			}
+			if htm == "" {
+				htm = h
+			}
+		}
+
+	case mediaType == "text/plain":
+		contents, err := ioutil.ReadAll(body)
+		return string(contents), "", err
+
+	case mediaType == "text/html":
+		contents, err := ioutil.ReadAll(body)
+		return "", string(contents), err
+	}
+
+	return "", "", nil
+}
+
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	case "base64":
+		// The decoder skips the line breaks base64 bodies are wrapped with.
+		return base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	return body
+}
+
+// htmlToText keeps the text of an HTML body, one line per paragraph, line
+// break or list item.
+func htmlToText(s string) string {
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = htmlBreaks.ReplaceAllString(s, "\n")
+	s = htmlTags.ReplaceAllString(s, "")
+
+	return html.UnescapeString(s)
+}
+
+// extractSets parses each line of a message body as shorthand. Reading
+// stops at a signature or quoted text. Lines that do not parse are skipped,
+// and reported when they hold a number and so were probably meant as sets.
+func extractSets(text string) (map[string][]Set, []SkippedLine) {
+	exercises := map[string][]Set{}
+	var skipped []SkippedLine
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "--" || strings.HasPrefix(line, ">") {
+			break
+		}
+		if line == "" {
+			continue
+		}
+
+		parsed, err := ParseShorthand(line)
+		if err != nil {
+			if hasDigit.MatchString(line) {
+				msg := err.Error()
+				if se, ok := err.(*ShorthandError); ok {
+					msg = fmt.Sprintf("column %d: %s", se.Column, se.Message)
+				}
+				skipped = append(skipped, SkippedLine{
+					Line:  i + 1,
+					Text:  line,
+					Error: msg,
+				})
+			}
+			continue
+		}
+
+		for exName, sets := range parsed {
+			exercises[exName] = append(exercises[exName], sets...)
+		}
+	}
+
+	return exercises, skipped
+}
+
+// Reply sends the sender of an ingested message a summary of what was
+// logged, through the configured relay or into the outbox maildir. Senders
+// that are not linked to the user, whose From header may be forged, are not
+// replied to. Without a relay or outbox it does nothing.
+func Reply(result *IngestResult) error {
+	cfg := loadSettings().cfg.Mail
+	if cfg.Relay == "" && cfg.Outbox == "" {
+		return nil
+	}
+
+	if result.From == "" {
+		return nil
+	}
+	owner, err := userByEmail(result.From)
+	if err == ErrNotFound || (err == nil && owner != result.User) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return sendMail(cfg, result.From, composeReply(cfg.From, result, time.Now()))
+}
+
+// sendMail sends msg to the address through the configured relay or into
+// the outbox maildir.
+func sendMail(cfg MailConfig, to string, msg []byte) error {
+	if cfg.Relay != "" {
+		return smtp.SendMail(cfg.Relay, nil, cfg.From, []string{to}, msg)
+	}
+
+	return deliverMaildir(cfg.Outbox, msg)
+}
+
+// sendVerification mails the code that links the address to its user.
+func sendVerification(email, code string) error {
+	cfg := loadSettings().cfg.Mail
+	if cfg.Relay == "" && cfg.Outbox == "" {
+		return &InputError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    "mail_unavailable",
+			Message: "mail.relay or mail.outbox must be set to verify addresses",
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", email)
+	b.WriteString("Subject: Confirm your address\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "Your code to receive workout summaries at this address is %s.\r\n", code)
+	b.WriteString("\r\nIf you did not ask for it, ignore this message.\r\n")
+
+	return sendMail(cfg, email, b.Bytes())
+}
+
+// composeReply writes the reply to an ingested message.
+func composeReply(from string, result *IngestResult, now time.Time) []byte {
+	subject := result.Subject
+	if subject == "" {
+		subject = "your workout"
+	}
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", result.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	if result.MessageID != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", result.MessageID)
+		fmt.Fprintf(&b, "References: %s\r\n", result.MessageID)
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(Summary(result), "\n", "\r\n", -1))
+
+	return b.Bytes()
+}
+
+// Summary describes an ingested message in plain text.
+func Summary(result *IngestResult) string {
+	var b bytes.Buffer
+
+	switch {
+	case result.Duplicate:
+		b.WriteString("This message was already logged")
+		if result.Date != "" {
+			fmt.Fprintf(&b, " on %s", result.Date)
+		}
+		b.WriteString(", so nothing was logged again.\n")
+
+	case len(result.Exercises) == 0:
+		b.WriteString("No sets were found in your message.\n")
+
+	default:
+		count := 0
+		for _, sets := range result.Exercises {
+			count += len(sets)
+		}
+		fmt.Fprintf(&b, "Logged %d sets on %s:\n\n", count, result.Date)
+
+		names := make([]string, 0, len(result.Exercises))
+		for exName := range result.Exercises {
+			names = append(names, exName)
+		}
+		sort.Strings(names)
+
+		for _, exName := range names {
+			sets := make([]string, 0, len(result.Exercises[exName]))
+			for _, set := range result.Exercises[exName] {
+				sets = append(sets, formatSet(set))
+			}
+			fmt.Fprintf(&b, "  %s: %s\n", exName, strings.Join(sets, ", "))
+		}
+	}
+
+	var prs []PR
+	for _, pr := range result.PRs {
+		if !pr.First {
+			prs = append(prs, pr)
+		}
+	}
+	if len(prs) > 0 {
+		b.WriteString("\nNew PRs:\n\n")
+		for _, pr := range prs {
+			unit := pr.Unit
+			if pr.Type == PRReps {
+				unit = ""
+			}
+			fmt.Fprintf(&b, "  %s %s %v%s (was %v%s)\n", pr.Exercise, pr.Type, pr.Value, unit, pr.Previous, unit)
+		}
+	}
+
+	if len(result.UnknownExercises) > 0 {
+		b.WriteString("\nThese exercises are not in the catalog:\n\n")
+		for _, u := range result.UnknownExercises {
+			fmt.Fprintf(&b, "  %s", u.Name)
+			if len(u.Suggestions) > 0 {
+				fmt.Fprintf(&b, " (did you mean %s?)", strings.Join(u.Suggestions, " or "))
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	if len(result.Skipped) > 0 {
+		b.WriteString("\nThese lines were not understood and were skipped:\n\n")
+		for _, line := range result.Skipped {
+			fmt.Fprintf(&b, "  line %d: %s\n    %s\n", line.Line, line.Text, line.Error)
+		}
+	}
+
+	return b.String()
+}
+
+// formatSet writes a set back as shorthand.
+func formatSet(set Set) string {
+	s := set.Load() + "x" + strconv.Itoa(set.Reps)
+	if set.RPE > 0 {
+		s += "@" + strconv.FormatFloat(set.RPE, 'f', -1, 64)
+	}
+
+	return s
+}
+
+// deliverMaildir writes msg into the maildir's new directory through its tmp
+// directory, creating the maildir if needed.
+func deliverMaildir(dir string, msg []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), id, strings.Replace(host, "/", "_", -1))
+
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, "new", name))
+}
+
+// ingestAndReply ingests a message and replies to it, logging the outcome.
+func ingestAndReply(r io.Reader, source string, recipients []string) error {
+	result, err := Ingest(r, recipients)
+	if err != nil {
+		logger.Info("message rejected", zap.String("source", source), zap.Error(err))
+		return err
+	}
+
+	logger.Info("message ingested",
+		zap.String("source", source),
+		zap.String("user", result.User),
+		zap.String("date", result.Date),
+		zap.Bool("duplicate", result.Duplicate),
+		zap.Int("skipped", len(result.Skipped)),
+	)
+
+	if err := Reply(result); err != nil {
+		logger.Error("could not send reply", zap.String("to", result.From), zap.Error(err))
+	}
+
+	return nil
+}
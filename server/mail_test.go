@@ -0,0 +1,238 @@
+package server
+
+import (
+	"net/smtp"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageText(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        string
+		want        string
+	}{
+		{
+			name: "no content type is plain text",
+			body: "bench 100x5",
+			want: "bench 100x5",
+		},
+		{
+			name:        "quoted-printable",
+			contentType: "text/plain; charset=utf-8",
+			encoding:    "quoted-printable",
+			body:        "bench 100x5=\r\n, 110x3",
+			want:        "bench 100x5, 110x3",
+		},
+		{
+			name:        "base64 wrapped over lines",
+			contentType: "text/plain",
+			encoding:    "base64",
+			body:        "YmVuY2gg\r\nMTAweDU=",
+			want:        "bench 100x5",
+		},
+		{
+			name:        "html without a plain part",
+			contentType: "text/html",
+			body:        "<style>p{}</style><p>bench 100x5</p><div>squat&nbsp;3x5@140</div>",
+			want:        "bench 100x5\nsquat 3x5@140\n",
+		},
+		{
+			name:        "plain part preferred over html",
+			contentType: `multipart/alternative; boundary="b"`,
+			body: "--b\r\nContent-Type: text/html\r\n\r\n<p>html 1x1</p>\r\n" +
+				"--b\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nbench 100x5=\r\n\r\n" +
+				"--b--\r\n",
+			want: "bench 100x5",
+		},
+		{
+			name:        "attachments are ignored",
+			contentType: `multipart/mixed; boundary="m"`,
+			body: "--m\r\nContent-Type: multipart/alternative; boundary=\"a\"\r\n\r\n" +
+				"--a\r\nContent-Type: text/html\r\n\r\n<p>bench 100x5</p>\r\n--a--\r\n" +
+				"--m\r\nContent-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\nJVBERi0=\r\n" +
+				"--m--\r\n",
+			want: "bench 100x5\n",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := messageText(tt.contentType, tt.encoding, strings.NewReader(tt.body))
+		if err != nil {
+			t.Errorf("%s: messageText: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: messageText = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtractSets(t *testing.T) {
+	text := "Hi,\n\nbench 100x5x2\nsquat 140x\nfelt good today\nbench 110x3\n\n-- \nrow 50x10\n"
+
+	exercises, skipped := extractSets(text)
+
+	want := map[string][]Set{
+		"bench": {
+			{Weight: 100, Reps: 5},
+			{Weight: 100, Reps: 5},
+			{Weight: 110, Reps: 3},
+		},
+	}
+	if !reflect.DeepEqual(exercises, want) {
+		t.Errorf("exercises = %+v, want %+v", exercises, want)
+	}
+
+	wantSkipped := []SkippedLine{{Line: 4, Text: "squat 140x", Error: `column 11: expected a whole number of reps or sets, got ""`}}
+	if !reflect.DeepEqual(skipped, wantSkipped) {
+		t.Errorf("skipped = %+v, want %+v", skipped, wantSkipped)
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"Mon, 5 Jan 2026 07:30:00 -0500", "2026-01-05T07:30:00-05:00"},
+		{"5 Jan 2026 23:10:00 +0000", "2026-01-05T23:10:00Z"},
+		{"Mon, 5 Jan 2026 07:30:00", "2026-01-05T07:30:00Z"},
+		{"yesterday", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := messageDate(tt.raw, time.UTC); got != tt.want {
+			t.Errorf("messageDate(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestRecipientToken(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"workout_server+ABC123@example.com", "abc123"},
+		{"<workout_server+abc123@example.com>", "abc123"},
+		{"first+last+abc@example.com", "abc"},
+		{"workout_server@example.com", ""},
+		{"not an address", ""},
+	}
+
+	for _, tt := range tests {
+		if got := recipientToken(tt.address); got != tt.want {
+			t.Errorf("recipientToken(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestSMTPReply(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "250 "},
+		{&InputError{Code: "unknown_recipient"}, "550 "},
+		{&InputError{Code: "invalid_message"}, "554 "},
+		{ErrConflict, "451 "},
+	}
+
+	for _, tt := range tests {
+		if got := smtpReply(tt.err); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("smtpReply(%v) = %q, want it to start with %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// mailUser creates a user and returns their workout address.
+func mailUser(t *testing.T, id string) string {
+	t.Helper()
+
+	if _, err := CreateUser(id, "", "password1"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	addr, err := MailAddress(id, false)
+	if err != nil {
+		t.Fatalf("MailAddress: %v", err)
+	}
+
+	return addr
+}
+
+func TestIngest(t *testing.T) {
+	useMemoryStore(t)
+	addr := mailUser(t, "al")
+
+	msg := "From: Al <al@example.com>\r\n" +
+		"To: " + addr + "\r\n" +
+		"Subject: =?utf-8?q?Leg_day?=\r\n" +
+		"Date: Mon, 5 Jan 2026 07:30:00 +0000\r\n" +
+		"Message-Id: <1@example.com>\r\n" +
+		"\r\n" +
+		"squat 3x5@140\r\nbench 100x\r\n"
+
+	result, err := Ingest(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	if result.User != "al" || result.Date != "2026-01-05" || result.Subject != "Leg day" || result.From != "al@example.com" {
+		t.Errorf("result = %+v", result)
+	}
+	if n := len(result.Exercises["back_squat"]); n != 3 {
+		t.Errorf("back_squat sets = %d, want 3", n)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Line != 2 {
+		t.Errorf("skipped = %+v, want line 2", result.Skipped)
+	}
+
+	again, err := Ingest(strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	if !again.Duplicate || again.Date != "2026-01-05" {
+		t.Errorf("second Ingest = %+v, want a duplicate on 2026-01-05", again)
+	}
+	if got := setCounts(t, "al", "2026-01-05"); got["2026-01-05"] != 3 {
+		t.Errorf("sets by day = %v, want 3 on 2026-01-05", got)
+	}
+
+	_, err = Ingest(strings.NewReader("To: someone@example.com\r\n\r\nbench 100x5\r\n"), nil)
+	if ie, ok := err.(*InputError); !ok || ie.Code != "unknown_recipient" {
+		t.Errorf("Ingest to an unknown address error = %v, want unknown_recipient", err)
+	}
+}
+
+func TestSMTPServer(t *testing.T) {
+	useMemoryStore(t)
+	addr := mailUser(t, "al")
+
+	srv, err := listenSMTP("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listenSMTP: %v", err)
+	}
+	defer srv.close()
+
+	msg := "From: al@example.com\r\n" +
+		"Date: Tue, 6 Jan 2026 18:00:00 +0000\r\n" +
+		"\r\n" +
+		"bench 100x5x2\r\n"
+
+	err = smtp.SendMail(srv.ln.Addr().String(), nil, "al@example.com", []string{addr}, []byte(msg))
+	if err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+	if got := setCounts(t, "al", "2026-01-06"); got["2026-01-06"] != 2 {
+		t.Errorf("sets by day = %v, want 2 on 2026-01-06", got)
+	}
+
+	err = smtp.SendMail(srv.ln.Addr().String(), nil, "al@example.com", []string{"someone@example.com"}, []byte(msg))
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("SendMail to an unknown address error = %v, want 550", err)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ScanMaildir ingests every message in the maildir's new directory and
+// moves it to cur marked as seen. Messages that failed only because the
+// store did are left in new for the next scan. It returns the number of
+// messages logged.
+func ScanMaildir(dir string) (int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return 0, errors.Wrap(err, "ioutil.ReadDir")
+	}
+
+	logged := 0
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, "new", file.Name())
+
+		f, err := os.Open(path)
+		if err != nil {
+			return logged, errors.Wrap(err, "os.Open")
+		}
+
+		err = ingestAndReply(f, "maildir:"+file.Name(), nil)
+		f.Close()
+
+		if _, ok := err.(*InputError); err != nil && !ok {
+			continue
+		}
+		if err == nil {
+			logged++
+		}
+
+		name := file.Name()
+		if i := strings.Index(name, ":2,"); i >= 0 {
+			name = name[:i]
+		}
+		if err := os.Rename(path, filepath.Join(dir, "cur", name+":2,S")); err != nil {
+			return logged, errors.Wrap(err, "os.Rename")
+		}
+	}
+
+	return logged, nil
+}
+
+// maildirWatcher scans a maildir on an interval until it is stopped.
+type maildirWatcher struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func watchMaildir(dir string, interval time.Duration) *maildirWatcher {
+	w := &maildirWatcher{
+		stop: make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		logger.Info("watching maildir", zap.String("dir", dir), zap.Duration("interval", interval))
+
+		for {
+			if _, err := ScanMaildir(dir); err != nil {
+				logger.Error("could not scan maildir", zap.String("dir", dir), zap.Error(err))
+			}
+
+			select {
+			case <-ticker.C:
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+// close stops the watcher and waits for a scan in progress to finish.
+func (w *maildirWatcher) close() {
+	close(w.stop)
+	w.wg.Wait()
+}
+
+// startMail starts the configured ways of receiving mail and returns a
+// function that stops them.
+func startMail(cfg MailConfig) (func(), error) {
+	var (
+		listener *smtpServer
+		watcher  *maildirWatcher
+	)
+
+	if cfg.Listen != "" {
+		var err error
+		listener, err = listenSMTP(cfg.Listen)
+		if err != nil {
+			return nil, errors.Wrap(err, "listenSMTP")
+		}
+	}
+
+	if cfg.Maildir != "" {
+		watcher = watchMaildir(cfg.Maildir, cfg.PollInterval)
+	}
+
+	return func() {
+		if listener != nil {
+			listener.close()
+		}
+		if watcher != nil {
+			watcher.close()
+		}
+	}, nil
+}
@@ -1,126 +1,184 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
-	gocb "github.com/couchbase/gocb"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
 var (
-	logger  *zap.Logger
-	err     error
-	cluster *gocb.Cluster
-	bucket  *gocb.Bucket
+	logger *zap.Logger
+	err    error
+	store  WorkoutStore
 )
 
-type Exercise struct {
-	Reps   int `json:"reps"`
-	Weight int `json:"weight"`
-}
-
-type Document struct {
-	InsertionDate string                    `json:"insertion_date"`
-	Date          string                    `json:"date"`
-	Exercises     map[string]map[string]int `json:"exercises"`
-}
-
 func init() {
-	logger, err = zap.NewDevelopment()
+	cfg := zap.NewDevelopmentConfig()
+	cfg.Level = logLevel
+
+	logger, err = cfg.Build()
 	if err != nil {
 		os.Exit(77)
 	}
 }
 
+// WriteResponse is the day document after a write, along with any personal
+// records the write set, the exercise names it used that are not in the
+// catalog and how many activities were left out as already imported.
+type WriteResponse struct {
+	*Document
+	PRs                 []PR              `json:"prs"`
+	UnknownExercises    []UnknownExercise `json:"unknown_exercises,omitempty"`
+	DuplicateActivities int               `json:"duplicate_activities,omitempty"`
+}
+
 func handler(w http.ResponseWriter, r *http.Request) {
+	// The mux sends every path without a route of its own here.
+	if r.URL.Path != "/" {
+		writeError(w, r, http.StatusNotFound, "not_found", "no such endpoint")
+		return
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		os.Exit(200)
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
 	}
 
-	fmt.Println(r.Method, string(body))
+	logger.Debug("workout received", zap.String("request_id", requestID(r)), zap.String("method", r.Method), zap.ByteString("body", body))
 
 	docuBody := Document{}
 
 	err = json.Unmarshal(body, &docuBody)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(2)
+		writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
 	}
 
-	fmt.Printf("%+v", docuBody)
-
-	docuBody.InsertionDate = strings.Split(time.Now().String(), " ")[0]
-
-	//bucket.Upsert(key, value, expiry)
-	thing := Document{}
-	_, err = bucket.Get(docuBody.InsertionDate, &thing)
+	loc, err := requestLocation(r)
 	if err != nil {
-		logger.Info("yo wtf mayne")
-		_, err = bucket.Upsert(docuBody.InsertionDate, docuBody, 0)
-		if err != nil {
-			logger.Info("yo wtf dawg")
-		}
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
 		return
 	}
-	fmt.Printf("%+v", thing)
-	for exName, exer := range docuBody.Exercises {
-		logger.Info(fmt.Sprintf("%+v", exer) + " " + exName)
-		if thing.Exercises[exName] == nil {
-			thing.Exercises[exName] = exer
-		} else {
-			for weight, reps := range exer {
-				if thing.Exercises[exName][weight] == 0 {
-					thing.Exercises[exName][weight] = reps
-				} else {
-					thing.Exercises[exName][weight] += reps
-				}
-			}
-		}
-	}
 
-	fmt.Printf("%+v\n", thing)
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
 
-	// right now just add that shit
-	_, err = bucket.Upsert(docuBody.InsertionDate, thing, 0)
+	resp, err := Log(requestUser(r), requestSession(r), &docuBody, loc)
 	if err != nil {
-		logger.Info("yo wtf bro")
+		writeLogError(w, r, err)
+		return
 	}
+
+	writeJSON(w, http.StatusOK, units.Response(resp))
 }
 
 func getLastTime(w http.ResponseWriter, r *http.Request) {
-	value := Document{}
-	_, err = bucket.Get(strings.Split(time.Now().AddDate(0, 0, -7).String(), " ")[0], &value)
+	loc, err := requestLocation(r)
 	if err != nil {
-		w.Write([]byte("Could not get last weeks data"))
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
 		return
 	}
-	valueString, err := json.Marshal(value)
-	if err != nil {
-		w.Write([]byte("Could not marshal last weeks data"))
-	}
-	w.Write([]byte(valueString))
-}
 
-func startHTTP() {
-	cluster, _ = gocb.Connect("couchbase://127.0.0.1")
-	bucket, _ = cluster.OpenBucket("workout", "")
+	writeDay(w, r, time.Now().In(loc).AddDate(0, 0, -7).Format(dateLayout))
+}
 
-	http.HandleFunc("/lastweek", getLastTime)
-	//http.HandleFunc("/today", getToday)
-	http.HandleFunc("/", handler)
-	http.ListenAndServe(":3000", nil)
+func routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lastweek", getLastTime)
+	mux.HandleFunc("/today", getToday)
+	mux.HandleFunc("/v1/workouts", workouts)
+	mux.HandleFunc("/v1/workouts/", workout)
+	mux.HandleFunc("/v1/compare", requireFeature("compare", compareWorkouts))
+	mux.HandleFunc("/v1/exercises", catalogExercises)
+	mux.HandleFunc("/v1/exercises/", exercises)
+	mux.HandleFunc("/v1/prs", requireFeature("prs", getPRs))
+	mux.HandleFunc("/v1/activities", activities)
+	mux.HandleFunc("/v1/activities/", activities)
+	mux.HandleFunc("/v1/bodyweight", bodyweight)
+	mux.HandleFunc("/v1/bodyweight/", bodyweight)
+	mux.HandleFunc("/v1/users", users)
+	mux.HandleFunc("/v1/users/me", me)
+	mux.HandleFunc("/v1/login", login)
+	mux.HandleFunc("/v1/undo", undo)
+	mux.HandleFunc("/v1/shorthand", shorthand)
+	mux.HandleFunc("/", handler)
+
+	return withRequestID(withCORS(withRateLimit(withAuth(withIdempotency(mux)))))
 }
 
-// Start yeah man
-func Start() error {
-	startHTTP()
+// startHTTP serves the API until it fails or the process is asked to stop,
+// in which case in-flight requests get cfg.ShutdownTimeout to finish.
+func startHTTP(cfg Config) error {
+	srv := &http.Server{
+		Addr:         cfg.Addr,
+		Handler:      routes(),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	logger.Info("listening", zap.String("addr", cfg.Addr))
+
+	select {
+	case err := <-errc:
+		return errors.Wrap(err, "srv.ListenAndServe")
+
+	case sig := <-sigs:
+		logger.Info("shutting down", zap.String("signal", sig.String()), zap.Duration("timeout", cfg.ShutdownTimeout))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		return errors.Wrap(err, "srv.Shutdown")
+	}
 
 	return nil
 }
+
+// Start serves the API with cfg, along with any configured ways of receiving
+// workouts by mail, until it fails or receives SIGINT or SIGTERM. The caller
+// still owns s and should close it afterwards.
+func Start(cfg Config, s WorkoutStore) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if err := Use(cfg, s); err != nil {
+		return errors.Wrap(err, "Use")
+	}
+
+	if err := loadTokenKey(cfg); err != nil {
+		return errors.Wrap(err, "loadTokenKey")
+	}
+
+	stopMail, err := startMail(cfg.Mail)
+	if err != nil {
+		return errors.Wrap(err, "startMail")
+	}
+	defer stopMail()
+
+	return startHTTP(cfg)
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"testing"
+)
+
+// useMemoryStore points the package at a new memory store with the default
+// settings, days in UTC and weights in kilograms.
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+
+	cfg := DefaultConfig()
+	cfg.Store = "memory"
+	cfg.Timezone = "UTC"
+	cfg.LogLevel = "error"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("cfg.Validate: %v", err)
+	}
+
+	if err := Use(cfg, NewMemoryStore()); err != nil {
+		t.Fatalf("Use: %v", err)
+	}
+}
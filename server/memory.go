@@ -0,0 +1,282 @@
+package server
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps day documents in memory. Nothing survives a restart.
+type MemoryStore struct {
+	db *memoryDB
+	// prefix scopes the keys of a user's view of the store.
+	prefix string
+}
+
+// memoryDB is the data shared by a MemoryStore and its user views.
+type memoryDB struct {
+	mu   sync.RWMutex
+	docs map[string]*Document
+	meta map[string][]byte
+	// expires holds when each expiring meta record lapses.
+	expires map[string]time.Time
+	swept   time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		db: &memoryDB{
+			docs:    map[string]*Document{},
+			meta:    map[string][]byte{},
+			expires: map[string]time.Time{},
+		},
+	}
+}
+
+// User implements WorkoutStore.
+func (s *MemoryStore) User(id string) WorkoutStore {
+	return &MemoryStore{
+		db:     s.db,
+		prefix: s.prefix + "user/" + id + "/",
+	}
+}
+
+// Get implements WorkoutStore.
+func (s *MemoryStore) Get(date string) (*Document, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	doc, ok := s.db.docs[s.prefix+date]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return copyDocument(doc), nil
+}
+
+// Upsert implements WorkoutStore.
+func (s *MemoryStore) Upsert(date string, doc *Document) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.docs[s.prefix+date] = copyDocument(doc)
+	return nil
+}
+
+// Merge implements WorkoutStore.
+func (s *MemoryStore) Merge(date string, doc *Document) (*Document, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	thing, ok := s.db.docs[s.prefix+date]
+	if !ok {
+		thing = newDocument(date, doc)
+		s.db.docs[s.prefix+date] = thing
+	}
+
+	mergeExercises(thing, doc)
+
+	return copyDocument(thing), nil
+}
+
+// Update implements WorkoutStore. The day is locked for the whole update, so
+// fn is only called once.
+func (s *MemoryStore) Update(date string, fn func(doc *Document) (*Document, error)) (*Document, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var current *Document
+	if stored, ok := s.db.docs[s.prefix+date]; ok {
+		current = copyDocument(stored)
+	}
+
+	doc, err := fn(current)
+	if err != nil {
+		return doc, err
+	}
+
+	if doc == nil {
+		delete(s.db.docs, s.prefix+date)
+	} else {
+		s.db.docs[s.prefix+date] = copyDocument(doc)
+	}
+
+	return doc, nil
+}
+
+// Range implements WorkoutStore.
+func (s *MemoryStore) Range(from, to string) ([]*Document, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	var dates []string
+	for key := range s.db.docs {
+		if !strings.HasPrefix(key, s.prefix) {
+			continue
+		}
+
+		// Keys of other users' views have a further prefix.
+		date := key[len(s.prefix):]
+		if date >= from && date <= to && !strings.Contains(date, "/") {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+
+	docs := make([]*Document, 0, len(dates))
+	for _, date := range dates {
+		docs = append(docs, copyDocument(s.db.docs[s.prefix+date]))
+	}
+
+	return docs, nil
+}
+
+// Delete implements WorkoutStore.
+func (s *MemoryStore) Delete(date string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.docs[s.prefix+date]; !ok {
+		return ErrNotFound
+	}
+	delete(s.db.docs, s.prefix+date)
+
+	return nil
+}
+
+// GetMeta implements WorkoutStore.
+func (s *MemoryStore) GetMeta(key string, v interface{}) error {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	contents, ok := s.db.meta[s.prefix+key]
+	if !ok || s.db.expired(s.prefix+key, time.Now()) {
+		return ErrNotFound
+	}
+
+	return json.Unmarshal(contents, v)
+}
+
+// PutMeta implements WorkoutStore. Records are kept encoded so callers never
+// share memory with the store.
+func (s *MemoryStore) PutMeta(key string, v interface{}) error {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.meta[s.prefix+key] = contents
+	delete(s.db.expires, s.prefix+key)
+	return nil
+}
+
+// UpdateMeta implements WorkoutStore. The store is locked for the whole
+// update, so fn is only called once.
+func (s *MemoryStore) UpdateMeta(key string, v interface{}, fn func() error) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	resetValue(v)
+	contents, ok := s.db.meta[s.prefix+key]
+	if ok && !s.db.expired(s.prefix+key, time.Now()) {
+		if err := json.Unmarshal(contents, v); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.db.meta[s.prefix+key] = contents
+	delete(s.db.expires, s.prefix+key)
+	return nil
+}
+
+// PutMetaExpiring implements WorkoutStore.
+func (s *MemoryStore) PutMetaExpiring(key string, v interface{}, ttl time.Duration) error {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	now := time.Now()
+	s.db.sweep(now)
+	s.db.meta[s.prefix+key] = contents
+	s.db.expires[s.prefix+key] = now.Add(ttl)
+	return nil
+}
+
+// DeleteMeta implements WorkoutStore.
+func (s *MemoryStore) DeleteMeta(key string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	_, ok := s.db.meta[s.prefix+key]
+	expired := s.db.expired(s.prefix+key, time.Now())
+	delete(s.db.meta, s.prefix+key)
+	delete(s.db.expires, s.prefix+key)
+
+	if !ok || expired {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// expired reports whether the meta record under key has lapsed. The caller
+// must hold mu.
+func (db *memoryDB) expired(key string, now time.Time) bool {
+	expires, ok := db.expires[key]
+	return ok && !now.Before(expires)
+}
+
+// sweep drops the lapsed meta records of every view, at most once per
+// expirySweepInterval. The caller must hold mu for writing.
+func (db *memoryDB) sweep(now time.Time) {
+	if now.Sub(db.swept) < expirySweepInterval {
+		return
+	}
+	db.swept = now
+
+	for key := range db.expires {
+		if db.expired(key, now) {
+			delete(db.meta, key)
+			delete(db.expires, key)
+		}
+	}
+}
+
+// Close implements WorkoutStore.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// copyDocument returns a deep copy of doc so callers cannot mutate stored state.
+func copyDocument(doc *Document) *Document {
+	cp := *doc
+	cp.Exercises = make(map[string][]Set, len(doc.Exercises))
+	for exName, sets := range doc.Exercises {
+		cp.Exercises[exName] = append([]Set(nil), sets...)
+	}
+	cp.Activities = append([]Activity(nil), doc.Activities...)
+	if doc.Bodyweight != nil {
+		w := *doc.Bodyweight
+		cp.Bodyweight = &w
+	}
+
+	return &cp
+}
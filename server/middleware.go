@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// knownFeatures are the optional endpoints that can be turned off in the
+// config.
+var knownFeatures = map[string]bool{
+	"compare": true,
+	"e1rm":    true,
+	"prs":     true,
+}
+
+// featureEnabled reports whether the feature is on in the current settings.
+func featureEnabled(name string) bool {
+	on, ok := loadSettings().cfg.Features[name]
+	return !ok || on
+}
+
+// requireFeature answers 404 while the feature is turned off.
+func requireFeature(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(name) {
+			writeError(w, r, http.StatusNotFound, "feature_disabled", name+" is turned off on this server")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// withCORS lets browsers on the configured origins call the API and answers
+// their preflight requests.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(origin) {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			h.Set("Access-Control-Expose-Headers", requestIDHeader+", "+replayedHeader)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+				h.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+apiKeyHeader+", "+idempotencyHeader+", "+requestIDHeader+", "+timezoneHeader)
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func originAllowed(origin string) bool {
+	for _, allowed := range loadSettings().cfg.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withRateLimit answers 429 to clients that exceed the configured rate.
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loadSettings().limiter.allow(clientIP(r), time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusTooManyRequests, "rate_limited", "too many requests, slow down")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// rateLimiter is a token bucket per client. A nil limiter allows everything.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate requests per second with
+// bursts of burst, or nil when rate is zero.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{
+			tokens: l.burst,
+			last:   now,
+		}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	// Forget idle clients so the map does not grow forever.
+	if len(l.buckets) > 10000 {
+		for c, other := range l.buckets {
+			if now.Sub(other.last) > time.Minute {
+				delete(l.buckets, c)
+			}
+		}
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
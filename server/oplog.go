@@ -0,0 +1,345 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// opLogKey is the meta record of a user's recent writes.
+	opLogKey = "oplog"
+	// maxOps is how many writes the log keeps per user; older ones can no
+	// longer be undone.
+	maxOps = 100
+	// maxUndo bounds a single undo request.
+	maxUndo = 20
+)
+
+// userLocks serializes each user's logged writes so the snapshot an operation
+// keeps is the day exactly as the write found it, while different users write
+// at the same time. A user's PR events are only written under their lock.
+var userLocks = struct {
+	sync.Mutex
+	held map[string]*userLock
+}{
+	held: map[string]*userLock{},
+}
+
+// userLock is a user's write lock and how many writes hold or wait for it.
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockUser takes the user's write lock and returns the func releasing it.
+func lockUser(user string) func() {
+	userLocks.Lock()
+	l := userLocks.held[user]
+	if l == nil {
+		l = &userLock{}
+		userLocks.held[user] = l
+	}
+	l.refs++
+	userLocks.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		userLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(userLocks.held, user)
+		}
+		userLocks.Unlock()
+	}
+}
+
+// Operation is one logged write: the days it touched as they were before it.
+type Operation struct {
+	ID      string     `json:"id"`
+	Kind    string     `json:"kind"`
+	Session string     `json:"session"`
+	Time    time.Time  `json:"time"`
+	Before  []Snapshot `json:"before"`
+}
+
+// Snapshot is a day as it was before an operation. Doc is nil when the day
+// had no document.
+type Snapshot struct {
+	Date string    `json:"date"`
+	Doc  *Document `json:"doc,omitempty"`
+}
+
+// UndoneOperation describes an operation that was reverted.
+type UndoneOperation struct {
+	ID    string    `json:"id"`
+	Kind  string    `json:"kind"`
+	Time  time.Time `json:"time"`
+	Dates []string  `json:"dates"`
+}
+
+// UndoResult is the outcome of an undo: the operations reverted, newest
+// first, and the days they touched as they are now.
+type UndoResult struct {
+	Undone   []UndoneOperation `json:"undone"`
+	Workouts []*Document       `json:"workouts"`
+}
+
+// snapshot reads the day for an operation's Before list.
+func snapshot(s WorkoutStore, date string) (Snapshot, error) {
+	doc, err := s.Get(date)
+	if err == ErrNotFound {
+		return Snapshot{Date: date}, nil
+	}
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return Snapshot{Date: date, Doc: doc}, nil
+}
+
+// recordOp appends an operation to the user's log, dropping the oldest
+// beyond maxOps. The user's lock must be held.
+func recordOp(user, session, kind string, before []Snapshot) error {
+	id, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+
+	op := Operation{
+		ID:      id,
+		Kind:    kind,
+		Session: session,
+		Time:    time.Now().UTC(),
+		Before:  before,
+	}
+
+	var ops []Operation
+	return storeFor(user).UpdateMeta(opLogKey, &ops, func() error {
+		ops = append(ops, op)
+		if len(ops) > maxOps {
+			ops = ops[len(ops)-maxOps:]
+		}
+		return nil
+	})
+}
+
+// Undo reverts the last count writes the session made, restoring each day
+// they touched. It refuses with ErrConflict when a later write from another
+// session touched one of those days, since restoring would discard it, and
+// when other writers keep changing a day while it is restored.
+func Undo(user, session string, count int) (*UndoResult, error) {
+	defer lockUser(user)()
+
+	s := storeFor(user)
+
+	var ops []Operation
+	if err := s.GetMeta(opLogKey, &ops); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	// Pick the session's last count operations, newest first.
+	var picked []int
+	for i := len(ops) - 1; i >= 0 && len(picked) < count; i-- {
+		if ops[i].Session == session {
+			picked = append(picked, i)
+		}
+	}
+
+	result := &UndoResult{
+		Undone:   []UndoneOperation{},
+		Workouts: []*Document{},
+	}
+	if len(picked) == 0 {
+		return result, nil
+	}
+
+	undone := map[int]bool{}
+	for _, i := range picked {
+		undone[i] = true
+	}
+
+	for _, i := range picked {
+		for _, snap := range ops[i].Before {
+			for j := i + 1; j < len(ops); j++ {
+				if undone[j] {
+					continue
+				}
+				for _, later := range ops[j].Before {
+					if later.Date == snap.Date {
+						return nil, ErrConflict
+					}
+				}
+			}
+		}
+	}
+
+	first, last := "", ""
+	seen := map[string]bool{}
+	var exercises []string
+	addExercises := func(doc *Document) {
+		if doc == nil {
+			return
+		}
+		for _, exName := range exerciseNames(doc) {
+			if !seen[exName] {
+				seen[exName] = true
+				exercises = append(exercises, exName)
+			}
+		}
+	}
+
+	var weighed weighedSpan
+	restored := map[string]bool{}
+	for _, i := range picked {
+		op := ops[i]
+		undoneOp := UndoneOperation{
+			ID:   op.ID,
+			Kind: op.Kind,
+			Time: op.Time,
+		}
+
+		for _, snap := range op.Before {
+			if snap.Doc != nil {
+				snap.Doc.upgradeUnits()
+			}
+
+			var current *Document
+			restoredDoc, err := s.Update(snap.Date, func(doc *Document) (*Document, error) {
+				current = doc
+				if snap.Doc == nil {
+					return nil, nil
+				}
+				return copyDocument(snap.Doc), nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			addExercises(current)
+			addExercises(snap.Doc)
+			e1rms.invalidate(user, snap.Date)
+
+			err = recordWrite(user, current, restoredDoc, Event{
+				Source: session,
+				Action: "undo",
+				Type:   EventReplace,
+				Date:   snap.Date,
+				Doc:    snap.Doc,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			if err := indexWeighin(user, snap.Date, snap.Doc, &weighed); err != nil {
+				return nil, err
+			}
+
+			if first == "" || snap.Date < first {
+				first = snap.Date
+			}
+			if snap.Date > last {
+				last = snap.Date
+			}
+			restored[snap.Date] = true
+			undoneOp.Dates = append(undoneOp.Dates, snap.Date)
+		}
+
+		result.Undone = append(result.Undone, undoneOp)
+	}
+
+	// Operations recorded since ops was read are kept.
+	undoneIDs := map[string]bool{}
+	for _, i := range picked {
+		undoneIDs[ops[i].ID] = true
+	}
+	var kept []Operation
+	err := s.UpdateMeta(opLogKey, &kept, func() error {
+		n := 0
+		for _, op := range kept {
+			if !undoneIDs[op.ID] {
+				kept[n] = op
+				n++
+			}
+		}
+		kept = kept[:n]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := weighed.refresh(user); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(exercises)
+	if _, err := updatePRs(user, first, last, exercises); err != nil {
+		return nil, err
+	}
+
+	dates := make([]string, 0, len(restored))
+	for date := range restored {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+
+	for _, date := range dates {
+		doc, err := s.Get(date)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Workouts = append(result.Workouts, doc)
+	}
+
+	return result, nil
+}
+
+// undo serves /v1/undo: POST reverts the last count writes, default 1, made
+// with the request's credentials. The days are shown in the unit query
+// parameter's unit.
+func undo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	count := 1
+	if raw := r.URL.Query().Get("count"); raw != "" {
+		var err error
+		count, err = strconv.Atoi(raw)
+		if err != nil || count < 1 || count > maxUndo {
+			writeError(w, r, http.StatusBadRequest, "invalid_query", "count must be between 1 and "+strconv.Itoa(maxUndo), FieldError{
+				Field:   "count",
+				Message: "must be between 1 and " + strconv.Itoa(maxUndo),
+			})
+			return
+		}
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	result, err := Undo(requestUser(r), requestSession(r), count)
+	if err == ErrConflict {
+		writeError(w, r, http.StatusConflict, "undo_conflict", "a later write from another session touched the same day")
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	result.Workouts = units.documents(result.Workouts)
+	writeJSON(w, http.StatusOK, result)
+}
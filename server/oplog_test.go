@@ -0,0 +1,170 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// logSets logs sets of one exercise on date under session.
+func logSets(t *testing.T, user, session, date, exName string, sets ...Set) *WriteResponse {
+	t.Helper()
+
+	resp, err := Log(user, session, &Document{
+		Date:      date,
+		Exercises: map[string][]Set{exName: sets},
+	}, time.UTC)
+	if err != nil {
+		t.Fatalf("Log: %v", err)
+	}
+
+	return resp
+}
+
+// setCounts returns how many sets are logged on each of dates, leaving out
+// days without a document.
+func setCounts(t *testing.T, user string, dates ...string) map[string]int {
+	t.Helper()
+
+	counts := map[string]int{}
+	for _, date := range dates {
+		doc, err := storeFor(user).Get(date)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Get(%s): %v", date, err)
+		}
+		for _, sets := range doc.Exercises {
+			counts[date] += len(sets)
+		}
+	}
+
+	return counts
+}
+
+func TestUndo(t *testing.T) {
+	const (
+		mon = "2026-01-05"
+		tue = "2026-01-06"
+	)
+
+	type write struct {
+		session string
+		date    string
+		sets    int
+	}
+
+	tests := []struct {
+		name    string
+		writes  []write
+		session string
+		count   int
+		err     error
+		undone  int
+		want    map[string]int
+	}{
+		{
+			name:    "last write of the session",
+			writes:  []write{{"a", mon, 1}, {"a", mon, 2}},
+			session: "a",
+			count:   1,
+			undone:  1,
+			want:    map[string]int{mon: 1},
+		},
+		{
+			name:    "several writes restore the earliest snapshot",
+			writes:  []write{{"a", mon, 1}, {"a", tue, 2}, {"a", mon, 3}},
+			session: "a",
+			count:   3,
+			undone:  3,
+			want:    map[string]int{},
+		},
+		{
+			name:    "other sessions on other days are kept",
+			writes:  []write{{"a", mon, 1}, {"b", tue, 2}},
+			session: "a",
+			count:   1,
+			undone:  1,
+			want:    map[string]int{tue: 2},
+		},
+		{
+			name:    "a later write by another session conflicts",
+			writes:  []write{{"a", mon, 1}, {"b", mon, 2}},
+			session: "a",
+			count:   1,
+			err:     ErrConflict,
+			want:    map[string]int{mon: 3},
+		},
+		{
+			name:    "an earlier write by another session does not conflict",
+			writes:  []write{{"b", mon, 2}, {"a", mon, 1}},
+			session: "a",
+			count:   1,
+			undone:  1,
+			want:    map[string]int{mon: 2},
+		},
+		{
+			name:    "a session with nothing to undo",
+			writes:  []write{{"a", mon, 1}},
+			session: "b",
+			count:   1,
+			want:    map[string]int{mon: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		useMemoryStore(t)
+
+		for _, w := range tt.writes {
+			sets := make([]Set, w.sets)
+			for i := range sets {
+				sets[i] = Set{Weight: 100, Reps: 5}
+			}
+			logSets(t, "al", w.session, w.date, "squat", sets...)
+		}
+
+		result, err := Undo("al", tt.session, tt.count)
+		if err != tt.err {
+			t.Errorf("%s: Undo error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && len(result.Undone) != tt.undone {
+			t.Errorf("%s: undid %d operations, want %d", tt.name, len(result.Undone), tt.undone)
+		}
+
+		got := setCounts(t, "al", mon, tue)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: sets by day = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for date, n := range tt.want {
+			if got[date] != n {
+				t.Errorf("%s: sets by day = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestUndoAfterConflictResolves(t *testing.T) {
+	useMemoryStore(t)
+
+	logSets(t, "al", "a", "2026-01-05", "squat", Set{Weight: 100, Reps: 5})
+	logSets(t, "al", "b", "2026-01-05", "squat", Set{Weight: 110, Reps: 5})
+
+	if _, err := Undo("al", "a", 1); err != ErrConflict {
+		t.Fatalf("Undo(a) error = %v, want %v", err, ErrConflict)
+	}
+
+	// Once b's write is undone, a's no longer has a later write over it.
+	if _, err := Undo("al", "b", 1); err != nil {
+		t.Fatalf("Undo(b): %v", err)
+	}
+	if _, err := Undo("al", "a", 1); err != nil {
+		t.Fatalf("Undo(a): %v", err)
+	}
+
+	if got := setCounts(t, "al", "2026-01-05"); len(got) != 0 {
+		t.Errorf("sets by day = %v, want none", got)
+	}
+}
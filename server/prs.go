@@ -0,0 +1,460 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// PR types.
+const (
+	PRWeight = "weight"
+	PRReps   = "reps"
+	PRE1RM   = "e1rm"
+	PRVolume = "volume"
+)
+
+// prsKey is the auxiliary record holding every PR event by exercise.
+const prsKey = "prs"
+
+// PR is a personal record set on a day. Value is the new best and Previous
+// the best before it; First marks the first time the record was set, which
+// has nothing to beat. Reps PRs are per weight and set type. Weights are
+// stored in kilograms.
+//
+// Weight, SetType and Reps are the set that made the record. Records made by
+// bodyweight sets count the Bodyweight of the day in Value.
+type PR struct {
+	Type       string  `json:"type"`
+	Exercise   string  `json:"exercise"`
+	Date       string  `json:"date"`
+	Value      float64 `json:"value"`
+	Previous   float64 `json:"previous"`
+	Weight     float64 `json:"weight"`
+	SetType    string  `json:"set_type,omitempty"`
+	Bodyweight float64 `json:"bodyweight,omitempty"`
+	Unit       string  `json:"unit,omitempty"`
+	Reps       int     `json:"reps"`
+	First      bool    `json:"first,omitempty"`
+}
+
+// prWindow is how many days updatePRs reads at a time.
+const prWindow = 31
+
+// prBests is the running best of every PR type for one exercise.
+type prBests struct {
+	weight float64
+	e1rm   float64
+	volume float64
+	reps   map[loadKey]int
+	seen   bool
+}
+
+func newPRBests() *prBests {
+	return &prBests{
+		reps: map[loadKey]int{},
+	}
+}
+
+// apply records an event into the running bests.
+func (b *prBests) apply(pr PR) {
+	b.seen = true
+
+	switch pr.Type {
+	case PRWeight:
+		b.weight = pr.Value
+	case PRE1RM:
+		b.e1rm = pr.Value
+	case PRVolume:
+		b.volume = pr.Value
+	case PRReps:
+		b.reps[loadKey{Type: pr.SetType, Weight: pr.Weight}] = pr.Reps
+	}
+}
+
+// detectPRs returns the PRs set by one day's sets of an exercise, done at
+// bodyweight bw, and advances the running bests past them.
+func detectPRs(b *prBests, exercise, date string, sets []Set, bw float64) []PR {
+	if len(sets) == 0 {
+		return nil
+	}
+
+	var prs []PR
+	first := !b.seen
+
+	// Bodyweight is only recorded where it went into the value.
+	if top, ok := topSet(sets, bw); ok && (first || effectiveLoad(top, bw) > b.weight) {
+		pr := PR{
+			Type:     PRWeight,
+			Exercise: exercise,
+			Date:     date,
+			Unit:     UnitKg,
+			Value:    effectiveLoad(top, bw),
+			Previous: b.weight,
+			Weight:   top.Weight,
+			SetType:  top.Type,
+			Reps:     top.Reps,
+			First:    first,
+		}
+		if top.Type != "" {
+			pr.Bodyweight = bw
+		}
+		prs = append(prs, pr)
+	}
+
+	if best, ok := bestE1RM(formulas[defaultFormula()], date, sets, bw); ok && (first || best.E1RM > b.e1rm) {
+		prs = append(prs, PR{
+			Type:       PRE1RM,
+			Exercise:   exercise,
+			Date:       date,
+			Unit:       UnitKg,
+			Value:      best.E1RM,
+			Previous:   b.e1rm,
+			Weight:     best.Weight,
+			SetType:    best.Type,
+			Bodyweight: best.Bodyweight,
+			Reps:       best.Reps,
+			First:      first,
+		})
+	}
+
+	bodyweightSets := false
+	for _, set := range sets {
+		bodyweightSets = bodyweightSets || set.Type != ""
+	}
+
+	if v := volume(sets, bw); first || v > b.volume {
+		pr := PR{
+			Type:     PRVolume,
+			Exercise: exercise,
+			Date:     date,
+			Unit:     UnitKg,
+			Value:    v,
+			Previous: b.volume,
+			First:    first,
+		}
+		if bodyweightSets {
+			pr.Bodyweight = bw
+		}
+		prs = append(prs, pr)
+	}
+
+	// Reps PRs are the most reps in a single set at a weight.
+	most := map[loadKey]int{}
+	for _, set := range sets {
+		if key := keyOf(set); set.Reps > most[key] {
+			most[key] = set.Reps
+		}
+	}
+	for _, key := range sortedWeights(most) {
+		previous, ok := b.reps[key]
+		if ok && most[key] <= previous {
+			continue
+		}
+
+		prs = append(prs, PR{
+			Type:     PRReps,
+			Exercise: exercise,
+			Date:     date,
+			Unit:     UnitKg,
+			Value:    float64(most[key]),
+			Previous: float64(previous),
+			Weight:   key.Weight,
+			SetType:  key.Type,
+			Reps:     most[key],
+			First:    !ok,
+		})
+	}
+
+	for _, pr := range prs {
+		b.apply(pr)
+	}
+	b.seen = true
+
+	return prs
+}
+
+// equal reports whether b and o are the same running bests.
+func (b *prBests) equal(o *prBests) bool {
+	if b.weight != o.weight || b.e1rm != o.e1rm || b.volume != o.volume || b.seen != o.seen || len(b.reps) != len(o.reps) {
+		return false
+	}
+
+	for key, reps := range b.reps {
+		if other, ok := o.reps[key]; !ok || other != reps {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadPRs returns every PR event stored in s by exercise. Events from before
+// weights were stored in kilograms are converted from legacyUnit, as the sets
+// they were found in are.
+func loadPRs(s WorkoutStore) (map[string][]PR, error) {
+	all := map[string][]PR{}
+	if err := s.GetMeta(prsKey, &all); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+
+	for _, events := range all {
+		for i, pr := range events {
+			if pr.Unit != "" {
+				continue
+			}
+
+			unit := legacyUnit()
+			if pr.Type != PRReps {
+				pr.Value = toKg(pr.Value, unit)
+				pr.Previous = toKg(pr.Previous, unit)
+			}
+			pr.Weight = toKg(pr.Weight, unit)
+			pr.Unit = UnitKg
+			events[i] = pr
+		}
+	}
+
+	return all, nil
+}
+
+// updatePRs recomputes the PR events of the exercises from date onward and
+// returns the events on date that did not exist before. The days after date
+// are replayed as well, so edits and deletions that lower a day correctly
+// revoke the PRs it held and promote the later sets that now beat the old
+// bests. Days are read prWindow at a time, and an exercise's replay stops once
+// it is past through, the last day the write changed, with the same running
+// bests as its stored events: the unchanged days after it would only yield
+// the stored events again. An empty through replays every day. The user's
+// lock must be held.
+func updatePRs(user, date, through string, exercises []string) ([]PR, error) {
+	if len(exercises) == 0 {
+		return []PR{}, nil
+	}
+
+	s := storeFor(user)
+
+	all, err := loadPRs(s)
+	if err != nil {
+		return nil, err
+	}
+
+	to := date
+	if today := time.Now().In(defaultLocation()).AddDate(0, 0, maxFutureDays).Format(dateLayout); today > to {
+		to = today
+	}
+	for _, exercise := range exercises {
+		for _, pr := range all[exercise] {
+			if pr.Date > to {
+				to = pr.Date
+			}
+		}
+	}
+
+	bws, err := loadBodyweights(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// replay is the recomputation of one exercise's events.
+	type replay struct {
+		events   []PR
+		bests    *prBests
+		existing map[PR]bool
+		done     bool
+	}
+
+	replays := make(map[string]*replay, len(exercises))
+	for _, exercise := range exercises {
+		r := &replay{
+			bests:    newPRBests(),
+			existing: map[PR]bool{},
+		}
+		for _, pr := range all[exercise] {
+			if pr.Date < date {
+				r.events = append(r.events, pr)
+				r.bests.apply(pr)
+			} else if pr.Date == date {
+				r.existing[pr] = true
+			}
+		}
+		replays[exercise] = r
+	}
+
+	start, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh := []PR{}
+	for from := date; from <= to; {
+		end := start.AddDate(0, 0, prWindow-1).Format(dateLayout)
+		if end > to {
+			end = to
+		}
+
+		docs, err := s.Range(from, end)
+		if err != nil {
+			return nil, err
+		}
+
+		replaying := 0
+		for _, exercise := range exercises {
+			r := replays[exercise]
+			if r.done {
+				continue
+			}
+
+			for _, doc := range docs {
+				for _, pr := range detectPRs(r.bests, exercise, doc.Date, doc.Exercises[exercise], bws.asOf(doc.Date)) {
+					r.events = append(r.events, pr)
+					if pr.Date == date && !r.existing[pr] {
+						fresh = append(fresh, pr)
+					}
+				}
+			}
+
+			if through != "" && end >= through && storedBests(all[exercise], end).equal(r.bests) {
+				for _, pr := range all[exercise] {
+					if pr.Date > end {
+						r.events = append(r.events, pr)
+					}
+				}
+				r.done = true
+				continue
+			}
+			replaying++
+		}
+		if replaying == 0 {
+			break
+		}
+
+		start = start.AddDate(0, 0, prWindow)
+		from = start.Format(dateLayout)
+	}
+
+	// Only the replayed exercises are written, over whatever PRs of the
+	// others were stored in the meantime.
+	var stored map[string][]PR
+	err = s.UpdateMeta(prsKey, &stored, func() error {
+		if stored == nil {
+			stored = map[string][]PR{}
+		}
+		for _, exercise := range exercises {
+			if events := replays[exercise].events; len(events) == 0 {
+				delete(stored, exercise)
+			} else {
+				stored[exercise] = events
+			}
+		}
+		return nil
+	})
+
+	return fresh, err
+}
+
+// storedBests returns the running bests of the stored events up to and
+// including date.
+func storedBests(events []PR, date string) *prBests {
+	bests := newPRBests()
+	for _, pr := range events {
+		if pr.Date <= date {
+			bests.apply(pr)
+		}
+	}
+
+	return bests
+}
+
+// exerciseNames returns the names of the exercises in doc.
+func exerciseNames(doc *Document) []string {
+	names := make([]string, 0, len(doc.Exercises))
+	for exName := range doc.Exercises {
+		names = append(names, exName)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// getPRs serves /v1/prs, optionally filtered by the exercise, type, from and
+// to query parameters, in the unit query parameter's unit.
+func getPRs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	query := r.URL.Query()
+
+	prType := query.Get("type")
+	switch prType {
+	case "", PRWeight, PRReps, PRE1RM, PRVolume:
+	default:
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "unknown PR type", FieldError{
+			Field:   "type",
+			Message: "must be one of weight, reps, e1rm or volume",
+		})
+		return
+	}
+
+	for _, field := range []string{"from", "to"} {
+		if raw := query.Get(field); raw != "" {
+			if _, err := queryDate(raw, ""); err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+					Field:   field,
+					Message: err.Error(),
+				})
+				return
+			}
+		}
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	all, err := loadPRs(storeFor(requestUser(r)))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	exercise := query.Get("exercise")
+	if exercise != "" {
+		exercise, err = resolveExercise(requestUser(r), exercise)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	from, to := query.Get("from"), query.Get("to")
+
+	prs := []PR{}
+	for exName, events := range all {
+		if exercise != "" && exName != exercise {
+			continue
+		}
+
+		for _, pr := range events {
+			if prType != "" && pr.Type != prType {
+				continue
+			}
+			if (from != "" && pr.Date < from) || (to != "" && pr.Date > to) {
+				continue
+			}
+			prs = append(prs, pr)
+		}
+	}
+
+	sort.SliceStable(prs, func(i, j int) bool {
+		if prs[i].Date != prs[j].Date {
+			return prs[i].Date < prs[j].Date
+		}
+		return prs[i].Exercise < prs[j].Exercise
+	})
+
+	writeJSON(w, http.StatusOK, units.PRs(prs))
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// settings are the configuration values that can change while the server
+// runs. They are swapped as a whole so a request never sees half a reload.
+type settings struct {
+	cfg      Config
+	location *time.Location
+	limiter  *rateLimiter
+}
+
+var (
+	current  atomic.Value
+	logLevel = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+)
+
+func init() {
+	cfg := DefaultConfig()
+	current.Store(&settings{
+		cfg:      cfg,
+		location: time.Local,
+		limiter:  newRateLimiter(cfg.RateLimit, cfg.RateBurst),
+	})
+}
+
+func loadSettings() *settings {
+	return current.Load().(*settings)
+}
+
+// defaultLocation is the timezone days are bucketed in when a request does
+// not name one.
+func defaultLocation() *time.Location {
+	return loadSettings().location
+}
+
+// defaultFormula is the e1RM formula used when a request does not name one.
+func defaultFormula() string {
+	return loadSettings().cfg.E1RMFormula
+}
+
+// defaultUnit is the weight unit of users who have not chosen one.
+func defaultUnit() string {
+	unit, _ := parseUnit(loadSettings().cfg.Unit)
+	return unit
+}
+
+// apply makes cfg the current settings. cfg must be valid.
+func apply(cfg Config) {
+	loc, _ := cfg.Location()
+
+	var level zapcore.Level
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	logLevel.SetLevel(level)
+
+	old := loadSettings()
+
+	// Keep the limiter, and the buckets it holds, unless its rate changed.
+	limiter := old.limiter
+	if cfg.RateLimit != old.cfg.RateLimit || cfg.RateBurst != old.cfg.RateBurst {
+		limiter = newRateLimiter(cfg.RateLimit, cfg.RateBurst)
+	}
+
+	current.Store(&settings{
+		cfg:      cfg,
+		location: loc,
+		limiter:  limiter,
+	})
+}
+
+// Reload validates cfg and applies its runtime settings. An invalid config is
+// rejected and the current settings are kept. Changes to settings that need a
+// restart are logged but not applied.
+func Reload(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	old := loadSettings().cfg
+	changes, restart := diffConfig(old, cfg)
+
+	// Settings that need a restart keep their running values.
+	cfg.Addr = old.Addr
+	cfg.ReadTimeout = old.ReadTimeout
+	cfg.WriteTimeout = old.WriteTimeout
+	cfg.IdleTimeout = old.IdleTimeout
+	cfg.ShutdownTimeout = old.ShutdownTimeout
+	cfg.Store = old.Store
+	cfg.DataDir = old.DataDir
+	cfg.Couchbase = old.Couchbase
+	cfg.Mail = old.Mail
+	cfg.TokenSecret = old.TokenSecret
+
+	apply(cfg)
+
+	if len(changes) == 0 && len(restart) == 0 {
+		logger.Info("config reloaded with no changes")
+		return nil
+	}
+
+	logger.Info("config reloaded", zap.Strings("changed", changes), zap.Strings("needs_restart", restart))
+	return nil
+}
+
+// diffConfig describes each setting that differs between old and new, split
+// into those applied on reload and those that need a restart.
+func diffConfig(old, new Config) (changes, restart []string) {
+	describe := func(name string, a, b interface{}) string {
+		return fmt.Sprintf("%s: %v -> %v", name, a, b)
+	}
+
+	if old.Timezone != new.Timezone {
+		changes = append(changes, describe("timezone", old.Timezone, new.Timezone))
+	}
+	if old.LogLevel != new.LogLevel {
+		changes = append(changes, describe("log_level", old.LogLevel, new.LogLevel))
+	}
+	if old.RateLimit != new.RateLimit {
+		changes = append(changes, describe("rate_limit", old.RateLimit, new.RateLimit))
+	}
+	if old.RateBurst != new.RateBurst {
+		changes = append(changes, describe("rate_burst", old.RateBurst, new.RateBurst))
+	}
+	if !reflect.DeepEqual(featureList(old.Features), featureList(new.Features)) {
+		changes = append(changes, describe("features", featureList(old.Features), featureList(new.Features)))
+	}
+	if old.StrictExercises != new.StrictExercises {
+		changes = append(changes, describe("strict_exercises", old.StrictExercises, new.StrictExercises))
+	}
+	if old.Unit != new.Unit {
+		changes = append(changes, describe("unit", old.Unit, new.Unit))
+	}
+	if old.E1RMFormula != new.E1RMFormula {
+		changes = append(changes, describe("e1rm_formula", old.E1RMFormula, new.E1RMFormula))
+	}
+	if strings.Join(old.CORSOrigins, ",") != strings.Join(new.CORSOrigins, ",") {
+		changes = append(changes, describe("cors_origins", old.CORSOrigins, new.CORSOrigins))
+	}
+	if old.TokenTTL != new.TokenTTL {
+		changes = append(changes, describe("token_ttl", old.TokenTTL, new.TokenTTL))
+	}
+	if old.IdempotencyTTL != new.IdempotencyTTL {
+		changes = append(changes, describe("idempotency_ttl", old.IdempotencyTTL, new.IdempotencyTTL))
+	}
+
+	if old.Addr != new.Addr {
+		restart = append(restart, describe("addr", old.Addr, new.Addr))
+	}
+	if old.ReadTimeout != new.ReadTimeout {
+		restart = append(restart, describe("read_timeout", old.ReadTimeout, new.ReadTimeout))
+	}
+	if old.WriteTimeout != new.WriteTimeout {
+		restart = append(restart, describe("write_timeout", old.WriteTimeout, new.WriteTimeout))
+	}
+	if old.IdleTimeout != new.IdleTimeout {
+		restart = append(restart, describe("idle_timeout", old.IdleTimeout, new.IdleTimeout))
+	}
+	if old.ShutdownTimeout != new.ShutdownTimeout {
+		restart = append(restart, describe("shutdown_timeout", old.ShutdownTimeout, new.ShutdownTimeout))
+	}
+	if old.Store != new.Store {
+		restart = append(restart, describe("store", old.Store, new.Store))
+	}
+	if old.DataDir != new.DataDir {
+		restart = append(restart, describe("data_dir", old.DataDir, new.DataDir))
+	}
+	if old.Couchbase != new.Couchbase {
+		// Credentials are left out of the log.
+		restart = append(restart, "couchbase")
+	}
+	if old.Mail != new.Mail {
+		restart = append(restart, describe("mail", old.Mail, new.Mail))
+	}
+	if old.TokenSecret != new.TokenSecret {
+		restart = append(restart, "token_secret")
+	}
+
+	return changes, restart
+}
+
+// featureList renders features as sorted name=enabled pairs.
+func featureList(features map[string]bool) []string {
+	list := make([]string, 0, len(features))
+	for name, on := range features {
+		list = append(list, fmt.Sprintf("%s=%t", name, on))
+	}
+	sort.Strings(list)
+
+	return list
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SetPatch is a correction to a set. Only the fields given are changed. A
+// unit given without a weight corrects the unit the set was logged in.
+type SetPatch struct {
+	Weight *float64 `json:"weight"`
+	Unit   *string  `json:"unit"`
+	Reps   *int     `json:"reps"`
+	RPE    *float64 `json:"rpe"`
+	Notes  *string  `json:"notes"`
+}
+
+// apply returns the stored set with the patch applied. A weight without a
+// unit is in unit.
+func (p *SetPatch) apply(set Set, unit string) Set {
+	if p.Weight != nil || p.Unit != nil {
+		logged := Set{
+			Weight: set.LoggedWeight,
+			Unit:   set.LoggedUnit,
+		}
+		if p.Weight != nil {
+			logged.Weight, logged.Unit = *p.Weight, ""
+		}
+		if p.Unit != nil {
+			logged.Unit = *p.Unit
+		}
+
+		logged = canonicalSet(logged, unit)
+		set.Weight, set.Unit = logged.Weight, logged.Unit
+		set.LoggedWeight, set.LoggedUnit = logged.LoggedWeight, logged.LoggedUnit
+	}
+	if p.Reps != nil {
+		set.Reps = *p.Reps
+	}
+	if p.RPE != nil {
+		set.RPE = *p.RPE
+	}
+	if p.Notes != nil {
+		set.Notes = *p.Notes
+	}
+
+	return set
+}
+
+// EditSets changes the sets of one exercise on the user's day with edit,
+// which returns the exercise's new sets. An exercise left without sets is
+// removed, and a day left with nothing logged is deleted. The edit is logged
+// under session so it can be undone. edit is called again when another
+// writer changes the day under it, and must not use the store; when that
+// keeps happening EditSets gives up with ErrConflict.
+func EditSets(user, session, date, exercise, kind string, edit func([]Set) ([]Set, error)) (*WriteResponse, error) {
+	defer lockUser(user)()
+
+	s := storeFor(user)
+
+	// Any of the exercise's names finds it, but days logged before the
+	// catalog keep the names they were logged under.
+	name := exercise
+	id, err := resolveExercise(user, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		before Snapshot
+		sets   []Set
+	)
+	doc, err := s.Update(date, func(doc *Document) (*Document, error) {
+		if doc == nil {
+			return nil, ErrNotFound
+		}
+		before = Snapshot{Date: date, Doc: copyDocument(doc)}
+
+		exercise = name
+		if _, ok := doc.Exercises[exercise]; !ok {
+			exercise = id
+		}
+
+		current, ok := doc.Exercises[exercise]
+		if !ok {
+			return nil, ErrNotFound
+		}
+
+		var err error
+		sets, err = edit(current)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(sets) == 0 {
+			delete(doc.Exercises, exercise)
+		} else {
+			doc.Exercises[exercise] = sets
+		}
+
+		if fields := doc.validate(); len(fields) > 0 {
+			return nil, &InputError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    "invalid_workout",
+				Message: "the corrected workout has invalid fields",
+				Fields:  fields,
+			}
+		}
+
+		// Legacy documents are upgraded by the rewrite.
+		doc.Version = SchemaVersion
+
+		if doc.empty() {
+			return nil, nil
+		}
+		return doc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	e1rms.invalidate(user, date)
+
+	err = recordWrite(user, before.Doc, doc, Event{
+		Source:   session,
+		Action:   kind,
+		Type:     EventSetExercise,
+		Date:     date,
+		Exercise: exercise,
+		Sets:     sets,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := recordOp(user, session, kind, []Snapshot{before}); err != nil {
+		logger.Error("could not record operation", zap.String("user", user), zap.String("date", date), zap.Error(err))
+	}
+
+	prs, err := updatePRs(user, date, date, []string{exercise})
+	if err != nil {
+		logger.Error("could not update PRs", zap.String("user", user), zap.String("date", date), zap.Error(err))
+	}
+
+	return &WriteResponse{
+		Document: doc,
+		PRs:      prs,
+	}, nil
+}
+
+// workout serves /v1/workouts/{date} and the exercises and sets under it:
+//
+//	GET    /v1/workouts/{date}
+//	GET    /v1/workouts/{date}/history
+//	DELETE /v1/workouts/{date}/exercises/{name}
+//	PATCH  /v1/workouts/{date}/exercises/{name}/sets/{index}
+//	DELETE /v1/workouts/{date}/exercises/{name}/sets/{index}
+//
+// Set indexes count from 0 in the order the sets are stored.
+func workout(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/workouts/"), "/")
+
+	if _, err := time.Parse(dateLayout, parts[0]); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_date", "date must be YYYY-MM-DD")
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		getWorkout(w, r, parts[0])
+
+	case len(parts) == 2 && parts[1] == "history":
+		getHistory(w, r, parts[0])
+
+	case len(parts) == 3 && parts[1] == "exercises" && parts[2] != "":
+		if r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, r)
+			return
+		}
+		deleteExercise(w, r, parts[0], parts[2])
+
+	case len(parts) == 5 && parts[1] == "exercises" && parts[2] != "" && parts[3] == "sets":
+		index, err := strconv.Atoi(parts[4])
+		if err != nil || index < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_index", "set index must be a number from 0")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPatch:
+			patchSet(w, r, parts[0], parts[2], index)
+		case http.MethodDelete:
+			deleteSet(w, r, parts[0], parts[2], index)
+		default:
+			writeMethodNotAllowed(w, r)
+		}
+
+	default:
+		writeError(w, r, http.StatusNotFound, "not_found", "no such endpoint")
+	}
+}
+
+func deleteExercise(w http.ResponseWriter, r *http.Request, date, exercise string) {
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	resp, err := EditSets(requestUser(r), requestSession(r), date, exercise, "delete_exercise", func([]Set) ([]Set, error) {
+		return nil, nil
+	})
+	writeEditResponse(w, r, units, resp, err)
+}
+
+func patchSet(w http.ResponseWriter, r *http.Request, date, exercise string, index int) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
+	}
+
+	patch := SetPatch{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	if patch.Unit != nil {
+		if _, ok := parseUnit(*patch.Unit); !ok {
+			writeError(w, r, http.StatusUnprocessableEntity, "invalid_workout", "the correction has invalid fields", FieldError{
+				Field:   "unit",
+				Message: "unit must be kg or lb",
+			})
+			return
+		}
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	unit, err := inputUnit(requestUser(r))
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	resp, err := EditSets(requestUser(r), requestSession(r), date, exercise, "patch_set", func(sets []Set) ([]Set, error) {
+		if index >= len(sets) {
+			return nil, ErrNotFound
+		}
+		sets[index] = patch.apply(sets[index], unit)
+		return sets, nil
+	})
+	writeEditResponse(w, r, units, resp, err)
+}
+
+func deleteSet(w http.ResponseWriter, r *http.Request, date, exercise string, index int) {
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	resp, err := EditSets(requestUser(r), requestSession(r), date, exercise, "delete_set", func(sets []Set) ([]Set, error) {
+		if index >= len(sets) {
+			return nil, ErrNotFound
+		}
+		return append(sets[:index], sets[index+1:]...), nil
+	})
+	writeEditResponse(w, r, units, resp, err)
+}
+
+// writeEditResponse writes the result of EditSets in units. A day deleted by
+// the edit is answered with 204.
+func writeEditResponse(w http.ResponseWriter, r *http.Request, units Units, resp *WriteResponse, err error) {
+	if err == ErrNotFound {
+		writeError(w, r, http.StatusNotFound, "not_found", "no such workout, exercise or set")
+		return
+	}
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	if resp.Document == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.Response(resp))
+}
@@ -0,0 +1,548 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxShorthandSets bounds the set count of a single group such as 135x5x3.
+const maxShorthandSets = 100
+
+// ShorthandError reports where shorthand could not be parsed. Line and
+// Column count from 1, Column in characters.
+type ShorthandError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *ShorthandError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// shorthandToken is a run of text between separators. pos is its byte offset
+// in the parsed text.
+type shorthandToken struct {
+	text string
+	pos  int
+	// end marks a newline or semicolon, which ends an exercise.
+	end bool
+}
+
+// shorthandWeight is a weight written on its own, such as 60kg or bw+25, used
+// by the set groups that follow it. used is set once a group has taken it.
+type shorthandWeight struct {
+	load Set
+	pos  int
+	used bool
+}
+
+// shorthandParser accumulates the sets of the exercises parsed so far.
+type shorthandParser struct {
+	text      string
+	exercises map[string][]Set
+	name      string
+	namePos   int
+	sets      int
+	weight    *shorthandWeight
+	// last is the sets of the previous group, which a following @rpe
+	// applies to.
+	last []int
+}
+
+// ParseShorthand reads sets written the way they are jotted down in the gym
+// and returns them by exercise. Exercises are separated by newlines or
+// semicolons, and each is a name followed by set groups:
+//
+//	bench 135x5x3, 155x3      weight x reps x sets, weight x reps
+//	squat 3x5@225             sets x reps @ weight
+//	pullup bw+25 x8 x6        a weight on its own applies to the x groups after it
+//	row 60kg 4x10 @8, 70x8    sets x reps right after a weight, then @rpe
+//
+// Weights may carry kg or lb, and bw, bw+25 and bw-25 are bodyweight,
+// weighted and assisted sets. An @ value that has a unit, is above 10 or is a
+// bodyweight is a weight, otherwise it is an RPE. Names are lowercased with
+// spaces replaced by underscores, so "Leg Press" becomes leg_press. Errors are
+// *ShorthandError.
+func ParseShorthand(text string) (map[string][]Set, error) {
+	p := &shorthandParser{
+		text:      text,
+		exercises: map[string][]Set{},
+	}
+
+	for _, tok := range tokenizeShorthand(text) {
+		var err error
+		switch {
+		case tok.end:
+			err = p.finish()
+
+		case strings.HasPrefix(tok.text, "@"):
+			err = p.rpe(tok)
+
+		case isSetToken(strings.ToLower(tok.text)):
+			err = p.group(tok)
+
+		default:
+			err = p.word(tok)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.finish(); err != nil {
+		return nil, err
+	}
+
+	if len(p.exercises) == 0 {
+		return nil, p.errorAt(len(text), "no sets found")
+	}
+
+	return p.exercises, nil
+}
+
+// tokenizeShorthand splits text on whitespace and commas, keeping newlines
+// and semicolons as end tokens.
+func tokenizeShorthand(text string) []shorthandToken {
+	var tokens []shorthandToken
+
+	start := -1
+	for i, r := range text {
+		sep := unicode.IsSpace(r) || r == ',' || r == ';'
+		if sep && start >= 0 {
+			tokens = append(tokens, shorthandToken{text: text[start:i], pos: start})
+			start = -1
+		}
+		if r == '\n' || r == ';' {
+			tokens = append(tokens, shorthandToken{pos: i, end: true})
+		}
+		if !sep && start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, shorthandToken{text: text[start:], pos: start})
+	}
+
+	return tokens
+}
+
+// isSetToken reports whether a lowercased token is a weight or set group
+// rather than part of an exercise name.
+func isSetToken(t string) bool {
+	if t == "" {
+		return false
+	}
+	if t[0] >= '0' && t[0] <= '9' || t[0] == '.' {
+		return true
+	}
+	if t == "bw" || strings.HasPrefix(t, "bw+") || strings.HasPrefix(t, "bw-") || strings.HasPrefix(t, "bwx") {
+		return true
+	}
+
+	return len(t) > 1 && t[0] == 'x' && t[1] >= '0' && t[1] <= '9'
+}
+
+// errorAt returns a *ShorthandError for the byte offset pos.
+func (p *shorthandParser) errorAt(pos int, format string, args ...interface{}) error {
+	line, lineStart := 1, 0
+	for i := 0; i < pos && i < len(p.text); i++ {
+		if p.text[i] == '\n' {
+			line++
+			lineStart = i + 1
+		}
+	}
+
+	return &ShorthandError{
+		Line:    line,
+		Column:  utf8.RuneCountInString(p.text[lineStart:pos]) + 1,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// word adds a word to the exercise name, or starts the next exercise when
+// the current one already has sets.
+func (p *shorthandParser) word(tok shorthandToken) error {
+	if p.sets > 0 {
+		if err := p.finish(); err != nil {
+			return err
+		}
+	}
+
+	if p.name == "" {
+		p.name = strings.ToLower(tok.text)
+		p.namePos = tok.pos
+	} else {
+		p.name += "_" + strings.ToLower(tok.text)
+	}
+
+	return nil
+}
+
+// finish closes the current exercise.
+func (p *shorthandParser) finish() error {
+	// A weight left over is a set missing its reps, as in "bench 225", so it
+	// is reported before an exercise without sets.
+	if p.weight != nil && !p.weight.used {
+		return p.errorAt(p.weight.pos, "weight has no reps after it")
+	}
+	if p.name != "" && p.sets == 0 {
+		return p.errorAt(p.namePos, "no sets for %s", p.name)
+	}
+
+	p.name = ""
+	p.sets = 0
+	p.weight = nil
+	p.last = nil
+
+	return nil
+}
+
+// rpe applies a standalone @rpe to the sets of the previous group.
+func (p *shorthandParser) rpe(tok shorthandToken) error {
+	if len(p.last) == 0 {
+		return p.errorAt(tok.pos, "@ must follow a set")
+	}
+
+	rpe, err := p.parseRPE(tok.text[1:], tok.pos+1)
+	if err != nil {
+		return err
+	}
+
+	sets := p.exercises[p.name]
+	for _, i := range p.last {
+		sets[i].RPE = rpe
+	}
+
+	return nil
+}
+
+// group parses a weight on its own or a set group.
+func (p *shorthandParser) group(tok shorthandToken) error {
+	if p.name == "" {
+		return p.errorAt(tok.pos, "expected an exercise name before %q", tok.text)
+	}
+
+	t := strings.ToLower(tok.text)
+
+	at, atPos := "", -1
+	if i := strings.Index(t, "@"); i >= 0 {
+		at, atPos = t[i+1:], tok.pos+i+1
+		t = t[:i]
+	}
+
+	var (
+		parts []string
+		pos   []int
+	)
+	offset := tok.pos
+	for {
+		i := strings.Index(t, "x")
+		if i < 0 {
+			parts = append(parts, t)
+			pos = append(pos, offset)
+			break
+		}
+		parts = append(parts, t[:i])
+		pos = append(pos, offset)
+		t = t[i+1:]
+		offset += i + 1
+	}
+
+	// A weight on its own is used by the groups after it.
+	if len(parts) == 1 {
+		if atPos >= 0 {
+			return p.errorAt(atPos-1, "@ must follow a set")
+		}
+		load, err := p.parseWeight(parts[0], pos[0])
+		if err != nil {
+			return err
+		}
+		if p.weight != nil && !p.weight.used {
+			return p.errorAt(p.weight.pos, "weight has no reps after it")
+		}
+		p.weight = &shorthandWeight{load: load, pos: pos[0]}
+		return nil
+	}
+
+	if len(parts) > 3 {
+		return p.errorAt(pos[3]-1, "too many x in set")
+	}
+
+	nums := make([]int, len(parts)-1)
+	for i, part := range parts[1:] {
+		n, err := p.parseCount(part, pos[i+1])
+		if err != nil {
+			return err
+		}
+		nums[i] = n
+	}
+
+	var (
+		load       Set
+		reps, sets int
+		rpe        float64
+	)
+
+	atWeight := false
+	if atPos >= 0 {
+		l, err := p.parseWeight(at, atPos)
+		if err != nil {
+			return err
+		}
+		if atWeight = l.Unit != "" || l.Weight > 10 || l.Type != ""; atWeight {
+			load = l
+		} else if rpe, err = p.parseRPE(at, atPos); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case parts[0] == "":
+		// x8 or x8x3: reps, and optionally sets, at the weight before it.
+		if p.weight == nil {
+			return p.errorAt(tok.pos, "x%s needs a weight before it", parts[1])
+		}
+		if atWeight {
+			return p.errorAt(atPos, "weight given twice")
+		}
+		load = p.weight.load
+		p.weight.used = true
+		reps, sets = nums[0], 1
+		if len(nums) == 2 {
+			sets = nums[1]
+		}
+
+	case len(nums) == 2:
+		// 135x5x3: weight x reps x sets.
+		if atWeight {
+			return p.errorAt(atPos, "weight given twice")
+		}
+		l, err := p.parseWeight(parts[0], pos[0])
+		if err != nil {
+			return err
+		}
+		load, reps, sets = l, nums[0], nums[1]
+
+	case atWeight || (p.weight != nil && !p.weight.used && isCount(parts[0])):
+		// 3x5@225, or 4x10 right after a weight: sets x reps. Groups after
+		// that one are weight x reps again.
+		n, err := p.parseCount(parts[0], pos[0])
+		if err != nil {
+			return err
+		}
+		if !atWeight {
+			load = p.weight.load
+			p.weight.used = true
+		}
+		sets, reps = n, nums[0]
+
+	default:
+		// 135x5: weight x reps.
+		l, err := p.parseWeight(parts[0], pos[0])
+		if err != nil {
+			return err
+		}
+		load, reps, sets = l, nums[0], 1
+	}
+
+	p.last = p.last[:0]
+	for i := 0; i < sets; i++ {
+		p.last = append(p.last, len(p.exercises[p.name]))
+		p.exercises[p.name] = append(p.exercises[p.name], Set{
+			Weight: load.Weight,
+			Unit:   load.Unit,
+			Type:   load.Type,
+			Reps:   reps,
+			RPE:    rpe,
+		})
+	}
+	p.sets += sets
+
+	return nil
+}
+
+// parseWeight parses a weight with an optional kg or lb unit, or bodyweight
+// written as bw, bw+<weight> or bw-<weight>. The load is returned as a set
+// without reps.
+func (p *shorthandParser) parseWeight(s string, pos int) (Set, error) {
+	if strings.HasPrefix(s, "bw") {
+		rest := s[2:]
+		if rest == "" {
+			return Set{Type: SetBodyweight}, nil
+		}
+
+		kind := ""
+		switch rest[0] {
+		case '+':
+			kind = SetWeighted
+		case '-':
+			kind = SetAssisted
+		default:
+			return Set{}, p.errorAt(pos+2, "expected + or - after bw")
+		}
+
+		load, err := p.parseWeight(rest[1:], pos+3)
+		if err != nil {
+			return Set{}, err
+		}
+		if load.Type != "" {
+			return Set{}, p.errorAt(pos+3, "expected a weight")
+		}
+		load.Type = kind
+
+		return load, nil
+	}
+
+	i := strings.IndexFunc(s, unicode.IsLetter)
+	if i < 0 {
+		i = len(s)
+	}
+
+	if i == 0 {
+		return Set{}, p.errorAt(pos, "expected a weight")
+	}
+
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || value < 0 {
+		return Set{}, p.errorAt(pos, "invalid weight %q", s[:i])
+	}
+
+	unit := s[i:]
+	if unit != "" {
+		var ok bool
+		if unit, ok = parseUnit(unit); !ok {
+			return Set{}, p.errorAt(pos+i, "unknown unit %q, expected kg or lb", s[i:])
+		}
+	}
+
+	return Set{
+		Weight: value,
+		Unit:   unit,
+	}, nil
+}
+
+// parseCount parses a number of reps or sets.
+func (p *shorthandParser) parseCount(s string, pos int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, p.errorAt(pos, "expected a whole number of reps or sets, got %q", s)
+	}
+	if n > maxShorthandSets {
+		return 0, p.errorAt(pos, "%d is more than %d", n, maxShorthandSets)
+	}
+
+	return n, nil
+}
+
+func (p *shorthandParser) parseRPE(s string, pos int) (float64, error) {
+	rpe, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, p.errorAt(pos, "invalid rpe %q", s)
+	}
+	if rpe < 0 || rpe > 10 {
+		return 0, p.errorAt(pos, "rpe must be between 0 and 10")
+	}
+
+	return rpe, nil
+}
+
+// isCount reports whether s is a plain whole number.
+func isCount(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// shorthandRequest is the body of POST /v1/shorthand.
+type shorthandRequest struct {
+	Text string `json:"text"`
+	Date string `json:"date"`
+}
+
+// shorthand serves /v1/shorthand: POST parses the text with ParseShorthand
+// and logs the sets. With dry_run=true the parsed day is returned without
+// being stored. Either way the sets are shown in the unit query parameter's
+// unit.
+func shorthand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
+	}
+
+	req := shorthandRequest{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	exercises, err := ParseShorthand(req.Text)
+	if err != nil {
+		writeShorthandError(w, r, err)
+		return
+	}
+
+	doc := &Document{
+		Date:      req.Date,
+		Exercises: exercises,
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		unit, err := inputUnit(requestUser(r))
+		if err != nil {
+			writeLogError(w, r, err)
+			return
+		}
+		doc.canonicalize(unit)
+
+		writeJSON(w, http.StatusOK, units.Document(doc))
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	resp, err := Log(requestUser(r), requestSession(r), doc, loc)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.Response(resp))
+}
+
+// writeShorthandError answers a *ShorthandError with its position.
+func writeShorthandError(w http.ResponseWriter, r *http.Request, err error) {
+	se, ok := err.(*ShorthandError)
+	if !ok {
+		writeLogError(w, r, err)
+		return
+	}
+
+	writeError(w, r, http.StatusUnprocessableEntity, "invalid_shorthand", se.Error(), FieldError{
+		Field:   "text",
+		Message: se.Message,
+		Line:    se.Line,
+		Column:  se.Column,
+	})
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseShorthand(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want map[string][]Set
+	}{
+		{
+			name: "weight x reps x sets",
+			text: "bench 135x5x3, 155x3",
+			want: map[string][]Set{
+				"bench": {
+					{Weight: 135, Reps: 5},
+					{Weight: 135, Reps: 5},
+					{Weight: 135, Reps: 5},
+					{Weight: 155, Reps: 3},
+				},
+			},
+		},
+		{
+			name: "sets x reps at weight",
+			text: "squat 3x5@225lb",
+			want: map[string][]Set{
+				"squat": {
+					{Weight: 225, Unit: UnitLb, Reps: 5},
+					{Weight: 225, Unit: UnitLb, Reps: 5},
+					{Weight: 225, Unit: UnitLb, Reps: 5},
+				},
+			},
+		},
+		{
+			name: "weight on its own then rpe",
+			text: "row 60kg 2x10 @8",
+			want: map[string][]Set{
+				"row": {
+					{Weight: 60, Unit: UnitKg, Reps: 10, RPE: 8},
+					{Weight: 60, Unit: UnitKg, Reps: 10, RPE: 8},
+				},
+			},
+		},
+		{
+			name: "weight x reps after sets x reps at a weight",
+			text: "bench 60kg 4x10, 80x5",
+			want: map[string][]Set{
+				"bench": {
+					{Weight: 60, Unit: UnitKg, Reps: 10},
+					{Weight: 60, Unit: UnitKg, Reps: 10},
+					{Weight: 60, Unit: UnitKg, Reps: 10},
+					{Weight: 60, Unit: UnitKg, Reps: 10},
+					{Weight: 80, Reps: 5},
+				},
+			},
+		},
+		{
+			name: "weight x reps after an rpe",
+			text: "row 60kg 4x10 @8, 70x8",
+			want: map[string][]Set{
+				"row": {
+					{Weight: 60, Unit: UnitKg, Reps: 10, RPE: 8},
+					{Weight: 60, Unit: UnitKg, Reps: 10, RPE: 8},
+					{Weight: 60, Unit: UnitKg, Reps: 10, RPE: 8},
+					{Weight: 60, Unit: UnitKg, Reps: 10, RPE: 8},
+					{Weight: 70, Reps: 8},
+				},
+			},
+		},
+		{
+			name: "weight x reps after a unitless weight",
+			text: "squat 100 3x5, 120x3",
+			want: map[string][]Set{
+				"squat": {
+					{Weight: 100, Reps: 5},
+					{Weight: 100, Reps: 5},
+					{Weight: 100, Reps: 5},
+					{Weight: 120, Reps: 3},
+				},
+			},
+		},
+		{
+			name: "x groups keep using the weight",
+			text: "pullup bw+25 x8 x6",
+			want: map[string][]Set{
+				"pullup": {
+					{Weight: 25, Type: SetWeighted, Reps: 8},
+					{Weight: 25, Type: SetWeighted, Reps: 6},
+				},
+			},
+		},
+		{
+			name: "bodyweight loads",
+			text: "pullup bw+25 x8, bw x5; dip bw-20kgx10",
+			want: map[string][]Set{
+				"pullup": {
+					{Weight: 25, Type: SetWeighted, Reps: 8},
+					{Type: SetBodyweight, Reps: 5},
+				},
+				"dip": {
+					{Weight: 20, Unit: UnitKg, Type: SetAssisted, Reps: 10},
+				},
+			},
+		},
+		{
+			name: "names are joined and lowercased",
+			text: "Leg Press 200x10\nCalf Raise 100x15",
+			want: map[string][]Set{
+				"leg_press":  {{Weight: 200, Reps: 10}},
+				"calf_raise": {{Weight: 100, Reps: 15}},
+			},
+		},
+		{
+			name: "inline rpe",
+			text: "deadlift 180x3@9.5",
+			want: map[string][]Set{
+				"deadlift": {{Weight: 180, Reps: 3, RPE: 9.5}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseShorthand(tt.text)
+		if err != nil {
+			t.Errorf("%s: ParseShorthand(%q): %v", tt.name, tt.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseShorthand(%q) = %+v, want %+v", tt.name, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseShorthandErrors(t *testing.T) {
+	tests := []struct {
+		text   string
+		line   int
+		column int
+		msg    string
+	}{
+		{"bench 225", 1, 7, "weight has no reps after it"},
+		{"bench", 1, 1, "no sets for bench"},
+		{"", 1, 1, "no sets found"},
+		{"135x5", 1, 1, `expected an exercise name before "135x5"`},
+		{"bench 135x5\nsquat x5", 2, 7, "x5 needs a weight before it"},
+		{"bench 135x5x3x2", 1, 14, "too many x in set"},
+		{"bench 135stonex5", 1, 10, `unknown unit "stone", expected kg or lb`},
+		{"bench 135x5@heavy", 1, 13, "expected a weight"},
+		{"bench @8", 1, 7, "@ must follow a set"},
+		{"bench 135x0", 1, 11, `expected a whole number of reps or sets, got "0"`},
+		{"bench 135x5x101", 1, 13, "101 is more than 100"},
+		{"bench 100kg 110kg x5", 1, 7, "weight has no reps after it"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseShorthand(tt.text)
+		se, ok := err.(*ShorthandError)
+		if !ok {
+			t.Errorf("ParseShorthand(%q) error = %v, want a *ShorthandError", tt.text, err)
+			continue
+		}
+		if se.Line != tt.line || se.Column != tt.column || se.Message != tt.msg {
+			t.Errorf("ParseShorthand(%q) error = %d:%d %q, want %d:%d %q",
+				tt.text, se.Line, se.Column, se.Message, tt.line, tt.column, tt.msg)
+		}
+	}
+}
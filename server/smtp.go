@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// smtpTimeout bounds each command of an SMTP session.
+const smtpTimeout = 5 * time.Minute
+
+// smtpServer takes messages for Ingest from a local MTA or mail client. It
+// speaks just enough SMTP to be handed mail, only takes mail for users'
+// workout addresses and never relays. It has no authentication of its own,
+// so Validate keeps it on a loopback address.
+type smtpServer struct {
+	ln       net.Listener
+	hostname string
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	closing bool
+}
+
+// listenSMTP starts accepting SMTP connections on addr.
+func listenSMTP(addr string) (*smtpServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	s := &smtpServer{
+		ln:       ln,
+		hostname: hostname,
+		conns:    map[net.Conn]bool{},
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+
+	logger.Info("listening for mail", zap.String("addr", ln.Addr().String()))
+
+	return s, nil
+}
+
+func (s *smtpServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// close stops accepting connections and waits for open sessions to end.
+// Sessions finish the message they are handling but read nothing more.
+func (s *smtpServer) close() {
+	s.ln.Close()
+
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// extend gives the session another smtpTimeout for its next command, or
+// reports false once the server is closing.
+func (s *smtpServer) extend(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	return true
+}
+
+// handle runs one SMTP session.
+func (s *smtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+
+	var (
+		from  string
+		rcpts []string
+	)
+	reset := func() {
+		from = ""
+		rcpts = nil
+	}
+
+	if !s.extend(conn) {
+		return
+	}
+	tp.PrintfLine("220 %s workout_server ESMTP ready", s.hostname)
+
+	for {
+		if !s.extend(conn) {
+			tp.PrintfLine("421 4.3.2 shutting down")
+			return
+		}
+
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			reset()
+			tp.PrintfLine("250 %s", s.hostname)
+
+		case "EHLO":
+			reset()
+			tp.PrintfLine("250-%s", s.hostname)
+			tp.PrintfLine("250-SIZE %d", maxMailSize)
+			tp.PrintfLine("250 8BITMIME")
+
+		case "MAIL":
+			if !strings.HasPrefix(strings.ToUpper(arg), "FROM:") {
+				tp.PrintfLine("501 5.5.4 syntax: MAIL FROM:<address>")
+				continue
+			}
+			reset()
+			from = arg[len("FROM:"):]
+			tp.PrintfLine("250 2.1.0 OK")
+
+		case "RCPT":
+			if from == "" {
+				tp.PrintfLine("503 5.5.1 MAIL first")
+				continue
+			}
+			if !strings.HasPrefix(strings.ToUpper(arg), "TO:") {
+				tp.PrintfLine("501 5.5.4 syntax: RCPT TO:<address>")
+				continue
+			}
+			rcpt := strings.TrimSpace(arg[len("TO:"):])
+			if i := strings.IndexByte(rcpt, '>'); i >= 0 {
+				rcpt = rcpt[:i+1]
+			}
+
+			// Only mail for a user's workout address is taken.
+			if _, err := userByRecipient([]string{rcpt}); err != nil {
+				if _, ok := err.(*InputError); ok {
+					tp.PrintfLine("550 5.1.1 no such mailbox")
+				} else {
+					tp.PrintfLine("451 4.3.0 try again later")
+				}
+				continue
+			}
+			rcpts = append(rcpts, rcpt)
+			tp.PrintfLine("250 2.1.5 OK")
+
+		case "DATA":
+			if len(rcpts) == 0 {
+				tp.PrintfLine("503 5.5.1 RCPT first")
+				continue
+			}
+			tp.PrintfLine("354 end data with <CR><LF>.<CR><LF>")
+
+			dr := tp.DotReader()
+			data, err := ioutil.ReadAll(io.LimitReader(dr, maxMailSize+1))
+			if err != nil {
+				return
+			}
+			recipients := rcpts
+			reset()
+
+			if len(data) > maxMailSize {
+				// Drain the rest of the message before answering.
+				if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+					return
+				}
+				tp.PrintfLine("552 5.3.4 message too big")
+				continue
+			}
+
+			tp.PrintfLine("%s", smtpReply(ingestAndReply(bytes.NewReader(data), "smtp:"+conn.RemoteAddr().String(), recipients)))
+
+		case "RSET":
+			reset()
+			tp.PrintfLine("250 2.0.0 OK")
+
+		case "NOOP":
+			tp.PrintfLine("250 2.0.0 OK")
+
+		case "VRFY":
+			tp.PrintfLine("252 2.1.5 cannot verify")
+
+		case "QUIT":
+			tp.PrintfLine("221 2.0.0 bye")
+			return
+
+		default:
+			tp.PrintfLine("502 5.5.2 command not implemented")
+		}
+	}
+}
+
+// smtpReply is the answer to DATA for the outcome of ingesting the message.
+// Rejected messages fail permanently; anything else is worth retrying.
+func smtpReply(err error) string {
+	if err == nil {
+		return "250 2.0.0 message logged"
+	}
+
+	if ie, ok := err.(*InputError); ok {
+		if ie.Code == "unknown_recipient" {
+			return "550 5.7.1 " + ie.Message
+		}
+		return "554 5.6.0 " + ie.Message
+	}
+
+	return "451 4.3.0 could not store the workout, try again later"
+}
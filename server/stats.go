@@ -0,0 +1,96 @@
+package server
+
+import (
+	"math"
+	"sort"
+)
+
+// effectiveLoad is the weight a set moves. Bodyweight sets move bw, the
+// lifter's bodyweight on the day, plus or minus their weight.
+func effectiveLoad(set Set, bw float64) float64 {
+	switch set.Type {
+	case SetBodyweight:
+		return bw
+	case SetWeighted:
+		return bw + set.Weight
+	case SetAssisted:
+		return math.Max(bw-set.Weight, 0)
+	}
+
+	return set.Weight
+}
+
+// volume is the total weight moved across sets.
+func volume(sets []Set, bw float64) float64 {
+	var total float64
+	for _, set := range sets {
+		total += effectiveLoad(set, bw) * float64(set.Reps)
+	}
+
+	return total
+}
+
+// topSet returns the set that moved the most weight, preferring more reps on
+// a tie.
+func topSet(sets []Set, bw float64) (Set, bool) {
+	if len(sets) == 0 {
+		return Set{}, false
+	}
+
+	top := sets[0]
+	for _, set := range sets[1:] {
+		load, topLoad := effectiveLoad(set, bw), effectiveLoad(top, bw)
+		if load > topLoad || (load == topLoad && set.Reps > top.Reps) {
+			top = set
+		}
+	}
+
+	return top, true
+}
+
+// loadKey identifies the weight of a set independently of bodyweight, so a
+// pull-up with 20kg added is told apart from one with 20kg of assistance.
+type loadKey struct {
+	Type   string
+	Weight float64
+}
+
+func keyOf(set Set) loadKey {
+	return loadKey{
+		Type:   set.Type,
+		Weight: set.Weight,
+	}
+}
+
+// repsByWeight totals the reps performed at each weight.
+func repsByWeight(sets []Set) map[loadKey]int {
+	reps := map[loadKey]int{}
+	for _, set := range sets {
+		reps[keyOf(set)] += set.Reps
+	}
+
+	return reps
+}
+
+// sortedWeights returns the weights of one or more rep maps in ascending
+// order, plain weights first.
+func sortedWeights(maps ...map[loadKey]int) []loadKey {
+	seen := map[loadKey]bool{}
+	var weights []loadKey
+	for _, m := range maps {
+		for weight := range m {
+			if !seen[weight] {
+				seen[weight] = true
+				weights = append(weights, weight)
+			}
+		}
+	}
+	sort.Slice(weights, func(i, j int) bool {
+		if weights[i].Type != weights[j].Type {
+			return weights[i].Type < weights[j].Type
+		}
+		return weights[i].Weight < weights[j].Weight
+	})
+
+	return weights
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// ErrNotFound is returned by a WorkoutStore when no document exists for a day.
+var ErrNotFound = errors.New("document not found")
+
+// ErrConflict is returned by a WorkoutStore when a write keeps losing a race
+// with concurrent writers to the same day.
+var ErrConflict = errors.New("document was modified concurrently")
+
+// expirySweepInterval bounds how often the memory and file stores look for
+// expired auxiliary records to remove. Reads never return an expired record
+// whether or not it has been swept yet.
+const expirySweepInterval = time.Minute
+
+// WorkoutStore is the storage layer for day documents. Documents are keyed by
+// their date in YYYY-MM-DD form.
+type WorkoutStore interface {
+	// User returns the view of the store holding only the user's documents
+	// and auxiliary records. The view shares the underlying connection.
+	User(id string) WorkoutStore
+	// Get returns the document stored for the day.
+	Get(date string) (*Document, error)
+	// Upsert replaces the document stored for the day.
+	Upsert(date string, doc *Document) error
+	// Merge adds the exercises in doc to the document stored for the day,
+	// creating it if needed, and returns the merged result.
+	Merge(date string, doc *Document) (*Document, error)
+	// Update replaces the document stored for the day with what fn makes
+	// of it. fn is given the stored document, or nil when there is none, and
+	// returns the new one, or nil to delete the day. fn may change the
+	// document it is given and return it. When another writer changes the day
+	// between the read and the write, fn is called again on a fresh read,
+	// and when that keeps happening Update returns ErrConflict. Errors from
+	// fn are returned as they are. The result is what fn returned. fn must
+	// not use the store, which may be locked while it runs.
+	Update(date string, fn func(doc *Document) (*Document, error)) (*Document, error)
+	// Range returns every document between from and to inclusive, sorted by date.
+	Range(from, to string) ([]*Document, error)
+	// Delete removes the document stored for the day.
+	Delete(date string) error
+	// GetMeta decodes the auxiliary record stored under key into v. Auxiliary
+	// records hold derived and bookkeeping data that is not a day document.
+	GetMeta(key string, v interface{}) error
+	// PutMeta stores v as the auxiliary record under key.
+	PutMeta(key string, v interface{}) error
+	// UpdateMeta changes the auxiliary record under key with fn, guarded
+	// against concurrent writers as Update is. v points to a value the
+	// record is decoded into, reset to its zero value when there is none,
+	// before each call of fn, which changes it in place; v is then stored
+	// under key. When another writer changes the record first, fn is called
+	// again on a fresh read, and when that keeps happening UpdateMeta returns
+	// ErrConflict. Errors from fn are returned as they are, and fn must not
+	// use the store.
+	UpdateMeta(key string, v interface{}, fn func() error) error
+	// PutMetaExpiring stores v as the auxiliary record under key until ttl
+	// has passed, after which the store forgets it as if it were deleted.
+	PutMetaExpiring(key string, v interface{}, ttl time.Duration) error
+	// DeleteMeta removes the auxiliary record stored under key.
+	DeleteMeta(key string) error
+	// Close releases any resources held by the store.
+	Close() error
+}
+
+// OpenStore opens the store selected by the configuration.
+func OpenStore(cfg Config) (WorkoutStore, error) {
+	switch cfg.Store {
+	case "couchbase":
+		return NewCouchbaseStore(cfg.Couchbase)
+
+	case "memory":
+		return NewMemoryStore(), nil
+
+	case "file":
+		return NewFileStore(cfg.DataDir)
+
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// resetValue sets the value v points to to its zero value, so a record can
+// be decoded into it afresh.
+func resetValue(v interface{}) {
+	rv := reflect.ValueOf(v).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+}
+
+// newDocument returns an empty document for the day, first inserted by doc.
+func newDocument(date string, doc *Document) *Document {
+	return &Document{
+		Version:       SchemaVersion,
+		InsertionDate: doc.InsertionDate,
+		Date:          date,
+		Exercises:     map[string][]Set{},
+	}
+}
+
+// mergeExercises appends the sets in src to dst, exercise by exercise, and
+// the activities in src to those of dst. A weigh-in in src replaces that of
+// dst.
+func mergeExercises(dst, src *Document) {
+	if dst.Exercises == nil {
+		dst.Exercises = map[string][]Set{}
+	}
+
+	for exName, sets := range src.Exercises {
+		dst.Exercises[exName] = append(dst.Exercises[exName], sets...)
+	}
+
+	dst.Activities = append(dst.Activities, src.Activities...)
+
+	if src.Bodyweight != nil {
+		w := *src.Bodyweight
+		dst.Bodyweight = &w
+	}
+}
+
+// dateRange calls fn for each day between from and to inclusive.
+func dateRange(from, to string, fn func(date string) error) error {
+	start, err := time.Parse(dateLayout, from)
+	if err != nil {
+		return err
+	}
+
+	end, err := time.Parse(dateLayout, to)
+	if err != nil {
+		return err
+	}
+
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		if err := fn(day.Format(dateLayout)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStores opens each store that runs without a server, calling fn with
+// a fresh one.
+func testStores(t *testing.T, fn func(name string, s WorkoutStore)) {
+	t.Helper()
+
+	fn("memory", NewMemoryStore())
+
+	dir, err := ioutil.TempDir("", "workout_server")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore: %v", err)
+	}
+	fn("file", fs)
+}
+
+// reps returns the reps of the day's sets of exName, or nil without a day.
+func reps(t *testing.T, s WorkoutStore, date, exName string) []int {
+	t.Helper()
+
+	doc, err := s.Get(date)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Get(%s): %v", date, err)
+	}
+
+	got := []int{}
+	for _, set := range doc.Exercises[exName] {
+		got = append(got, set.Reps)
+	}
+
+	return got
+}
+
+// testDay is a day with a set of exName at 100kg for each of reps.
+func testDay(date, exName string, reps ...int) *Document {
+	doc := &Document{
+		Version:   SchemaVersion,
+		Date:      date,
+		Exercises: map[string][]Set{},
+	}
+	for _, r := range reps {
+		doc.Exercises[exName] = append(doc.Exercises[exName], Set{Weight: 100, Unit: UnitKg, Reps: r})
+	}
+
+	return doc
+}
+
+func TestStoreDocuments(t *testing.T) {
+	type op struct {
+		kind string
+		date string
+		reps []int
+		err  error
+	}
+
+	tests := []struct {
+		name string
+		ops  []op
+		// want maps each date to the reps stored on it, nil when the day
+		// has no document.
+		want map[string][]int
+	}{
+		{
+			name: "merge creates the day",
+			ops:  []op{{kind: "merge", date: "2026-01-05", reps: []int{5}}},
+			want: map[string][]int{"2026-01-05": {5}},
+		},
+		{
+			name: "merge appends in order",
+			ops: []op{
+				{kind: "merge", date: "2026-01-05", reps: []int{5, 4}},
+				{kind: "merge", date: "2026-01-05", reps: []int{3}},
+			},
+			want: map[string][]int{"2026-01-05": {5, 4, 3}},
+		},
+		{
+			name: "upsert replaces",
+			ops: []op{
+				{kind: "merge", date: "2026-01-05", reps: []int{5}},
+				{kind: "upsert", date: "2026-01-05", reps: []int{8}},
+			},
+			want: map[string][]int{"2026-01-05": {8}},
+		},
+		{
+			name: "delete removes only its day",
+			ops: []op{
+				{kind: "upsert", date: "2026-01-05", reps: []int{5}},
+				{kind: "upsert", date: "2026-01-06", reps: []int{6}},
+				{kind: "delete", date: "2026-01-05"},
+			},
+			want: map[string][]int{"2026-01-05": nil, "2026-01-06": {6}},
+		},
+		{
+			name: "delete of a missing day",
+			ops:  []op{{kind: "delete", date: "2026-01-05", err: ErrNotFound}},
+			want: map[string][]int{"2026-01-05": nil},
+		},
+	}
+
+	for _, tt := range tests {
+		testStores(t, func(name string, s WorkoutStore) {
+			for _, o := range tt.ops {
+				var err error
+				switch o.kind {
+				case "merge":
+					_, err = s.Merge(o.date, testDay(o.date, "squat", o.reps...))
+				case "upsert":
+					err = s.Upsert(o.date, testDay(o.date, "squat", o.reps...))
+				case "delete":
+					err = s.Delete(o.date)
+				}
+				if err != o.err {
+					t.Errorf("%s %s: %s(%s) error = %v, want %v", name, tt.name, o.kind, o.date, err, o.err)
+				}
+			}
+
+			for date, want := range tt.want {
+				if got := reps(t, s, date, "squat"); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s %s: reps on %s = %v, want %v", name, tt.name, date, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreRange(t *testing.T) {
+	testStores(t, func(name string, s WorkoutStore) {
+		for _, date := range []string{"2026-01-07", "2026-01-03", "2026-01-05", "2026-01-10"} {
+			if err := s.Upsert(date, testDay(date, "squat", 5)); err != nil {
+				t.Fatalf("%s: Upsert: %v", name, err)
+			}
+		}
+		// Another user's days are not part of the shared keyspace.
+		if err := s.User("al").Upsert("2026-01-06", testDay("2026-01-06", "squat", 5)); err != nil {
+			t.Fatalf("%s: Upsert: %v", name, err)
+		}
+
+		tests := []struct {
+			from, to string
+			want     []string
+		}{
+			{"2026-01-01", "2026-01-31", []string{"2026-01-03", "2026-01-05", "2026-01-07", "2026-01-10"}},
+			{"2026-01-05", "2026-01-07", []string{"2026-01-05", "2026-01-07"}},
+			{"2026-01-08", "2026-01-09", nil},
+		}
+
+		for _, tt := range tests {
+			docs, err := s.Range(tt.from, tt.to)
+			if err != nil {
+				t.Errorf("%s: Range(%s, %s): %v", name, tt.from, tt.to, err)
+				continue
+			}
+
+			var got []string
+			for _, doc := range docs {
+				got = append(got, doc.Date)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: Range(%s, %s) = %v, want %v", name, tt.from, tt.to, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestStoreUserViews(t *testing.T) {
+	testStores(t, func(name string, s WorkoutStore) {
+		al, bo := s.User("al"), s.User("bo")
+
+		if err := al.Upsert("2026-01-05", testDay("2026-01-05", "squat", 5)); err != nil {
+			t.Fatalf("%s: Upsert: %v", name, err)
+		}
+		if err := al.PutMeta("prs", map[string]int{"squat": 1}); err != nil {
+			t.Fatalf("%s: PutMeta: %v", name, err)
+		}
+
+		for view, want := range map[string][]int{"al": {5}, "bo": nil, "shared": nil} {
+			v := map[string]WorkoutStore{"al": al, "bo": bo, "shared": s}[view]
+			if got := reps(t, v, "2026-01-05", "squat"); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: %s's reps = %v, want %v", name, view, got, want)
+			}
+		}
+
+		var prs map[string]int
+		if err := bo.GetMeta("prs", &prs); err != ErrNotFound {
+			t.Errorf("%s: bo's GetMeta error = %v, want %v", name, err, ErrNotFound)
+		}
+		if err := s.User("al").GetMeta("prs", &prs); err != nil || prs["squat"] != 1 {
+			t.Errorf("%s: al's GetMeta = %v, %v", name, prs, err)
+		}
+	})
+}
+
+func TestStoreMeta(t *testing.T) {
+	testStores(t, func(name string, s WorkoutStore) {
+		type record struct {
+			N int `json:"n"`
+		}
+
+		var got record
+		if err := s.GetMeta("a", &got); err != ErrNotFound {
+			t.Errorf("%s: GetMeta of a missing record error = %v", name, err)
+		}
+
+		if err := s.PutMeta("a", record{1}); err != nil {
+			t.Fatalf("%s: PutMeta: %v", name, err)
+		}
+		if err := s.GetMeta("a", &got); err != nil || got.N != 1 {
+			t.Errorf("%s: GetMeta = %+v, %v, want n 1", name, got, err)
+		}
+
+		// An expiring write replaces the record until it lapses.
+		if err := s.PutMetaExpiring("a", record{2}, time.Hour); err != nil {
+			t.Fatalf("%s: PutMetaExpiring: %v", name, err)
+		}
+		if err := s.GetMeta("a", &got); err != nil || got.N != 2 {
+			t.Errorf("%s: GetMeta = %+v, %v, want n 2", name, got, err)
+		}
+
+		if err := s.PutMetaExpiring("b", record{3}, time.Nanosecond); err != nil {
+			t.Fatalf("%s: PutMetaExpiring: %v", name, err)
+		}
+		time.Sleep(time.Millisecond)
+		if err := s.GetMeta("b", &got); err != ErrNotFound {
+			t.Errorf("%s: GetMeta of a lapsed record error = %v, want %v", name, err, ErrNotFound)
+		}
+
+		if err := s.DeleteMeta("a"); err != nil {
+			t.Errorf("%s: DeleteMeta: %v", name, err)
+		}
+		if err := s.DeleteMeta("a"); err != ErrNotFound {
+			t.Errorf("%s: DeleteMeta of a deleted record error = %v, want %v", name, err, ErrNotFound)
+		}
+		if err := s.DeleteMeta("b"); err != ErrNotFound {
+			t.Errorf("%s: DeleteMeta of a lapsed record error = %v, want %v", name, err, ErrNotFound)
+		}
+	})
+}
+
+func TestStoreCopies(t *testing.T) {
+	testStores(t, func(name string, s WorkoutStore) {
+		doc := testDay("2026-01-05", "squat", 5)
+		if err := s.Upsert("2026-01-05", doc); err != nil {
+			t.Fatalf("%s: Upsert: %v", name, err)
+		}
+
+		// Changing what was written or read must not change what is stored.
+		doc.Exercises["squat"][0].Reps = 1
+		got, err := s.Get("2026-01-05")
+		if err != nil {
+			t.Fatalf("%s: Get: %v", name, err)
+		}
+		got.Exercises["squat"][0].Reps = 2
+
+		if r := reps(t, s, "2026-01-05", "squat"); !reflect.DeepEqual(r, []int{5}) {
+			t.Errorf("%s: reps = %v, want [5]", name, r)
+		}
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	errEdit := errors.New("edit failed")
+
+	add := func(r int) func(*Document) (*Document, error) {
+		return func(doc *Document) (*Document, error) {
+			if doc == nil {
+				doc = testDay("2026-01-05", "squat")
+			}
+			doc.Exercises["squat"] = append(doc.Exercises["squat"], Set{Weight: 100, Unit: UnitKg, Reps: r})
+			return doc, nil
+		}
+	}
+	remove := func(*Document) (*Document, error) { return nil, nil }
+	fail := func(*Document) (*Document, error) { return nil, errEdit }
+
+	tests := []struct {
+		name string
+		fns  []func(*Document) (*Document, error)
+		err  error
+		want []int
+	}{
+		{"creates the day", []func(*Document) (*Document, error){add(5)}, nil, []int{5}},
+		{"changes the stored day", []func(*Document) (*Document, error){add(5), add(3)}, nil, []int{5, 3}},
+		{"deletes the day", []func(*Document) (*Document, error){add(5), remove}, nil, nil},
+		{"deleting a missing day", []func(*Document) (*Document, error){remove}, nil, nil},
+		{"an error writes nothing", []func(*Document) (*Document, error){add(5), fail}, errEdit, []int{5}},
+	}
+
+	for _, tt := range tests {
+		testStores(t, func(name string, s WorkoutStore) {
+			var err error
+			for _, fn := range tt.fns {
+				_, err = s.Update("2026-01-05", fn)
+			}
+			if err != tt.err {
+				t.Errorf("%s %s: Update error = %v, want %v", name, tt.name, err, tt.err)
+			}
+			if got := reps(t, s, "2026-01-05", "squat"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s %s: reps = %v, want %v", name, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateConcurrent(t *testing.T) {
+	const writers = 20
+
+	testStores(t, func(name string, s WorkoutStore) {
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+
+				_, err := s.Update("2026-01-05", func(doc *Document) (*Document, error) {
+					if doc == nil {
+						doc = testDay("2026-01-05", "squat")
+					}
+					doc.Exercises["squat"] = append(doc.Exercises["squat"], Set{Weight: 100, Unit: UnitKg, Reps: r})
+					return doc, nil
+				})
+				if err != nil {
+					t.Errorf("%s: Update: %v", name, err)
+				}
+			}(i + 1)
+		}
+		wg.Wait()
+
+		if got := reps(t, s, "2026-01-05", "squat"); len(got) != writers {
+			t.Errorf("%s: %d sets stored, want %d", name, len(got), writers)
+		}
+	})
+}
+
+func TestStoreUpdateMeta(t *testing.T) {
+	const writers = 20
+
+	testStores(t, func(name string, s WorkoutStore) {
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+
+				var ns []int
+				if err := s.UpdateMeta("ns", &ns, func() error {
+					ns = append(ns, n)
+					return nil
+				}); err != nil {
+					t.Errorf("%s: UpdateMeta: %v", name, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		var ns []int
+		if err := s.GetMeta("ns", &ns); err != nil {
+			t.Fatalf("%s: GetMeta: %v", name, err)
+		}
+		if len(ns) != writers {
+			t.Errorf("%s: %d values stored, want %d", name, len(ns), writers)
+		}
+
+		// A failed update writes nothing, and v starts from the record.
+		errEdit := errors.New("edit failed")
+		err := s.UpdateMeta("ns", &ns, func() error {
+			if len(ns) != writers {
+				t.Errorf("%s: UpdateMeta read %d values, want %d", name, len(ns), writers)
+			}
+			ns = nil
+			return errEdit
+		})
+		if err != errEdit {
+			t.Errorf("%s: UpdateMeta error = %v, want %v", name, err, errEdit)
+		}
+		if err := s.GetMeta("ns", &ns); err != nil || len(ns) != writers {
+			t.Errorf("%s: %d values stored after a failed update, want %d (err %v)", name, len(ns), writers, err)
+		}
+	})
+}
+
+func TestFileStoreSharedDirectory(t *testing.T) {
+	const writers = 10
+
+	dir, err := ioutil.TempDir("", "workout_server")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Stores opened separately on one directory, as by two processes, do
+	// not lose each other's updates.
+	var stores []WorkoutStore
+	for i := 0; i < 2; i++ {
+		s, err := NewFileStore(dir)
+		if err != nil {
+			t.Fatalf("NewFileStore: %v", err)
+		}
+		stores = append(stores, s)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		for _, s := range stores {
+			wg.Add(1)
+			go func(s WorkoutStore, r int) {
+				defer wg.Done()
+
+				if _, err := s.Merge("2026-01-05", testDay("2026-01-05", "squat", r)); err != nil {
+					t.Errorf("Merge: %v", err)
+				}
+
+				var ns []int
+				if err := s.UpdateMeta("ns", &ns, func() error {
+					ns = append(ns, r)
+					return nil
+				}); err != nil {
+					t.Errorf("UpdateMeta: %v", err)
+				}
+			}(s, i+1)
+		}
+	}
+	wg.Wait()
+
+	if got := reps(t, stores[0], "2026-01-05", "squat"); len(got) != 2*writers {
+		t.Errorf("%d sets stored, want %d", len(got), 2*writers)
+	}
+
+	var ns []int
+	if err := stores[1].GetMeta("ns", &ns); err != nil || len(ns) != 2*writers {
+		t.Errorf("%d values stored, want %d (err %v)", len(ns), 2*writers, err)
+	}
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GPS file formats ImportTrack reads.
+const (
+	FormatGPX = "gpx"
+	FormatTCX = "tcx"
+)
+
+const (
+	// earthRadius is the mean radius of the earth in metres.
+	earthRadius = 6371008.8
+
+	// minMovingSpeed is the speed in metres a second below which the time
+	// between two points is counted as stopped.
+	minMovingSpeed = 0.5
+
+	// climbThreshold is how far in metres the elevation must rise before
+	// the climb counts, so GPS noise on the flat does not add up to a hill.
+	climbThreshold = 2
+
+	splitDistance = 1000
+)
+
+// trackPoint is one recorded position. dist is the distance from the start
+// the device recorded, or -1 when it did not.
+type trackPoint struct {
+	time     time.Time
+	lat, lon float64
+	hasPos   bool
+	ele      float64
+	hasEle   bool
+	hr       int
+	dist     float64
+}
+
+// track is the points of a GPS file along with what the file says about the
+// activity as a whole.
+type track struct {
+	sport    string
+	calories int
+	points   []trackPoint
+}
+
+type gpxFile struct {
+	Tracks []struct {
+		Type     string `xml:"type"`
+		Segments []struct {
+			Points []struct {
+				Lat  float64  `xml:"lat,attr"`
+				Lon  float64  `xml:"lon,attr"`
+				Ele  *float64 `xml:"ele"`
+				Time string   `xml:"time"`
+				HR   int      `xml:"extensions>TrackPointExtension>hr"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+type tcxFile struct {
+	Activities []struct {
+		Sport string `xml:"Sport,attr"`
+		Laps  []struct {
+			Calories int `xml:"Calories"`
+			Points   []struct {
+				Time     string   `xml:"Time"`
+				Lat      *float64 `xml:"Position>LatitudeDegrees"`
+				Lon      *float64 `xml:"Position>LongitudeDegrees"`
+				Altitude *float64 `xml:"AltitudeMeters"`
+				Distance *float64 `xml:"DistanceMeters"`
+				HR       int      `xml:"HeartRateBpm>Value"`
+			} `xml:"Track>Trackpoint"`
+		} `xml:"Lap"`
+	} `xml:"Activities>Activity"`
+}
+
+// sniffFormat returns the format of a GPS file from its root element.
+func sniffFormat(data []byte) string {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			switch start.Name.Local {
+			case "gpx":
+				return FormatGPX
+			case "TrainingCenterDatabase":
+				return FormatTCX
+			}
+			return ""
+		}
+	}
+}
+
+// parseTrack reads a GPX or TCX file. Every track of the file is read as
+// part of one activity.
+func parseTrack(format string, data []byte) (*track, error) {
+	t := &track{}
+
+	switch format {
+	case FormatGPX:
+		var f gpxFile
+		if err := xml.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+
+		for _, trk := range f.Tracks {
+			if t.sport == "" {
+				t.sport = trk.Type
+			}
+			for _, seg := range trk.Segments {
+				for _, p := range seg.Points {
+					point := trackPoint{
+						lat:    p.Lat,
+						lon:    p.Lon,
+						hasPos: true,
+						hr:     p.HR,
+						dist:   -1,
+					}
+					if p.Ele != nil {
+						point.ele, point.hasEle = *p.Ele, true
+					}
+					if err := parseTrackTime(p.Time, &point); err != nil {
+						return nil, err
+					}
+					t.points = append(t.points, point)
+				}
+			}
+		}
+
+	case FormatTCX:
+		var f tcxFile
+		if err := xml.Unmarshal(data, &f); err != nil {
+			return nil, err
+		}
+
+		for _, activity := range f.Activities {
+			if t.sport == "" {
+				t.sport = activity.Sport
+			}
+			for _, lap := range activity.Laps {
+				t.calories += lap.Calories
+				for _, p := range lap.Points {
+					point := trackPoint{
+						hr:   p.HR,
+						dist: -1,
+					}
+					if p.Lat != nil && p.Lon != nil {
+						point.lat, point.lon, point.hasPos = *p.Lat, *p.Lon, true
+					}
+					if p.Altitude != nil {
+						point.ele, point.hasEle = *p.Altitude, true
+					}
+					if p.Distance != nil {
+						point.dist = *p.Distance
+					}
+					if err := parseTrackTime(p.Time, &point); err != nil {
+						return nil, err
+					}
+					t.points = append(t.points, point)
+				}
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	// Points without a time cannot be placed in the activity.
+	timed := t.points[:0]
+	for _, p := range t.points {
+		if !p.time.IsZero() {
+			timed = append(timed, p)
+		}
+	}
+	t.points = timed
+
+	if len(t.points) < 2 {
+		return nil, fmt.Errorf("the file has fewer than two timed points")
+	}
+
+	return t, nil
+}
+
+func parseTrackTime(raw string, p *trackPoint) error {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return fmt.Errorf("invalid time %q", raw)
+	}
+	p.time = t
+
+	return nil
+}
+
+// haversine returns the distance in metres between two positions.
+func haversine(a, b trackPoint) float64 {
+	rad := math.Pi / 180
+	dLat := (b.lat - a.lat) * rad
+	dLon := (b.lon - a.lon) * rad
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.lat*rad)*math.Cos(b.lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// activity works out the activity the track records: its distance, moving
+// time, elevation gain, heart rate and kilometre splits. The last split is
+// whatever is left after the last full kilometre.
+func (t *track) activity() Activity {
+	points := t.points
+	start, end := points[0].time, points[len(points)-1].time
+
+	a := Activity{
+		Type:      sportType(t.sport),
+		Duration:  round(end.Sub(start).Seconds(), 1),
+		Calories:  t.calories,
+		Timestamp: start.UTC(),
+	}
+
+	var (
+		distance, moving, gain float64
+		hrSum, hrCount         int
+		climbFrom              float64
+		hasClimbFrom           bool
+
+		splitStart             = start
+		splitHRSum, splitHRCnt int
+	)
+
+	for i, p := range points {
+		if p.hr > 0 {
+			hrSum += p.hr
+			hrCount++
+			splitHRSum += p.hr
+			splitHRCnt++
+			if p.hr > a.MaxHeartRate {
+				a.MaxHeartRate = p.hr
+			}
+		}
+
+		if p.hasEle {
+			switch {
+			case !hasClimbFrom || p.ele < climbFrom:
+				climbFrom, hasClimbFrom = p.ele, true
+			case p.ele-climbFrom >= climbThreshold:
+				gain += p.ele - climbFrom
+				climbFrom = p.ele
+			}
+		}
+
+		if i == 0 {
+			continue
+		}
+		prev := points[i-1]
+
+		var step float64
+		switch {
+		case p.dist >= 0 && prev.dist >= 0:
+			step = math.Max(p.dist-prev.dist, 0)
+		case p.hasPos && prev.hasPos:
+			step = haversine(prev, p)
+		}
+
+		dt := p.time.Sub(prev.time).Seconds()
+		if dt > 0 && step/dt >= minMovingSpeed {
+			moving += dt
+		}
+
+		// Close every split the step crossed, placing the crossing in time
+		// by the share of the step before it.
+		for step > 0 && distance+step >= float64(len(a.Splits)+1)*splitDistance {
+			mark := float64(len(a.Splits)+1) * splitDistance
+			at := prev.time.Add(time.Duration((mark - distance) / step * dt * float64(time.Second)))
+
+			split := Split{
+				Duration: round(at.Sub(splitStart).Seconds(), 1),
+				Distance: splitDistance,
+			}
+			if splitHRCnt > 0 {
+				split.AvgHeartRate = splitHRSum / splitHRCnt
+			}
+			a.Splits = append(a.Splits, split)
+
+			splitStart, splitHRSum, splitHRCnt = at, 0, 0
+		}
+
+		distance += step
+	}
+
+	if rest := distance - float64(len(a.Splits))*splitDistance; rest >= 1 && len(a.Splits) > 0 {
+		split := Split{
+			Duration: round(end.Sub(splitStart).Seconds(), 1),
+			Distance: round(rest, 1),
+		}
+		if splitHRCnt > 0 {
+			split.AvgHeartRate = splitHRSum / splitHRCnt
+		}
+		a.Splits = append(a.Splits, split)
+	}
+
+	a.Distance = round(distance, 1)
+	a.MovingTime = round(moving, 1)
+	a.ElevationGain = round(gain, 1)
+	if hrCount > 0 {
+		a.AvgHeartRate = hrSum / hrCount
+	}
+
+	return a
+}
+
+// sportType maps the sport a GPS file names, such as GPX's "running" or
+// TCX's "Biking", to an activity type.
+func sportType(sport string) string {
+	sport = strings.ToLower(sport)
+
+	switch {
+	case strings.Contains(sport, "run"):
+		return ActivityRun
+	case strings.Contains(sport, "bik"), strings.Contains(sport, "cycl"), strings.Contains(sport, "ride"):
+		return ActivityBike
+	case strings.Contains(sport, "hik"):
+		return ActivityHike
+	case strings.Contains(sport, "walk"):
+		return ActivityWalk
+	case strings.Contains(sport, "swim"):
+		return ActivitySwim
+	case strings.Contains(sport, "row"):
+		return ActivityRow
+	case strings.Contains(sport, "ski"):
+		return ActivitySki
+	}
+
+	return ActivityOther
+}
+
+// ImportTrack logs the activity recorded in a GPX or TCX file on the day it
+// started in loc, as Log does under session. An empty format is read from
+// the file, and typ overrides the activity type the file gives. A file that
+// was already imported is not added again, even when loc puts it on another
+// day; the response is then the day holding it and counts it in
+// DuplicateActivities.
+func ImportTrack(user, session, format string, data []byte, typ string, loc *time.Location) (*WriteResponse, error) {
+	if format == "" {
+		format = sniffFormat(data)
+	}
+	format = strings.ToLower(format)
+	if format != FormatGPX && format != FormatTCX {
+		return nil, &InputError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_format",
+			Message: "the file must be GPX or TCX",
+			Fields: []FieldError{{
+				Field:   "format",
+				Message: "must be gpx or tcx",
+			}},
+		}
+	}
+
+	t, err := parseTrack(format, data)
+	if err != nil {
+		return nil, &InputError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_track",
+			Message: "could not read the " + strings.ToUpper(format) + " file: " + err.Error(),
+		}
+	}
+
+	sum := sha256.Sum256(data)
+
+	activity := t.activity()
+	activity.Source = format + ":" + hex.EncodeToString(sum[:])
+	if typ != "" {
+		activity.Type = typ
+	}
+
+	return Log(user, session, &Document{
+		Date:       activity.Timestamp.In(loc).Format(dateLayout),
+		Exercises:  map[string][]Set{},
+		Activities: []Activity{activity},
+	}, loc)
+}
+
+// maxTrackSize bounds an uploaded GPS file; hours of one-second points fit
+// well within it.
+const maxTrackSize = 32 << 20
+
+// importTrack serves POST /v1/activities/import. The file is the request
+// body or, in a multipart form, the file field. The format query parameter
+// is gpx or tcx and is read from the file when it is missing; type overrides
+// the activity type.
+func importTrack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxTrackSize)
+
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read the file field: "+err.Error())
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(body); err != nil {
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
+	}
+
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	resp, err := ImportTrack(requestUser(r), requestSession(r), query.Get("format"), buf.Bytes(), query.Get("type"), loc)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.Response(resp))
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcxPoint is a trackpoint of a test TCX file, sec seconds after the start.
+type tcxPoint struct {
+	sec  int
+	dist float64
+	alt  float64
+	hr   int
+}
+
+func tcxFixture(sport string, calories int, points ...tcxPoint) []byte {
+	start := time.Date(2026, 1, 5, 7, 0, 0, 0, time.UTC)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0"?><TrainingCenterDatabase><Activities><Activity Sport=%q><Lap><Calories>%d</Calories><Track>`, sport, calories)
+	for _, p := range points {
+		fmt.Fprintf(&b, `<Trackpoint><Time>%s</Time><AltitudeMeters>%g</AltitudeMeters><DistanceMeters>%g</DistanceMeters><HeartRateBpm><Value>%d</Value></HeartRateBpm></Trackpoint>`,
+			start.Add(time.Duration(p.sec)*time.Second).Format(time.RFC3339), p.alt, p.dist, p.hr)
+	}
+	b.WriteString(`</Track></Lap></Activity></Activities></TrainingCenterDatabase>`)
+
+	return []byte(b.String())
+}
+
+// gpxPoint is a trackpoint of a test GPX file on the equator, sec seconds
+// after the start.
+type gpxPoint struct {
+	sec int
+	lon float64
+	ele float64
+}
+
+func gpxFixture(typ string, points ...gpxPoint) []byte {
+	start := time.Date(2026, 1, 5, 7, 0, 0, 0, time.UTC)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<?xml version="1.0"?><gpx version="1.1"><trk><type>%s</type><trkseg>`, typ)
+	for _, p := range points {
+		fmt.Fprintf(&b, `<trkpt lat="0" lon="%g"><ele>%g</ele><time>%s</time></trkpt>`,
+			p.lon, p.ele, start.Add(time.Duration(p.sec)*time.Second).Format(time.RFC3339))
+	}
+	b.WriteString(`</trkseg></trk></gpx>`)
+
+	return []byte(b.String())
+}
+
+func TestTrackActivityTCX(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want Activity
+	}{
+		{
+			name: "splits close where the distance crosses each kilometre",
+			data: tcxFixture("Running", 200,
+				tcxPoint{0, 0, 100, 120},
+				tcxPoint{150, 500, 101, 130},
+				tcxPoint{300, 1000, 103, 140},
+				tcxPoint{450, 1500, 102, 150},
+				tcxPoint{750, 2500, 105, 160},
+			),
+			want: Activity{
+				Type:          ActivityRun,
+				Duration:      750,
+				MovingTime:    750,
+				Distance:      2500,
+				ElevationGain: 6,
+				AvgHeartRate:  140,
+				MaxHeartRate:  160,
+				Calories:      200,
+				Splits: []Split{
+					{Duration: 300, Distance: 1000, AvgHeartRate: 130},
+					{Duration: 300, Distance: 1000, AvgHeartRate: 155},
+					{Duration: 150, Distance: 500},
+				},
+			},
+		},
+		{
+			name: "stops are left out of the moving time",
+			data: tcxFixture("Biking", 0,
+				tcxPoint{0, 0, 50, 0},
+				tcxPoint{100, 400, 50, 0},
+				tcxPoint{200, 400, 50, 0},
+			),
+			want: Activity{
+				Type:       ActivityBike,
+				Duration:   200,
+				MovingTime: 100,
+				Distance:   400,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tr, err := parseTrack(FormatTCX, tt.data)
+		if err != nil {
+			t.Errorf("%s: parseTrack: %v", tt.name, err)
+			continue
+		}
+
+		got := tr.activity()
+		got.Timestamp = time.Time{}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: activity = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrackActivityGPX(t *testing.T) {
+	// 0.0045 degrees of longitude on the equator is about 500.38m.
+	step := earthRadius * math.Pi / 180 * 0.0045
+
+	tests := []struct {
+		name   string
+		data   []byte
+		gain   float64
+		splits []float64
+	}{
+		{
+			name: "elevation noise is not a climb",
+			data: gpxFixture("running",
+				gpxPoint{0, 0, 10},
+				gpxPoint{120, 0.0045, 11},
+				gpxPoint{240, 0.009, 10},
+				gpxPoint{360, 0.0135, 11},
+			),
+			gain:   0,
+			splits: []float64{1000, round(3*step-1000, 1)},
+		},
+		{
+			name: "climbs count from the lowest point since the last",
+			data: gpxFixture("hiking",
+				gpxPoint{0, 0, 10},
+				gpxPoint{120, 0.0045, 13},
+				gpxPoint{240, 0.009, 12},
+				gpxPoint{360, 0.0135, 16},
+			),
+			gain:   7,
+			splits: []float64{1000, round(3*step-1000, 1)},
+		},
+		{
+			name: "no splits under a kilometre",
+			data: gpxFixture("walk",
+				gpxPoint{0, 0, 10},
+				gpxPoint{600, 0.0045, 10},
+			),
+			gain: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		tr, err := parseTrack(FormatGPX, tt.data)
+		if err != nil {
+			t.Errorf("%s: parseTrack: %v", tt.name, err)
+			continue
+		}
+
+		got := tr.activity()
+		if got.ElevationGain != tt.gain {
+			t.Errorf("%s: elevation gain = %v, want %v", tt.name, got.ElevationGain, tt.gain)
+		}
+
+		var splits []float64
+		for _, s := range got.Splits {
+			splits = append(splits, s.Distance)
+		}
+		if !reflect.DeepEqual(splits, tt.splits) {
+			t.Errorf("%s: split distances = %v, want %v", tt.name, splits, tt.splits)
+		}
+
+		want := round(float64(len(tr.points)-1)*step, 1)
+		if math.Abs(got.Distance-want) > 0.1 {
+			t.Errorf("%s: distance = %v, want %v", tt.name, got.Distance, want)
+		}
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{`<?xml version="1.0"?><gpx version="1.1"></gpx>`, FormatGPX},
+		{`<TrainingCenterDatabase></TrainingCenterDatabase>`, FormatTCX},
+		{`<kml></kml>`, ""},
+		{`not xml`, ""},
+	}
+
+	for _, tt := range tests {
+		if got := sniffFormat([]byte(tt.data)); got != tt.want {
+			t.Errorf("sniffFormat(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrackErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+	}{
+		{"one point", FormatGPX, gpxFixture("run", gpxPoint{0, 0, 0})},
+		{"bad time", FormatGPX, []byte(`<gpx><trk><trkseg><trkpt lat="0" lon="0"><time>noon</time></trkpt></trkseg></trk></gpx>`)},
+		{"unknown format", "fit", gpxFixture("run", gpxPoint{0, 0, 0}, gpxPoint{60, 0.001, 0})},
+		{"not xml", FormatTCX, []byte("not xml")},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseTrack(tt.format, tt.data); err == nil {
+			t.Errorf("%s: parseTrack succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestImportTrackDuplicate(t *testing.T) {
+	useMemoryStore(t)
+
+	data := tcxFixture("Running", 0,
+		tcxPoint{0, 0, 0, 0},
+		tcxPoint{600, 2000, 0, 0},
+	)
+
+	first, err := ImportTrack("al", "a", "", data, "", time.UTC)
+	if err != nil {
+		t.Fatalf("ImportTrack: %v", err)
+	}
+	if len(first.Activities) != 1 || first.DuplicateActivities != 0 {
+		t.Fatalf("first import = %d activities, %d duplicates, want 1 and 0", len(first.Activities), first.DuplicateActivities)
+	}
+
+	// 07:00 UTC is the day before in Honolulu, but it is still the same run.
+	hnl, err := time.LoadLocation("Pacific/Honolulu")
+	if err != nil {
+		t.Skipf("no zone data: %v", err)
+	}
+	again, err := ImportTrack("al", "a", FormatTCX, data, "", hnl)
+	if err != nil {
+		t.Fatalf("ImportTrack: %v", err)
+	}
+	if again.DuplicateActivities != 1 || again.Date != first.Date {
+		t.Errorf("second import = %d duplicates on %s, want 1 on %s", again.DuplicateActivities, again.Date, first.Date)
+	}
+}
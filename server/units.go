@@ -0,0 +1,473 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Weight units. Stored sets are always in kilograms, the canonical unit, and
+// keep the weight as it was logged so showing a set in its own unit is exact.
+const (
+	UnitKg = "kg"
+	UnitLb = "lb"
+)
+
+// kgPerLb is the international pound.
+const kgPerLb = 0.45359237
+
+// defaultIncrements are the smallest steps a bar can be loaded in by unit: a
+// pair of 1.25kg or 2.5lb plates.
+var defaultIncrements = map[string]float64{
+	UnitKg: 2.5,
+	UnitLb: 5,
+}
+
+// legacyUnitKey is the meta record, in the shared view of the store, holding
+// the unit of weights stored without one before weights were kept in
+// kilograms.
+const legacyUnitKey = "legacy-unit"
+
+// legacy holds the unit of legacy weights once Use has pinned it.
+var legacy atomic.Value
+
+// pinLegacyUnit loads the unit weights stored without one are read in. The
+// first time, it is the configured default unit, and it is stored so that
+// changing the default later does not change what those weights mean.
+func pinLegacyUnit(cfg Config) error {
+	var unit string
+	err := store.UpdateMeta(legacyUnitKey, &unit, func() error {
+		if _, ok := parseUnit(unit); ok {
+			return errUnchanged
+		}
+		unit, _ = parseUnit(cfg.Unit)
+		return nil
+	})
+	if err != nil && err != errUnchanged {
+		return err
+	}
+
+	legacy.Store(unit)
+	return nil
+}
+
+// legacyUnit is the unit of weights stored without one, from documents,
+// events and PRs written before weights were kept in kilograms.
+func legacyUnit() string {
+	if unit, ok := legacy.Load().(string); ok {
+		return unit
+	}
+
+	return UnitKg
+}
+
+// parseUnit returns the unit s names, accepting plurals and any case.
+func parseUnit(s string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "kg", "kgs":
+		return UnitKg, true
+	case "lb", "lbs":
+		return UnitLb, true
+	}
+
+	return "", false
+}
+
+// toKg converts a weight in unit to kilograms.
+func toKg(weight float64, unit string) float64 {
+	if unit == UnitLb {
+		return weight * kgPerLb
+	}
+
+	return weight
+}
+
+// fromKg converts a weight in kilograms to unit.
+func fromKg(weight float64, unit string) float64 {
+	if unit == UnitLb {
+		return weight / kgPerLb
+	}
+
+	return weight
+}
+
+// canonicalSet returns set, as written by a client, as it is stored. Its
+// weight is in its own unit, or in unit when it has none. LoggedWeight and
+// LoggedUnit are only ever shown, so any a client sends back are replaced.
+func canonicalSet(set Set, unit string) Set {
+	if u, ok := parseUnit(set.Unit); ok {
+		unit = u
+	}
+
+	set.LoggedWeight = set.Weight
+	set.LoggedUnit = unit
+	set.Weight = toKg(set.Weight, unit)
+	set.Unit = UnitKg
+
+	return set
+}
+
+// storedSet returns set, as found in the store or in an event, as it is
+// stored now. A set that says how it was logged is rebuilt from that, and one
+// from before weights were stored in kilograms is read as canonicalSet reads
+// it.
+func storedSet(set Set, unit string) Set {
+	if logged, ok := parseUnit(set.LoggedUnit); ok {
+		set.Weight, set.Unit = set.LoggedWeight, logged
+	}
+
+	return canonicalSet(set, unit)
+}
+
+// AsLogged returns a copy of doc with every weight in the unit it was logged
+// in and no LoggedWeight or LoggedUnit, as a client would write it, so that
+// Import stores the day exactly as it was.
+func AsLogged(doc *Document) *Document {
+	cp := copyDocument(doc)
+
+	for _, sets := range cp.Exercises {
+		for i, set := range sets {
+			if set.LoggedUnit != "" {
+				set.Weight, set.Unit = set.LoggedWeight, set.LoggedUnit
+			}
+			set.LoggedWeight, set.LoggedUnit = 0, ""
+			sets[i] = set
+		}
+	}
+
+	for i, a := range cp.Activities {
+		if a.LoggedUnit != "" {
+			a.Weight, a.Unit = a.LoggedWeight, a.LoggedUnit
+		}
+		a.LoggedWeight, a.LoggedUnit = 0, ""
+		cp.Activities[i] = a
+	}
+
+	if w := cp.Bodyweight; w != nil {
+		if w.LoggedUnit != "" {
+			w.Weight, w.Unit = w.LoggedWeight, w.LoggedUnit
+		}
+		w.LoggedWeight, w.LoggedUnit = 0, ""
+	}
+
+	return cp
+}
+
+// canonicalize converts every set, activity and weigh-in of d to the stored
+// form, reading weights without a unit as unit.
+func (d *Document) canonicalize(unit string) {
+	d.Version = SchemaVersion
+
+	for exName, sets := range d.Exercises {
+		for i := range sets {
+			d.Exercises[exName][i] = canonicalSet(sets[i], unit)
+		}
+	}
+
+	for i := range d.Activities {
+		d.Activities[i] = canonicalActivity(d.Activities[i], unit)
+	}
+
+	if d.Bodyweight != nil {
+		w := canonicalWeighin(*d.Bodyweight, unit)
+		d.Bodyweight = &w
+	}
+}
+
+// inputUnit is the unit the user's weights are read in when they do not name
+// one: the user's preferred unit, or the configured default.
+func inputUnit(user string) (string, error) {
+	units, err := UnitsFor(user, "")
+	if err != nil {
+		return "", err
+	}
+
+	return units.Unit, nil
+}
+
+// Units shows stored weights in one unit. Sets logged in another unit are
+// rounded to the nearest weight that can be loaded with Increment; totals and
+// estimates are converted exactly.
+type Units struct {
+	Unit      string  `json:"unit"`
+	Increment float64 `json:"increment"`
+}
+
+// UnitsFor returns how the user's weights are shown: in unit when it is
+// given, otherwise in the user's preferred unit or the configured default.
+func UnitsFor(user, unit string) (Units, error) {
+	var increments map[string]float64
+
+	if user != "" {
+		u, err := GetUser(user)
+		if err != nil && err != ErrNotFound {
+			return Units{}, err
+		}
+		if u != nil {
+			if unit == "" {
+				unit = u.Unit
+			}
+			increments = u.Increments
+		}
+	}
+
+	if unit == "" {
+		unit = defaultUnit()
+	}
+
+	parsed, ok := parseUnit(unit)
+	if !ok {
+		return Units{}, &InputError{
+			Status:  http.StatusBadRequest,
+			Code:    "invalid_query",
+			Message: "unit must be kg or lb",
+			Fields: []FieldError{{
+				Field:   "unit",
+				Message: "must be kg or lb",
+			}},
+		}
+	}
+
+	increment, ok := increments[parsed]
+	if !ok {
+		increment = defaultIncrements[parsed]
+	}
+
+	return Units{
+		Unit:      parsed,
+		Increment: increment,
+	}, nil
+}
+
+// requestUnits returns the units of the request's unit query parameter for
+// its user.
+func requestUnits(r *http.Request) (Units, error) {
+	return UnitsFor(requestUser(r), r.URL.Query().Get("unit"))
+}
+
+// weight converts a total or estimate in kilograms.
+func (u Units) weight(kg float64) float64 {
+	return round(fromKg(kg, u.Unit), 2)
+}
+
+// load converts the weight of a set in kilograms to the nearest loadable
+// weight.
+func (u Units) load(kg float64) float64 {
+	w := fromKg(kg, u.Unit)
+	if u.Increment > 0 {
+		w = math.Round(w/u.Increment) * u.Increment
+	}
+
+	return round(w, 2)
+}
+
+// set returns set in the unit. A set logged in the unit keeps its weight
+// exactly.
+func (u Units) set(set Set) Set {
+	if set.LoggedUnit == u.Unit {
+		set.Weight = set.LoggedWeight
+	} else {
+		set.Weight = u.load(set.Weight)
+	}
+	set.Unit = u.Unit
+
+	return set
+}
+
+func (u Units) sets(sets []Set) []Set {
+	if sets == nil {
+		return nil
+	}
+
+	shown := make([]Set, len(sets))
+	for i, set := range sets {
+		shown[i] = u.set(set)
+	}
+
+	return shown
+}
+
+// Document returns a copy of doc with every set in the unit.
+func (u Units) Document(doc *Document) *Document {
+	if doc == nil {
+		return nil
+	}
+
+	cp := *doc
+	cp.Exercises = make(map[string][]Set, len(doc.Exercises))
+	for exName, sets := range doc.Exercises {
+		cp.Exercises[exName] = u.sets(sets)
+	}
+	cp.Activities = u.activities(doc.Activities)
+	if doc.Bodyweight != nil {
+		w := u.weighin(*doc.Bodyweight)
+		cp.Bodyweight = &w
+	}
+
+	return &cp
+}
+
+func (u Units) documents(docs []*Document) []*Document {
+	shown := make([]*Document, len(docs))
+	for i, doc := range docs {
+		shown[i] = u.Document(doc)
+	}
+
+	return shown
+}
+
+// PRs returns copies of the PRs in the unit.
+func (u Units) PRs(prs []PR) []PR {
+	if prs == nil {
+		return nil
+	}
+
+	shown := make([]PR, len(prs))
+	for i, pr := range prs {
+		if pr.Type != PRReps {
+			pr.Value = u.weight(pr.Value)
+			pr.Previous = u.weight(pr.Previous)
+		}
+		pr.Weight = u.weight(pr.Weight)
+		pr.Bodyweight = u.weight(pr.Bodyweight)
+		pr.Unit = u.Unit
+		shown[i] = pr
+	}
+
+	return shown
+}
+
+// Response returns a copy of resp in the unit.
+func (u Units) Response(resp *WriteResponse) *WriteResponse {
+	if resp == nil {
+		return nil
+	}
+
+	cp := *resp
+	cp.Document = u.Document(resp.Document)
+	cp.PRs = u.PRs(resp.PRs)
+
+	return &cp
+}
+
+// comparison returns a copy of c in the unit.
+func (u Units) comparison(c Comparison) Comparison {
+	shown := c
+	shown.Unit = u.Unit
+	shown.Exercises = make([]ExerciseComparison, len(c.Exercises))
+
+	for i, ec := range c.Exercises {
+		ec.Volume = u.weight(ec.Volume)
+		ec.PreviousVolume = u.weight(ec.PreviousVolume)
+		ec.VolumeDelta = u.weight(ec.VolumeDelta)
+		ec.TopSetDelta = u.weight(ec.TopSetDelta)
+		if ec.TopSet != nil {
+			top := u.set(*ec.TopSet)
+			ec.TopSet = &top
+		}
+		if ec.PreviousTopSet != nil {
+			top := u.set(*ec.PreviousTopSet)
+			ec.PreviousTopSet = &top
+		}
+
+		reps := make([]WeightDelta, len(ec.Reps))
+		for j, wd := range ec.Reps {
+			wd.Weight = u.weight(wd.Weight)
+			reps[j] = wd
+		}
+		ec.Reps = reps
+
+		shown.Exercises[i] = ec
+	}
+
+	return shown
+}
+
+// points returns copies of the e1RM points in the unit.
+func (u Units) points(points []E1RMPoint) []E1RMPoint {
+	shown := make([]E1RMPoint, len(points))
+	for i, point := range points {
+		point.E1RM = u.weight(point.E1RM)
+		point.Weight = u.weight(point.Weight)
+		point.Bodyweight = u.weight(point.Bodyweight)
+		shown[i] = point
+	}
+
+	return shown
+}
+
+// activity returns the activity with its carried weight in the unit.
+func (u Units) activity(a Activity) Activity {
+	if a.Weight == 0 {
+		return a
+	}
+
+	set := u.set(Set{
+		Weight:       a.Weight,
+		LoggedWeight: a.LoggedWeight,
+		LoggedUnit:   a.LoggedUnit,
+	})
+	a.Weight, a.Unit = set.Weight, set.Unit
+
+	return a
+}
+
+func (u Units) activities(activities []Activity) []Activity {
+	if activities == nil {
+		return nil
+	}
+
+	shown := make([]Activity, len(activities))
+	for i, a := range activities {
+		shown[i] = u.activity(a)
+	}
+
+	return shown
+}
+
+// weighin returns the weigh-in in the unit. A weigh-in logged in the unit
+// keeps its weight exactly.
+func (u Units) weighin(w Weighin) Weighin {
+	if w.LoggedUnit == u.Unit {
+		w.Weight = w.LoggedWeight
+	} else {
+		w.Weight = u.weight(w.Weight)
+	}
+	w.Unit = u.Unit
+
+	return w
+}
+
+// history returns a copy of h with the sets of every event in the unit.
+func (u Units) history(h *DayHistory) *DayHistory {
+	shown := *h
+	shown.Events = make([]Event, len(h.Events))
+	for i, ev := range h.Events {
+		ev.Doc = u.Document(ev.Doc)
+
+		// Sets of events from before weights were stored in kilograms are
+		// converted first, as applying the event would.
+		if ev.Sets != nil {
+			sets := make([]Set, len(ev.Sets))
+			for j, set := range ev.Sets {
+				sets[j] = u.set(storedSet(set, legacyUnit()))
+			}
+			ev.Sets = sets
+		}
+
+		shown.Events[i] = ev
+	}
+
+	return &shown
+}
+
+// Weighins returns copies of the weigh-ins in the unit.
+func (u Units) Weighins(weighins []Weighin) []Weighin {
+	shown := make([]Weighin, len(weighins))
+	for i, w := range weighins {
+		shown[i] = u.weighin(w)
+	}
+
+	return shown
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUnit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"kg", UnitKg, true},
+		{" KGS ", UnitKg, true},
+		{"lb", UnitLb, true},
+		{"Lbs", UnitLb, true},
+		{"stone", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseUnit(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseUnit(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCanonicalSet(t *testing.T) {
+	tests := []struct {
+		name string
+		set  Set
+		unit string
+		want Set
+	}{
+		{
+			name: "no unit reads in the default",
+			set:  Set{Weight: 225, Reps: 5},
+			unit: UnitLb,
+			want: Set{Weight: 225 * kgPerLb, Unit: UnitKg, Reps: 5, LoggedWeight: 225, LoggedUnit: UnitLb},
+		},
+		{
+			name: "own unit wins over the default",
+			set:  Set{Weight: 100, Unit: "KG", Reps: 3},
+			unit: UnitLb,
+			want: Set{Weight: 100, Unit: UnitKg, Reps: 3, LoggedWeight: 100, LoggedUnit: UnitKg},
+		},
+		{
+			name: "logged weight sent back by a client is ignored",
+			set:  Set{Weight: 105, Unit: UnitKg, Reps: 1, LoggedWeight: 225, LoggedUnit: UnitLb},
+			unit: UnitKg,
+			want: Set{Weight: 105, Unit: UnitKg, Reps: 1, LoggedWeight: 105, LoggedUnit: UnitKg},
+		},
+		{
+			name: "bodyweight sets stay at zero",
+			set:  Set{Type: SetBodyweight, Reps: 10},
+			unit: UnitLb,
+			want: Set{Type: SetBodyweight, Unit: UnitKg, Reps: 10, LoggedUnit: UnitLb},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := canonicalSet(tt.set, tt.unit); got != tt.want {
+			t.Errorf("%s: canonicalSet(%+v, %q) = %+v, want %+v", tt.name, tt.set, tt.unit, got, tt.want)
+		}
+	}
+}
+
+func TestStoredSet(t *testing.T) {
+	stored := Set{Weight: 102.06, Unit: UnitKg, Reps: 1, LoggedWeight: 225, LoggedUnit: UnitLb}
+	want := Set{Weight: 225 * kgPerLb, Unit: UnitKg, Reps: 1, LoggedWeight: 225, LoggedUnit: UnitLb}
+	if got := storedSet(stored, UnitKg); got != want {
+		t.Errorf("storedSet(%+v) = %+v, want %+v", stored, got, want)
+	}
+
+	legacy := Set{Weight: 225, Reps: 5}
+	want = Set{Weight: 225 * kgPerLb, Unit: UnitKg, Reps: 5, LoggedWeight: 225, LoggedUnit: UnitLb}
+	if got := storedSet(legacy, UnitLb); got != want {
+		t.Errorf("storedSet(%+v) = %+v, want %+v", legacy, got, want)
+	}
+}
+
+func TestAsLogged(t *testing.T) {
+	doc := &Document{
+		Date: "2026-01-05",
+		Exercises: map[string][]Set{
+			"bench_press": {{Weight: 225, Unit: UnitLb, Reps: 5}, {Type: SetBodyweight, Reps: 10}},
+		},
+		Activities: []Activity{{Type: ActivityCarry, Duration: 60, Weight: 50, Unit: UnitLb}},
+		Bodyweight: &Weighin{Weight: 180, Unit: UnitLb},
+	}
+	doc.canonicalize(UnitKg)
+
+	// Stored again as a client's document, the day comes back exactly.
+	again := AsLogged(doc)
+	if got := again.Exercises["bench_press"][0]; got.Weight != 225 || got.Unit != UnitLb || got.LoggedUnit != "" {
+		t.Errorf("logged set = %+v, want 225lb without a logged weight", got)
+	}
+	again.canonicalize(UnitKg)
+	if !reflect.DeepEqual(again, doc) {
+		t.Errorf("canonicalize(AsLogged(doc)) = %+v, want %+v", again, doc)
+	}
+}
+
+func TestUnitsSet(t *testing.T) {
+	kg := Units{Unit: UnitKg, Increment: 2.5}
+	lb := Units{Unit: UnitLb, Increment: 5}
+	lbExact := Units{Unit: UnitLb}
+
+	tests := []struct {
+		name   string
+		units  Units
+		logged Set
+		want   float64
+	}{
+		{"same unit is exact", lb, Set{Weight: 227.5, Unit: UnitLb}, 227.5},
+		{"kg to lb rounds to the increment", lb, Set{Weight: 100, Unit: UnitKg}, 220},
+		{"lb to kg rounds to the increment", kg, Set{Weight: 225, Unit: UnitLb}, 102.5},
+		{"no increment rounds to two places", lbExact, Set{Weight: 100, Unit: UnitKg}, 220.46},
+		{"kg stays kg", kg, Set{Weight: 61.25, Unit: UnitKg}, 61.25},
+	}
+
+	for _, tt := range tests {
+		stored := canonicalSet(tt.logged, UnitKg)
+
+		got := tt.units.set(stored)
+		if got.Weight != tt.want || got.Unit != tt.units.Unit {
+			t.Errorf("%s: %+v.set(%+v) = %v%s, want %v%s", tt.name, tt.units, stored, got.Weight, got.Unit, tt.want, tt.units.Unit)
+		}
+	}
+}
+
+func TestConversionRoundTrip(t *testing.T) {
+	for _, w := range []float64{0, 1, 45, 102.5, 225, 1000} {
+		for _, unit := range []string{UnitKg, UnitLb} {
+			if got := fromKg(toKg(w, unit), unit); math.Abs(got-w) > 1e-9 {
+				t.Errorf("fromKg(toKg(%v, %s)) = %v", w, unit, got)
+			}
+		}
+	}
+
+	if got := toKg(1, UnitLb); got != kgPerLb {
+		t.Errorf("toKg(1, lb) = %v, want %v", got, kgPerLb)
+	}
+}
+
+func TestUnitsFor(t *testing.T) {
+	useMemoryStore(t)
+
+	if _, err := CreateUser("al", "Al", "password1"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := CreateUser("bo", "Bo", "password1"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	lb := UnitLb
+	if _, err := UpdateUser("bo", Preferences{Unit: &lb, Increments: map[string]float64{UnitLb: 2.5}}); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+
+	tests := []struct {
+		user string
+		unit string
+		want Units
+	}{
+		{"", "", Units{Unit: UnitKg, Increment: 2.5}},
+		{"al", "", Units{Unit: UnitKg, Increment: 2.5}},
+		{"al", "lbs", Units{Unit: UnitLb, Increment: 5}},
+		{"bo", "", Units{Unit: UnitLb, Increment: 2.5}},
+		{"bo", "kg", Units{Unit: UnitKg, Increment: 2.5}},
+	}
+
+	for _, tt := range tests {
+		got, err := UnitsFor(tt.user, tt.unit)
+		if err != nil {
+			t.Errorf("UnitsFor(%q, %q): %v", tt.user, tt.unit, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("UnitsFor(%q, %q) = %+v, want %+v", tt.user, tt.unit, got, tt.want)
+		}
+	}
+
+	if _, err := UnitsFor("al", "stone"); err == nil {
+		t.Errorf("UnitsFor(al, stone) succeeded, want an error")
+	}
+}
+
+func TestDocumentUpgradeUnits(t *testing.T) {
+	useMemoryStore(t)
+
+	tests := []struct {
+		name string
+		json string
+		want []Set
+	}{
+		{
+			name: "legacy weights read in the pinned unit",
+			json: `{"date":"2017-03-04","exercises":{"bench":{"100":5}}}`,
+			want: []Set{{Weight: 100, Unit: UnitKg, Reps: 5, LoggedWeight: 100, LoggedUnit: UnitKg}},
+		},
+		{
+			name: "version 2 weights keep their own unit",
+			json: `{"version":2,"date":"2017-03-04","exercises":{"bench":[{"weight":225,"unit":"lb","reps":5}]}}`,
+			want: []Set{{Weight: 225 * kgPerLb, Unit: UnitKg, Reps: 5, LoggedWeight: 225, LoggedUnit: UnitLb}},
+		},
+		{
+			name: "current documents are not converted again",
+			json: `{"version":3,"date":"2017-03-04","exercises":{"bench":[{"weight":102.5,"unit":"kg","reps":5,"logged_weight":225,"logged_unit":"lb"}]}}`,
+			want: []Set{{Weight: 102.5, Unit: UnitKg, Reps: 5, LoggedWeight: 225, LoggedUnit: UnitLb}},
+		},
+	}
+
+	for _, tt := range tests {
+		var doc Document
+		if err := json.Unmarshal([]byte(tt.json), &doc); err != nil {
+			t.Errorf("%s: Unmarshal: %v", tt.name, err)
+			continue
+		}
+		doc.upgradeUnits()
+
+		if doc.Version != SchemaVersion {
+			t.Errorf("%s: version = %d, want %d", tt.name, doc.Version, SchemaVersion)
+		}
+		got := doc.Exercises["bench"]
+		for i := range got {
+			got[i].Timestamp = time.Time{}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: sets = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLegacyUnitPinned(t *testing.T) {
+	s := NewMemoryStore()
+
+	use := func(unit string) {
+		t.Helper()
+
+		cfg := DefaultConfig()
+		cfg.Store = "memory"
+		cfg.Timezone = "UTC"
+		cfg.LogLevel = "error"
+		cfg.Unit = unit
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("cfg.Validate: %v", err)
+		}
+		if err := Use(cfg, s); err != nil {
+			t.Fatalf("Use: %v", err)
+		}
+	}
+
+	use(UnitLb)
+	// Changing the default afterwards leaves legacy weights in pounds.
+	use(UnitKg)
+
+	var doc Document
+	if err := json.Unmarshal([]byte(`{"date":"2017-03-04","exercises":{"bench":{"225":5}}}`), &doc); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	doc.upgradeUnits()
+
+	want := Set{Weight: 225 * kgPerLb, Unit: UnitKg, Reps: 5, LoggedWeight: 225, LoggedUnit: UnitLb}
+	got := doc.Exercises["bench"][0]
+	got.Timestamp = time.Time{}
+	if got != want {
+		t.Errorf("set = %+v, want %+v", got, want)
+	}
+}
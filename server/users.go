@@ -0,0 +1,719 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userKey holds the request's *principal in its context.
+const userKey contextKey = requestIDKey + 1
+
+const (
+	// userPrefix keys the account records in the root store.
+	userPrefix = "user:"
+	// emailPrefix keys the user ID of each linked email address in the
+	// root store.
+	emailPrefix = "email:"
+	// pendingEmailPrefix keys the verification of an address being linked
+	// in the root store.
+	pendingEmailPrefix = "email-pending:"
+	// mailTokenPrefix keys the user ID of each secret mail address token in
+	// the root store.
+	mailTokenPrefix = "mailtoken:"
+
+	// emailCodeTTL is how long a verification code can be used.
+	emailCodeTTL = 24 * time.Hour
+
+	passwordIterations = 50000
+	minPasswordLength  = 8
+)
+
+var userIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// usersMu serializes registrations so two requests cannot claim one ID.
+var usersMu sync.Mutex
+
+// User is an account. Each user's day documents live in their own view of
+// the store.
+type User struct {
+	ID           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	// Scopes bound what the user's logins may do. Accounts created before
+	// scopes existed get defaultScopes.
+	Scopes []string `json:"scopes,omitempty"`
+	// Emails are the verified addresses replies to mailed workouts are sent
+	// to.
+	Emails []string `json:"emails,omitempty"`
+	// MailToken is the secret part of the address the user mails workouts
+	// to. See MailAddress.
+	MailToken string `json:"mail_token,omitempty"`
+	// Unit is the weight unit the user's sets are shown in and read in when
+	// they do not name one. Empty is the configured default.
+	Unit string `json:"unit,omitempty"`
+	// Increments are the smallest steps, by unit, that the user can load a
+	// bar in. Units without one use defaultIncrements.
+	Increments map[string]float64 `json:"increments,omitempty"`
+	Created    time.Time          `json:"created"`
+}
+
+// Preferences are changes to a user's settings. Only the fields given are
+// changed; an increment of 0 restores the unit's default.
+type Preferences struct {
+	Name       *string            `json:"name"`
+	Unit       *string            `json:"unit"`
+	Increments map[string]float64 `json:"increments"`
+}
+
+// storeFor returns the user's view of the store. The empty user is the
+// shared keyspace that predates accounts.
+func storeFor(user string) WorkoutStore {
+	if user == "" {
+		return store
+	}
+
+	return store.User(user)
+}
+
+// requestUser returns the ID of the authenticated user of the request.
+func requestUser(r *http.Request) string {
+	if p, ok := r.Context().Value(userKey).(*principal); ok {
+		return p.User
+	}
+
+	return ""
+}
+
+// requestSession returns the session of the request's credentials.
+func requestSession(r *http.Request) string {
+	if p, ok := r.Context().Value(userKey).(*principal); ok {
+		return p.Session
+	}
+
+	return ""
+}
+
+// GetUser returns the account with the ID.
+func GetUser(id string) (*User, error) {
+	user := User{}
+	if err := store.GetMeta(userPrefix+id, &user); err != nil {
+		return nil, err
+	}
+
+	if len(user.Scopes) == 0 {
+		user.Scopes = defaultScopes
+	}
+
+	return &user, nil
+}
+
+// CreateUser registers an account. The password is stored hashed.
+func CreateUser(id, name, password string) (*User, error) {
+	var fields []FieldError
+	if !userIDPattern.MatchString(id) {
+		fields = append(fields, FieldError{
+			Field:   "id",
+			Message: "must be 1 to 32 lowercase letters, digits, dashes or underscores",
+		})
+	}
+	if len(password) < minPasswordLength {
+		fields = append(fields, FieldError{
+			Field:   "password",
+			Message: "must be at least " + strconv.Itoa(minPasswordLength) + " characters",
+		})
+	}
+	if len(fields) > 0 {
+		return nil, &InputError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_user",
+			Message: "the user has invalid fields",
+			Fields:  fields,
+		}
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if _, err := GetUser(id); err == nil {
+		return nil, &InputError{
+			Status:  http.StatusConflict,
+			Code:    "user_exists",
+			Message: "user " + id + " already exists",
+		}
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		ID:           id,
+		Name:         name,
+		PasswordHash: hash,
+		Scopes:       defaultScopes,
+		Created:      time.Now().UTC(),
+	}
+
+	return user, store.PutMeta(userPrefix+id, user)
+}
+
+// UpdateUser applies prefs to the account with the ID.
+func UpdateUser(id string, prefs Preferences) (*User, error) {
+	var fields []FieldError
+
+	unit := ""
+	if prefs.Unit != nil && *prefs.Unit != "" {
+		var ok bool
+		if unit, ok = parseUnit(*prefs.Unit); !ok {
+			fields = append(fields, FieldError{
+				Field:   "unit",
+				Message: "must be kg or lb",
+			})
+		}
+	}
+
+	increments := map[string]float64{}
+	for name, increment := range prefs.Increments {
+		u, ok := parseUnit(name)
+		if !ok {
+			fields = append(fields, FieldError{
+				Field:   "increments." + name,
+				Message: "must be kg or lb",
+			})
+			continue
+		}
+		if increment < 0 {
+			fields = append(fields, FieldError{
+				Field:   "increments." + name,
+				Message: "must not be negative",
+			})
+			continue
+		}
+		increments[u] = increment
+	}
+
+	if len(fields) > 0 {
+		sort.Slice(fields, func(i, j int) bool {
+			return fields[i].Field < fields[j].Field
+		})
+		return nil, &InputError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_user",
+			Message: "the preferences have invalid fields",
+			Fields:  fields,
+		}
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	user, err := GetUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if prefs.Name != nil {
+		user.Name = *prefs.Name
+	}
+	if prefs.Unit != nil {
+		user.Unit = unit
+	}
+	for u, increment := range increments {
+		if increment == 0 {
+			delete(user.Increments, u)
+			continue
+		}
+		if user.Increments == nil {
+			user.Increments = map[string]float64{}
+		}
+		user.Increments[u] = increment
+	}
+
+	return user, store.PutMeta(userPrefix+id, user)
+}
+
+// pendingEmail is an address waiting for its owner to confirm it.
+type pendingEmail struct {
+	User     string    `json:"user"`
+	CodeHash string    `json:"code_hash"`
+	Expires  time.Time `json:"expires"`
+}
+
+// LinkEmail starts linking the address to the user by mailing it a
+// verification code, which VerifyEmail takes to finish. Replies to mailed
+// workouts only go to linked addresses, and an address belongs to one user
+// at a time.
+func LinkEmail(id, address string) error {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return &InputError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_email",
+			Message: fmt.Sprintf("invalid email address %q", address),
+		}
+	}
+	email := strings.ToLower(addr.Address)
+
+	code, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+
+	if err := putPendingEmail(id, email, code); err != nil {
+		return err
+	}
+
+	return sendVerification(email, code)
+}
+
+// putPendingEmail records the code an address being linked to the user is
+// verified with.
+func putPendingEmail(id, email, code string) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if _, err := GetUser(id); err == ErrNotFound {
+		return fmt.Errorf("user %s does not exist", id)
+	} else if err != nil {
+		return err
+	}
+
+	owner, err := userByEmail(email)
+	if err == nil && owner != id {
+		return &InputError{
+			Status:  http.StatusConflict,
+			Code:    "email_taken",
+			Message: email + " is linked to another user",
+		}
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(code))
+
+	return store.PutMeta(pendingEmailPrefix+email, pendingEmail{
+		User:     id,
+		CodeHash: hex.EncodeToString(sum[:]),
+		Expires:  time.Now().Add(emailCodeTTL).UTC(),
+	})
+}
+
+// VerifyEmail finishes linking the address to the user with the code
+// LinkEmail mailed to it.
+func VerifyEmail(id, address, code string) error {
+	email := strings.ToLower(strings.TrimSpace(address))
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	invalid := &InputError{
+		Status:  http.StatusForbidden,
+		Code:    "invalid_code",
+		Message: "the code is wrong or has expired; link the address again for a new one",
+	}
+
+	pending := pendingEmail{}
+	if err := store.GetMeta(pendingEmailPrefix+email, &pending); err == ErrNotFound {
+		return invalid
+	} else if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	if pending.User != id || time.Now().After(pending.Expires) ||
+		subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(pending.CodeHash)) != 1 {
+		return invalid
+	}
+
+	user, err := GetUser(id)
+	if err != nil {
+		return err
+	}
+
+	if err := store.PutMeta(emailPrefix+email, id); err != nil {
+		return err
+	}
+	if err := store.DeleteMeta(pendingEmailPrefix + email); err != nil && err != ErrNotFound {
+		return err
+	}
+
+	for _, linked := range user.Emails {
+		if linked == email {
+			return nil
+		}
+	}
+	user.Emails = append(user.Emails, email)
+
+	return store.PutMeta(userPrefix+id, user)
+}
+
+// UnlinkEmail stops replies to mailed workouts going to the address.
+func UnlinkEmail(address string) error {
+	email := strings.ToLower(strings.TrimSpace(address))
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	id, err := userByEmail(email)
+	if err != nil {
+		return err
+	}
+
+	if err := store.DeleteMeta(emailPrefix + email); err != nil {
+		return err
+	}
+
+	user, err := GetUser(id)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	kept := user.Emails[:0]
+	for _, linked := range user.Emails {
+		if linked != email {
+			kept = append(kept, linked)
+		}
+	}
+	user.Emails = kept
+
+	return store.PutMeta(userPrefix+id, user)
+}
+
+// MailAddress returns the address the user mails workouts to, giving the
+// user one the first time. With rotate the user gets a new address and the
+// old one stops working.
+func MailAddress(id string, rotate bool) (string, error) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	user, err := GetUser(id)
+	if err == ErrNotFound {
+		return "", fmt.Errorf("user %s does not exist", id)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if user.MailToken == "" || rotate {
+		token, err := randomHex(10)
+		if err != nil {
+			return "", err
+		}
+
+		if err := store.PutMeta(mailTokenPrefix+token, id); err != nil {
+			return "", err
+		}
+		if user.MailToken != "" {
+			if err := store.DeleteMeta(mailTokenPrefix + user.MailToken); err != nil && err != ErrNotFound {
+				return "", err
+			}
+		}
+
+		user.MailToken = token
+		if err := store.PutMeta(userPrefix+id, user); err != nil {
+			return "", err
+		}
+	}
+
+	return mailAddress(loadSettings().cfg.Mail.From, user.MailToken), nil
+}
+
+// mailAddress is the subaddress of the server's own address for token, so
+// mail.from of workout_server@example.com gives
+// workout_server+<token>@example.com.
+func mailAddress(from, token string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return token
+	}
+
+	at := strings.LastIndexByte(addr.Address, '@')
+	if at < 0 {
+		return addr.Address + "+" + token
+	}
+
+	return addr.Address[:at] + "+" + token + addr.Address[at:]
+}
+
+// userByMailToken returns the ID of the user whose mail address has the
+// token.
+func userByMailToken(token string) (string, error) {
+	var id string
+	if err := store.GetMeta(mailTokenPrefix+strings.ToLower(token), &id); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// userByEmail returns the ID of the user the address is linked to.
+func userByEmail(email string) (string, error) {
+	var id string
+	if err := store.GetMeta(emailPrefix+strings.ToLower(email), &id); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// authenticate returns the user whose password matches.
+func authenticate(id, password string) (*User, bool) {
+	user, err := GetUser(id)
+	if err != nil {
+		return nil, false
+	}
+
+	return user, checkPassword(user.PasswordHash, password)
+}
+
+// users serves /v1/users: POST registers an account.
+func users(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+		return
+	}
+
+	req := struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	user, err := CreateUser(req.ID, req.Name, req.Password)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	user.PasswordHash = ""
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// me serves /v1/users/me: GET returns the caller's account and PATCH changes
+// its preferences.
+func me(w http.ResponseWriter, r *http.Request) {
+	id := requestUser(r)
+	if id == "" {
+		writeError(w, r, http.StatusNotFound, "not_found", "the credentials do not belong to an account")
+		return
+	}
+
+	var (
+		user *User
+		err  error
+	)
+
+	switch r.Method {
+	case http.MethodGet:
+		user, err = GetUser(id)
+
+	case http.MethodPatch:
+		body, rerr := ioutil.ReadAll(r.Body)
+		if rerr != nil {
+			writeError(w, r, http.StatusBadRequest, "unreadable_body", "could not read request body")
+			return
+		}
+
+		prefs := Preferences{}
+		if err := json.Unmarshal(body, &prefs); err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+			return
+		}
+
+		user, err = UpdateUser(id, prefs)
+
+	default:
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	user.PasswordHash = ""
+	writeJSON(w, http.StatusOK, user)
+}
+
+// hashPassword derives a salted PBKDF2-HMAC-SHA256 hash of the password.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2([]byte(password), salt, passwordIterations)
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s",
+		passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// checkPassword reports whether password matches a hash from hashPassword.
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iterations), want) == 1
+}
+
+// pbkdf2 derives a single SHA-256 sized block as in RFC 8018.
+func pbkdf2(password, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+
+	return key
+}
+
+// MigrateLegacy moves the day documents between from and to out of the
+// shared keyspace that predates accounts and into the user's, merging with
+// any days the user already has. The shared keyspace's PRs are recomputed
+// without the moved days. It returns the number of days moved. The shared
+// keyspace is locked for the whole migration, and a day another process
+// changes meanwhile stops it with ErrConflict.
+func MigrateLegacy(user, from, to string) (int, error) {
+	if _, err := GetUser(user); err != nil {
+		if err == ErrNotFound {
+			return 0, fmt.Errorf("user %s does not exist", user)
+		}
+		return 0, err
+	}
+
+	// Import takes the user's lock while this is held.
+	defer lockUser("")()
+
+	docs, err := store.Range(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	// Import reads the documents as a client's, in the units they were
+	// logged in; the shared keyspace's events keep them as they were stored.
+	stored := make([]*Document, len(docs))
+	for i, doc := range docs {
+		stored[i] = doc
+		docs[i] = AsLogged(doc)
+	}
+
+	if err := Import(user, "migrate", docs, true); err != nil {
+		return 0, err
+	}
+
+	var weighed weighedSpan
+	for _, doc := range stored {
+		_, err := store.Update(doc.Date, func(current *Document) (*Document, error) {
+			if !sameDocument(current, doc) {
+				return nil, ErrConflict
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		e1rms.invalidate("", doc.Date)
+
+		if err := indexWeighin("", doc.Date, nil, &weighed); err != nil {
+			return 0, err
+		}
+
+		err = recordWrite("", doc, nil, Event{
+			Source: "migrate",
+			Action: "migrate",
+			Type:   EventReplace,
+			Date:   doc.Date,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := weighed.refresh(""); err != nil {
+		return 0, err
+	}
+
+	if len(stored) > 0 {
+		// The moved days no longer hold the shared keyspace's PRs; days
+		// left outside the range keep theirs.
+		seen := map[string]bool{}
+		var exercises []string
+		for _, doc := range stored {
+			for _, exName := range exerciseNames(doc) {
+				if !seen[exName] {
+					seen[exName] = true
+					exercises = append(exercises, exName)
+				}
+			}
+		}
+		sort.Strings(exercises)
+
+		if _, err := updatePRs("", stored[0].Date, stored[len(stored)-1].Date, exercises); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(docs), nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestMigrateLegacy(t *testing.T) {
+	const (
+		mon = "2026-01-05"
+		tue = "2026-01-06"
+	)
+
+	useMemoryStore(t)
+
+	logSets(t, "", "cli", mon, "squat", Set{Weight: 225, Unit: UnitLb, Reps: 5})
+	logSets(t, "", "cli", tue, "squat", Set{Weight: 100, Reps: 5}, Set{Weight: 100, Reps: 5})
+	logSets(t, "al", "a", tue, "squat", Set{Weight: 110, Reps: 3})
+	if _, err := CreateUser("al", "", "password1"); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	moved, err := MigrateLegacy("al", mon, tue)
+	if err != nil {
+		t.Fatalf("MigrateLegacy: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("moved %d days, want 2", moved)
+	}
+
+	if got := setCounts(t, "", mon, tue); len(got) != 0 {
+		t.Errorf("shared sets by day = %v, want none", got)
+	}
+	if got := setCounts(t, "al", mon, tue); got[mon] != 1 || got[tue] != 3 {
+		t.Errorf("al's sets by day = %v, want 1 on %s and 3 on %s", got, mon, tue)
+	}
+
+	// The moved sets keep the unit they were logged in.
+	doc, err := storeFor("al").Get(mon)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if set := doc.Exercises["back_squat"][0]; set.LoggedWeight != 225 || set.LoggedUnit != UnitLb {
+		t.Errorf("moved set = %+v, want logged as 225lb", set)
+	}
+
+	if _, err := MigrateLegacy("bo", mon, tue); err == nil {
+		t.Errorf("MigrateLegacy for a missing user succeeded, want an error")
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxRangeDays bounds a single range query so a typo in a year cannot
+	// make the store scan decades of days.
+	maxRangeDays = 366
+
+	defaultPageSize = 31
+	maxPageSize     = 366
+)
+
+// WorkoutPage is one page of a range query. Next is the from date of the
+// following page and is empty on the last page.
+type WorkoutPage struct {
+	Workouts []*Document `json:"workouts"`
+	Next     string      `json:"next,omitempty"`
+}
+
+// workouts serves /v1/workouts: GET lists a date range, POST logs sets.
+func workouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		listWorkouts(w, r)
+
+	case http.MethodPost:
+		handler(w, r)
+
+	default:
+		writeMethodNotAllowed(w, r)
+	}
+}
+
+// listWorkouts returns the day documents between the from and to query
+// parameters inclusive. to defaults to today and from to 30 days before it.
+// Weights are in the unit query parameter's unit.
+func listWorkouts(w http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+
+	to, err := queryDate(query.Get("to"), time.Now().In(loc).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "to",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	from, err := queryDate(query.Get("from"), to.AddDate(0, 0, -30).Format(dateLayout))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", err.Error(), FieldError{
+			Field:   "from",
+			Message: err.Error(),
+		})
+		return
+	}
+
+	if from.After(to) {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "from must not be after to")
+		return
+	}
+
+	if to.Sub(from) >= maxRangeDays*24*time.Hour {
+		writeError(w, r, http.StatusBadRequest, "invalid_query", "range must not exceed "+strconv.Itoa(maxRangeDays)+" days")
+		return
+	}
+
+	limit := defaultPageSize
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, r, http.StatusBadRequest, "invalid_query", "limit must be between 1 and "+strconv.Itoa(maxPageSize), FieldError{
+				Field:   "limit",
+				Message: "must be between 1 and " + strconv.Itoa(maxPageSize),
+			})
+			return
+		}
+	}
+
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	docs, err := storeFor(requestUser(r)).Range(from.Format(dateLayout), to.Format(dateLayout))
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	page := WorkoutPage{
+		Workouts: units.documents(docs),
+	}
+
+	if len(docs) > limit {
+		page.Workouts = page.Workouts[:limit]
+
+		last, _ := time.Parse(dateLayout, docs[limit-1].Date)
+		page.Next = last.AddDate(0, 0, 1).Format(dateLayout)
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// getWorkout serves GET /v1/workouts/{date}.
+func getWorkout(w http.ResponseWriter, r *http.Request, date string) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r)
+		return
+	}
+
+	writeDay(w, r, date)
+}
+
+// getToday serves /today, the current day in the request's timezone.
+func getToday(w http.ResponseWriter, r *http.Request) {
+	loc, err := requestLocation(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_timezone", err.Error())
+		return
+	}
+
+	writeDay(w, r, time.Now().In(loc).Format(dateLayout))
+}
+
+// writeDay writes the user's day in the unit query parameter's unit.
+func writeDay(w http.ResponseWriter, r *http.Request, date string) {
+	units, err := requestUnits(r)
+	if err != nil {
+		writeLogError(w, r, err)
+		return
+	}
+
+	doc, err := storeFor(requestUser(r)).Get(date)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, units.Document(doc))
+}
+
+// queryDate parses a YYYY-MM-DD query parameter, using def when it is empty.
+func queryDate(raw, def string) (time.Time, error) {
+	if raw == "" {
+		raw = def
+	}
+
+	t, err := time.Parse(dateLayout, raw)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q: expected YYYY-MM-DD", raw)
+	}
+
+	return t, nil
+}